@@ -0,0 +1,174 @@
+// Package anthropic is a client of the Anthropic Messages API
+package anthropic
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"time"
+)
+
+const (
+	defaultBaseURL = "https://api.anthropic.com/v1"
+	defaultVersion = "2023-06-01"
+	// Streamed answers with extended thinking can take a long time
+	defaultTimeout = 10000 * time.Minute
+)
+
+var dataPrefix = []byte("data: ")
+
+// A Client is an API client to communicate with the Anthropic Messages API
+type Client interface {
+	// Messages creates a message, the answer of the model to the conversation
+	Messages(ctx context.Context, request MessagesRequest) (*MessagesResponse, error)
+
+	// MessagesStream creates a message and streams the server-sent events through
+	// multiple calls to onEvent. Returns when the message_stop event is received.
+	MessagesStream(ctx context.Context, request MessagesRequest, onEvent func(*StreamEvent)) error
+}
+
+type client struct {
+	baseURL    string
+	apiKey     string
+	version    string
+	headers    map[string]string
+	httpClient *http.Client
+}
+
+// NewClient returns a new Anthropic API client. An apiKey is required by api.anthropic.com
+func NewClient(apiKey string, options ...ClientOption) Client {
+	c := &client{
+		baseURL: defaultBaseURL,
+		apiKey:  apiKey,
+		version: defaultVersion,
+		httpClient: &http.Client{
+			Timeout: defaultTimeout,
+		},
+	}
+	for _, o := range options {
+		o(c)
+	}
+	return c
+}
+
+func (c *client) Messages(ctx context.Context, request MessagesRequest) (*MessagesResponse, error) {
+	request.Stream = false
+	req, err := c.newRequest(ctx, request)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := c.performRequest(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	output := new(MessagesResponse)
+	if err := json.NewDecoder(resp.Body).Decode(output); err != nil {
+		return nil, fmt.Errorf("invalid json response: %w", err)
+	}
+	return output, nil
+}
+
+func (c *client) MessagesStream(ctx context.Context, request MessagesRequest, onEvent func(*StreamEvent)) error {
+	request.Stream = true
+	req, err := c.newRequest(ctx, request)
+	if err != nil {
+		return err
+	}
+	resp, err := c.performRequest(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	reader := bufio.NewReader(resp.Body)
+	for {
+		line, err := reader.ReadBytes('\n')
+		if err != nil {
+			if err == io.EOF {
+				return io.ErrUnexpectedEOF
+			}
+			return err
+		}
+		// The event name is repeated in the type field of the data, so only data lines are read
+		line = bytes.TrimSpace(line)
+		if !bytes.HasPrefix(line, dataPrefix) {
+			continue
+		}
+		event := new(StreamEvent)
+		if err := json.Unmarshal(bytes.TrimPrefix(line, dataPrefix), event); err != nil {
+			return fmt.Errorf("invalid json stream data: %w", err)
+		}
+		switch event.Type {
+		case EventError:
+			if event.Error != nil {
+				return *event.Error
+			}
+			return fmt.Errorf("stream error: %s", line)
+		case EventPing:
+			continue
+		}
+		onEvent(event)
+		if event.Type == EventMessageStop {
+			return nil
+		}
+	}
+}
+
+func (c *client) newRequest(ctx context.Context, request MessagesRequest) (*http.Request, error) {
+	body, err := json.Marshal(request)
+	if err != nil {
+		return nil, fmt.Errorf("failed encoding json: %w", err)
+	}
+	req, err := http.NewRequestWithContext(ctx, "POST", c.baseURL+"/messages", bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("anthropic-version", c.version)
+	if len(c.apiKey) > 0 {
+		req.Header.Set("x-api-key", c.apiKey)
+	}
+	for key, value := range c.headers {
+		req.Header.Set(key, value)
+	}
+	return req, nil
+}
+
+func (c *client) performRequest(req *http.Request) (*http.Response, error) {
+	resp, err := c.httpClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if err := checkForSuccess(resp); err != nil {
+		return nil, err
+	}
+	return resp, nil
+}
+
+// returns an error if this response includes an error.
+func checkForSuccess(resp *http.Response) error {
+	if resp.StatusCode >= 200 && resp.StatusCode < 300 {
+		return nil
+	}
+	defer resp.Body.Close()
+	data, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return fmt.Errorf("failed to read from body: %w", err)
+	}
+	var result APIErrorResponse
+	if err := json.Unmarshal(data, &result); err != nil || result.Error.Message == "" {
+		return APIError{
+			StatusCode: resp.StatusCode,
+			Type:       "Unexpected",
+			Message:    string(data),
+		}
+	}
+	result.Error.StatusCode = resp.StatusCode
+	return result.Error
+}
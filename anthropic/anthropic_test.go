@@ -0,0 +1,241 @@
+package anthropic
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+const testStream = `event: message_start
+data: {"type":"message_start","message":{"id":"msg_1","type":"message","role":"assistant","model":"claude-test","content":[],"usage":{"input_tokens":25,"output_tokens":1}}}
+
+event: content_block_start
+data: {"type":"content_block_start","index":0,"content_block":{"type":"text","text":""}}
+
+event: ping
+data: {"type":"ping"}
+
+event: content_block_delta
+data: {"type":"content_block_delta","index":0,"delta":{"type":"text_delta","text":"Hello"}}
+
+event: content_block_delta
+data: {"type":"content_block_delta","index":0,"delta":{"type":"text_delta","text":", world"}}
+
+event: content_block_stop
+data: {"type":"content_block_stop","index":0}
+
+event: content_block_start
+data: {"type":"content_block_start","index":1,"content_block":{"type":"tool_use","id":"toolu_1","name":"google_search","input":{}}}
+
+event: content_block_delta
+data: {"type":"content_block_delta","index":1,"delta":{"type":"input_json_delta","partial_json":""}}
+
+event: content_block_delta
+data: {"type":"content_block_delta","index":1,"delta":{"type":"input_json_delta","partial_json":"{\"query\": \"go"}}
+
+event: content_block_delta
+data: {"type":"content_block_delta","index":1,"delta":{"type":"input_json_delta","partial_json":"lang\"}"}}
+
+event: content_block_stop
+data: {"type":"content_block_stop","index":1}
+
+event: message_delta
+data: {"type":"message_delta","delta":{"type":"","stop_reason":"tool_use"},"usage":{"output_tokens":42}}
+
+event: message_stop
+data: {"type":"message_stop"}
+
+`
+
+// newTestServer answers the requests to /messages with the handler and checks the headers
+func newTestServer(t *testing.T, handler func(w http.ResponseWriter, request MessagesRequest)) (*httptest.Server, Client) {
+	t.Helper()
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost || r.URL.Path != "/v1/messages" {
+			t.Errorf("unexpected request %s %s", r.Method, r.URL.Path)
+		}
+		if key := r.Header.Get("x-api-key"); key != "test-key" {
+			t.Errorf("x-api-key = %q", key)
+		}
+		if version := r.Header.Get("anthropic-version"); version != defaultVersion {
+			t.Errorf("anthropic-version = %q", version)
+		}
+		if beta := r.Header.Get("anthropic-beta"); beta != "test-beta" {
+			t.Errorf("anthropic-beta = %q", beta)
+		}
+		request := MessagesRequest{}
+		if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+			t.Errorf("invalid request body: %v", err)
+		}
+		handler(w, request)
+	}))
+	t.Cleanup(server.Close)
+	client := NewClient("test-key", WithBaseURL(server.URL+"/v1"), WithHeaders(map[string]string{"anthropic-beta": "test-beta"}))
+	return server, client
+}
+
+func TestMessagesStream(t *testing.T) {
+	_, client := newTestServer(t, func(w http.ResponseWriter, request MessagesRequest) {
+		if !request.Stream {
+			t.Error("stream is not set")
+		}
+		w.Header().Set("Content-Type", "text/event-stream")
+		io.WriteString(w, testStream)
+	})
+
+	events := []*StreamEvent{}
+	err := client.MessagesStream(context.Background(), MessagesRequest{Model: "claude-test", MaxTokens: 100}, func(event *StreamEvent) {
+		events = append(events, event)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	text := ""
+	arguments := ""
+	for _, event := range events {
+		if event.Type == EventPing {
+			t.Error("ping events must be skipped")
+		}
+		if event.Type != EventContentBlockDelta {
+			continue
+		}
+		switch event.Delta.Type {
+		case DeltaTypeText:
+			text += event.Delta.Text
+		case DeltaTypeInputJSON:
+			if event.Index != 1 {
+				t.Errorf("input_json_delta of block %d", event.Index)
+			}
+			arguments += event.Delta.PartialJSON
+		}
+	}
+	if text != "Hello, world" {
+		t.Errorf("text = %q", text)
+	}
+	if arguments != `{"query": "golang"}` {
+		t.Errorf("arguments = %q", arguments)
+	}
+
+	first := events[0]
+	if first.Type != EventMessageStart || first.Message == nil || first.Message.Usage.InputTokens != 25 {
+		t.Errorf("message_start = %+v", first)
+	}
+	toolStart := events[5]
+	if toolStart.Type != EventContentBlockStart || toolStart.ContentBlock.Type != BlockTypeToolUse ||
+		toolStart.ContentBlock.ID != "toolu_1" || toolStart.ContentBlock.Name != "google_search" {
+		t.Errorf("tool_use content_block_start = %+v", toolStart)
+	}
+	delta := events[len(events)-2]
+	if delta.Type != EventMessageDelta || delta.Delta.StopReason != "tool_use" || delta.Usage == nil || delta.Usage.OutputTokens != 42 {
+		t.Errorf("message_delta = %+v", delta)
+	}
+	if last := events[len(events)-1]; last.Type != EventMessageStop {
+		t.Errorf("last event = %s", last.Type)
+	}
+}
+
+func TestMessagesStreamErrorEvent(t *testing.T) {
+	_, client := newTestServer(t, func(w http.ResponseWriter, request MessagesRequest) {
+		io.WriteString(w, "event: message_start\ndata: {\"type\":\"message_start\",\"message\":{\"usage\":{\"input_tokens\":1}}}\n\n"+
+			"event: error\ndata: {\"type\":\"error\",\"error\":{\"type\":\"overloaded_error\",\"message\":\"Overloaded\"}}\n\n")
+	})
+	err := client.MessagesStream(context.Background(), MessagesRequest{}, func(*StreamEvent) {})
+	apiErr := APIError{}
+	if !errors.As(err, &apiErr) || apiErr.Type != "overloaded_error" || apiErr.Message != "Overloaded" {
+		t.Errorf("err = %v", err)
+	}
+}
+
+func TestMessagesStreamUnexpectedEOF(t *testing.T) {
+	_, client := newTestServer(t, func(w http.ResponseWriter, request MessagesRequest) {
+		io.WriteString(w, strings.SplitAfter(testStream, "\n\n")[0])
+	})
+	err := client.MessagesStream(context.Background(), MessagesRequest{}, func(*StreamEvent) {})
+	if !errors.Is(err, io.ErrUnexpectedEOF) {
+		t.Errorf("err = %v", err)
+	}
+}
+
+func TestMessages(t *testing.T) {
+	_, client := newTestServer(t, func(w http.ResponseWriter, request MessagesRequest) {
+		if request.Stream {
+			t.Error("stream is set")
+		}
+		if request.Model != "claude-test" || request.MaxTokens != 100 || request.System != "Be brief" || len(request.Messages) != 1 {
+			t.Errorf("request = %+v", request)
+		}
+		io.WriteString(w, `{"id":"msg_1","type":"message","role":"assistant","model":"claude-test",
+			"content":[{"type":"text","text":"Hi"},{"type":"tool_use","id":"toolu_1","name":"http_get","input":{"url":"https://example.com"}},{"type":"text","text":" there"}],
+			"stop_reason":"tool_use","usage":{"input_tokens":10,"output_tokens":5}}`)
+	})
+
+	response, err := client.Messages(context.Background(), MessagesRequest{
+		Model:     "claude-test",
+		MaxTokens: 100,
+		System:    "Be brief",
+		Messages:  []Message{{Role: "user", Content: []ContentBlock{{Type: BlockTypeText, Text: "Hello"}}}},
+		Stream:    true,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if response.Text() != "Hi there" {
+		t.Errorf("text = %q", response.Text())
+	}
+	if response.StopReason != "tool_use" || response.Usage.InputTokens != 10 || response.Usage.OutputTokens != 5 {
+		t.Errorf("response = %+v", response)
+	}
+	toolUse := response.Content[1]
+	if toolUse.Type != BlockTypeToolUse || toolUse.ID != "toolu_1" || toolUse.Name != "http_get" ||
+		string(toolUse.Input) != `{"url":"https://example.com"}` {
+		t.Errorf("tool_use = %+v", toolUse)
+	}
+}
+
+func TestErrorResponses(t *testing.T) {
+	tests := []struct {
+		name    string
+		status  int
+		body    string
+		errType string
+		message string
+	}{
+		{"api error", http.StatusBadRequest, `{"type":"error","error":{"type":"invalid_request_error","message":"max_tokens: Field required"}}`, "invalid_request_error", "max_tokens: Field required"},
+		{"overloaded", 529, `{"type":"error","error":{"type":"overloaded_error","message":"Overloaded"}}`, "overloaded_error", "Overloaded"},
+		{"not json", http.StatusBadGateway, "<html>Bad Gateway</html>", "Unexpected", "<html>Bad Gateway</html>"},
+		{"no message", http.StatusInternalServerError, `{"type":"error"}`, "Unexpected", `{"type":"error"}`},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			_, client := newTestServer(t, func(w http.ResponseWriter, request MessagesRequest) {
+				w.WriteHeader(test.status)
+				io.WriteString(w, test.body)
+			})
+			for _, call := range []func() error{
+				func() error {
+					_, err := client.Messages(context.Background(), MessagesRequest{})
+					return err
+				},
+				func() error {
+					return client.MessagesStream(context.Background(), MessagesRequest{}, func(*StreamEvent) {
+						t.Error("no events are expected")
+					})
+				},
+			} {
+				apiErr := APIError{}
+				if err := call(); !errors.As(err, &apiErr) {
+					t.Fatalf("err = %v", err)
+				}
+				if apiErr.StatusCode != test.status || apiErr.Type != test.errType || apiErr.Message != test.message {
+					t.Errorf("err = %+v", apiErr)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,183 @@
+package anthropic
+
+import (
+	"encoding/json"
+	"fmt"
+)
+
+// Content block types
+const (
+	BlockTypeText       = "text"
+	BlockTypeImage      = "image"
+	BlockTypeToolUse    = "tool_use"
+	BlockTypeToolResult = "tool_result"
+	BlockTypeThinking   = "thinking"
+)
+
+// Streaming event types
+const (
+	EventMessageStart      = "message_start"
+	EventContentBlockStart = "content_block_start"
+	EventContentBlockDelta = "content_block_delta"
+	EventContentBlockStop  = "content_block_stop"
+	EventMessageDelta      = "message_delta"
+	EventMessageStop       = "message_stop"
+	EventPing              = "ping"
+	EventError             = "error"
+)
+
+// Delta types of content_block_delta events
+const (
+	DeltaTypeText      = "text_delta"
+	DeltaTypeInputJSON = "input_json_delta"
+)
+
+// APIError represents an error that occured on an API
+type APIError struct {
+	StatusCode int    `json:"status_code"`
+	Type       string `json:"type"`
+	Message    string `json:"message"`
+}
+
+func (e APIError) Error() string {
+	return fmt.Sprintf("[%d:%s] %s", e.StatusCode, e.Type, e.Message)
+}
+
+// APIErrorResponse is the full error response that has been returned by the API
+type APIErrorResponse struct {
+	Type  string   `json:"type"`
+	Error APIError `json:"error"`
+}
+
+// ImageSource is the source of an image block, either a URL or base64 data
+type ImageSource struct {
+	Type      string `json:"type"`
+	URL       string `json:"url,omitempty"`
+	MediaType string `json:"media_type,omitempty"`
+	Data      string `json:"data,omitempty"`
+}
+
+// ContentBlock is one block of a message. Which fields are set depends on Type.
+type ContentBlock struct {
+	Type string `json:"type"`
+
+	// text
+	Text string `json:"text,omitempty"`
+
+	// image
+	Source *ImageSource `json:"source,omitempty"`
+
+	// tool_use
+	ID    string          `json:"id,omitempty"`
+	Name  string          `json:"name,omitempty"`
+	Input json.RawMessage `json:"input,omitempty"`
+
+	// tool_result
+	ToolUseID string `json:"tool_use_id,omitempty"`
+	Content   string `json:"content,omitempty"`
+	IsError   bool   `json:"is_error,omitempty"`
+
+	// thinking
+	Thinking  string `json:"thinking,omitempty"`
+	Signature string `json:"signature,omitempty"`
+}
+
+// Message is a message of the conversation, the role is "user" or "assistant"
+type Message struct {
+	Role    string         `json:"role"`
+	Content []ContentBlock `json:"content"`
+}
+
+// InputSchema is the JSON schema of the tool input
+type InputSchema struct {
+	Type       string                 `json:"type"`
+	Properties map[string]interface{} `json:"properties"`
+	Required   []string               `json:"required,omitempty"`
+}
+
+type Tool struct {
+	Name        string      `json:"name"`
+	Description string      `json:"description,omitempty"`
+	InputSchema InputSchema `json:"input_schema"`
+}
+
+// Thinking enables extended thinking with the given budget of tokens
+type Thinking struct {
+	Type         string `json:"type"`
+	BudgetTokens int    `json:"budget_tokens"`
+}
+
+// MessagesRequest is a request for the Messages API
+type MessagesRequest struct {
+	Model string `json:"model"`
+	// MaxTokens is required by the API
+	MaxTokens int `json:"max_tokens"`
+	// System is the system prompt, there is no system role in the messages
+	System   string    `json:"system,omitempty"`
+	Messages []Message `json:"messages"`
+	Tools    []Tool    `json:"tools,omitempty"`
+
+	Temperature *float32  `json:"temperature,omitempty"`
+	Thinking    *Thinking `json:"thinking,omitempty"`
+
+	// Whether to stream back results or not. Don't set this value in the request yourself
+	// as it will be overriden depending on if you use MessagesStream or Messages methods.
+	Stream bool `json:"stream,omitempty"`
+}
+
+// Usage is the number of tokens used by the request
+type Usage struct {
+	InputTokens  int `json:"input_tokens"`
+	OutputTokens int `json:"output_tokens"`
+}
+
+// MessagesResponse is the full response from a request to the Messages API
+type MessagesResponse struct {
+	ID         string         `json:"id"`
+	Type       string         `json:"type"`
+	Role       string         `json:"role"`
+	Model      string         `json:"model"`
+	Content    []ContentBlock `json:"content"`
+	StopReason string         `json:"stop_reason"`
+	Usage      Usage          `json:"usage"`
+}
+
+// Text returns the text blocks of the response joined together
+func (r *MessagesResponse) Text() string {
+	text := ""
+	for _, block := range r.Content {
+		if block.Type == BlockTypeText {
+			text += block.Text
+		}
+	}
+	return text
+}
+
+// Delta is the payload of content_block_delta and message_delta events
+type Delta struct {
+	Type        string `json:"type"`
+	Text        string `json:"text"`
+	PartialJSON string `json:"partial_json"`
+	Thinking    string `json:"thinking"`
+
+	// message_delta
+	StopReason string `json:"stop_reason"`
+}
+
+// StreamEvent is one server-sent event of a streamed response
+type StreamEvent struct {
+	Type string `json:"type"`
+	// Index of the content block for content_block_* events
+	Index int `json:"index"`
+
+	// message_start
+	Message *MessagesResponse `json:"message,omitempty"`
+	// content_block_start
+	ContentBlock *ContentBlock `json:"content_block,omitempty"`
+	// content_block_delta and message_delta
+	Delta *Delta `json:"delta,omitempty"`
+	// message_delta, the output tokens so far
+	Usage *Usage `json:"usage,omitempty"`
+	// error
+	Error *APIError `json:"error,omitempty"`
+}
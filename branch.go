@@ -0,0 +1,124 @@
+package main
+
+import (
+	"log"
+	"strconv"
+	"strings"
+
+	gpt3 "chat_bot/gpt3"
+
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api/v5"
+)
+
+const branchCallbackPrefix = "branch:"
+
+// offerBranch asks whether to fork the conversation when the user replies to an older answer
+// of the bot. Returns true if the message will be answered after the user makes a choice.
+func offerBranch(bot *tgbotapi.BotAPI, message *tgbotapi.Message) bool {
+	replyTo := message.ReplyToMessage
+	if replyTo == nil || replyTo.From == nil || replyTo.From.ID != bot.Self.ID || message.Text == "" {
+		return false
+	}
+	chatID := message.Chat.ID
+	mu.Lock()
+	turnPos := findTurnLocked(chatID, replyTo.MessageID, true)
+	isLast := false
+	if turnPos >= 0 {
+		last, _ := lastTurnLocked(chatID)
+		isLast = activeConversationLocked(chatID).Turns[turnPos].Index == last.Index
+	}
+	mu.Unlock()
+	if turnPos < 0 || isLast {
+		return false
+	}
+
+	msg := tgbotapi.NewMessage(chatID, "Вы ответили на одно из предыдущих сообщений. Начать новую ветку беседы от этого ответа?")
+	msg.ReplyToMessageID = message.MessageID
+	msg.ReplyMarkup = tgbotapi.NewInlineKeyboardMarkup(
+		tgbotapi.NewInlineKeyboardRow(
+			tgbotapi.NewInlineKeyboardButtonData("🌿 Новая ветка", branchCallbackPrefix+"fork:"+strconv.Itoa(replyTo.MessageID)),
+			tgbotapi.NewInlineKeyboardButtonData("➡️ Продолжить", branchCallbackPrefix+"continue"),
+		),
+	)
+	if _, err := bot.Send(msg); err != nil {
+		log.Printf("Failed to send message: %v", err)
+		return false
+	}
+	return true
+}
+
+// forkConversation creates a new conversation with the history cut right after the answer
+// that contains replyMessageID and makes it active. The original conversation stays intact.
+func forkConversation(chatID int64, replyMessageID int) (Conversation, bool) {
+	saveChat(chatID)
+	mu.Lock()
+	turnPos := findTurnLocked(chatID, replyMessageID, true)
+	if turnPos < 0 {
+		mu.Unlock()
+		return Conversation{}, false
+	}
+	source := *activeConversationLocked(chatID)
+	history := conversationHistory[chatID]
+	turn := source.Turns[turnPos]
+
+	// The answer ends right before the next user message
+	end := turn.Index + 1
+	for end < len(history) && history[end].Role != "user" {
+		end++
+	}
+	branchHistory := append([]gpt3.ChatCompletionRequestMessage{}, history[:end]...)
+	branchTurns := append([]Turn{}, source.Turns[:turnPos+1]...)
+
+	title := "Ветка: " + conversationTitle(source, history)
+	branch := newConversationLocked(chatID, title)
+	index := findConversationLocked(chatID, branch.ID)
+	chatConversations[chatID][index].Turns = branchTurns
+	user := userSettingsMap[chatID]
+	user.ConversationID = branch.ID
+	userSettingsMap[chatID] = user
+	conversationHistory[chatID] = branchHistory
+	branch = chatConversations[chatID][index]
+	mu.Unlock()
+	saveChat(chatID)
+	return branch, true
+}
+
+func handleBranchCallback(bot *tgbotapi.BotAPI, query *tgbotapi.CallbackQuery) {
+	chatID := query.Message.Chat.ID
+	message := query.Message.ReplyToMessage
+	if message == nil || message.Text == "" {
+		bot.Request(tgbotapi.NewCallback(query.ID, "Сообщение не найдено"))
+		return
+	}
+	mu.Lock()
+	model := userSettingsMap[chatID].Model
+	if model == "" {
+		model = defaultModel()
+	}
+	busy := generating[chatID] || switching[chatID]
+	mu.Unlock()
+	if busy {
+		bot.Request(tgbotapi.NewCallback(query.ID, "Дождитесь окончания текущего ответа"))
+		return
+	}
+
+	action := strings.TrimPrefix(query.Data, branchCallbackPrefix)
+	text := "Продолжаю текущую беседу."
+	if strings.HasPrefix(action, "fork:") {
+		replyMessageID, _ := strconv.Atoi(strings.TrimPrefix(action, "fork:"))
+		branch, ok := forkConversation(chatID, replyMessageID)
+		if !ok {
+			bot.Request(tgbotapi.NewCallback(query.ID, "Ответ не найден в текущей беседе"))
+			return
+		}
+		text = "Начата ветка «" + branch.Title + "». Исходная беседа доступна в /chats."
+	}
+	bot.Request(tgbotapi.NewCallback(query.ID, ""))
+	msg := tgbotapi.NewEditMessageText(chatID, query.Message.MessageID, text)
+	if _, err := bot.Send(msg); err != nil {
+		log.Printf("Failed to edit message: %v", err)
+	}
+
+	answerMessage(bot, chatID, message.MessageID, message.Text, model)
+	CompleteResponse(chatID)
+}
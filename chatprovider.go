@@ -0,0 +1,210 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+
+	gpt3 "chat_bot/gpt3"
+)
+
+const (
+	APIOpenAI    = "openai"
+	APIAnthropic = "anthropic"
+	APIGemini    = "gemini"
+	// APIResponses is the Responses API of OpenAI that keeps the conversation on the server
+	APIResponses = "responses"
+)
+
+// ChatProvider is a chat backend. Providers only translate the conversation to their API,
+// the history, the function calls and the Telegram rendering are handled by generateTextStream.
+type ChatProvider interface {
+	// StreamChat sends the conversation to the model, passes every piece of the answer to
+	// onDelta and returns the complete answer. Canceling ctx stops the generation.
+	StreamChat(ctx context.Context, request ChatRequest, onDelta func(ChatDelta)) (ChatResult, error)
+}
+
+// ChatDelta is a piece of the answer. Reasoning is shown to the user while the answer is
+// generated but is not a part of the answer text.
+type ChatDelta struct {
+	Text      string
+	Reasoning string
+}
+
+// ChatRequest is the conversation as stored in the history, images are already attached to
+// the user messages they belong to
+type ChatRequest struct {
+	Spec      ModelSpec
+	Messages  []gpt3.ChatCompletionRequestMessage
+	Functions []gpt3.ChatCompletionRequestFunction
+	// MaxTokens is the limit of the answer
+	MaxTokens int
+	// ResponseFormat asks for a JSON answer. APIs without it only get the instruction in Messages.
+	ResponseFormat *gpt3.ChatCompletionResponseFormat
+	// PreviousResponseID is the answer stored on the server that continues the first
+	// PreviousMessages messages, only the rest of them have to be sent
+	PreviousResponseID string
+	PreviousMessages   int
+}
+
+type ChatUsage struct {
+	PromptTokens     int
+	CompletionTokens int
+}
+
+type ChatResult struct {
+	Text string
+	// ToolCalls are set when the model wants functions to be called before it answers
+	ToolCalls    []gpt3.ChatCompletionToolCall
+	FinishReason string
+	Usage        ChatUsage
+	// ResponseID is the ID of the answer stored on the server, if the API keeps one
+	ResponseID string
+}
+
+// chatProviderForModel returns the provider that serves the model in the chat
+func chatProviderForModel(spec ModelSpec) (ChatProvider, error) {
+	switch spec.API {
+	case "", APIOpenAI:
+		return &OpenAIProvider{client: clientForModel(spec.Name)}, nil
+	case APIAnthropic:
+		return &AnthropicProvider{client: anthropicClientForModel(spec)}, nil
+	case APIGemini:
+		return &GeminiProvider{client: geminiClientForModel(spec)}, nil
+	case APIResponses:
+		return &ResponsesProvider{client: clientForModel(spec.Name)}, nil
+	}
+	return nil, fmt.Errorf("unknown API %s of model %s", spec.API, spec.Name)
+}
+
+// OpenAIProvider talks to the Chat Completions API of OpenAI or of a compatible server
+type OpenAIProvider struct {
+	client gpt3.Client
+}
+
+func (p *OpenAIProvider) newRequest(request ChatRequest) gpt3.ChatCompletionRequest {
+	spec := request.Spec
+	completionRequest := gpt3.ChatCompletionRequest{
+		Model:          spec.Name,
+		Messages:       request.Messages,
+		TopP:           1,
+		ResponseFormat: request.ResponseFormat,
+	}
+	for _, function := range request.Functions {
+		completionRequest.Tools = append(completionRequest.Tools, gpt3.ChatCompletionRequestTool{
+			Type:     "function",
+			Function: function,
+		})
+	}
+	if len(completionRequest.Tools) > 0 {
+		completionRequest.ToolChoice = "auto"
+	}
+	if spec.Reasoning {
+		completionRequest.ReasoningEffort = spec.ReasoningEffort
+		completionRequest.MaxCompletionTokens = request.MaxTokens
+	} else {
+		completionRequest.Temperature = spec.Temperature
+		completionRequest.MaxTokens = request.MaxTokens
+	}
+	return completionRequest
+}
+
+func (p *OpenAIProvider) StreamChat(ctx context.Context, request ChatRequest, onDelta func(ChatDelta)) (ChatResult, error) {
+	completionRequest := p.newRequest(request)
+	result := ChatResult{}
+
+	if !request.Spec.Stream {
+		completion, err := p.client.ChatCompletion(ctx, completionRequest)
+		if err != nil {
+			return result, err
+		}
+		if len(completion.Choices) == 0 {
+			return result, errors.New("empty response")
+		}
+		choice := completion.Choices[0]
+		if choice.Message.Content != "" {
+			onDelta(ChatDelta{Text: choice.Message.Content})
+		}
+		result.Text = choice.Message.Content
+		result.ToolCalls = choice.Message.ToolCalls
+		result.FinishReason = choice.FinishReason
+		result.Usage = ChatUsage{
+			PromptTokens:     completion.Usage.PromptTokens,
+			CompletionTokens: completion.Usage.CompletionTokens,
+		}
+		return result, nil
+	}
+
+	completionRequest.StreamOptions = &gpt3.ChatCompletionStreamOptions{IncludeUsage: true}
+	text := strings.Builder{}
+	// Tool calls are streamed in fragments, the index tells which call a fragment belongs to
+	toolCalls := []gpt3.ChatCompletionToolCall{}
+	err := p.client.ChatCompletionStream(ctx, completionRequest, func(completion *gpt3.ChatCompletionStreamResponse) {
+		if completion.Usage.TotalTokens > 0 {
+			result.Usage = ChatUsage{
+				PromptTokens:     completion.Usage.PromptTokens,
+				CompletionTokens: completion.Usage.CompletionTokens,
+			}
+		}
+		if len(completion.Choices) == 0 {
+			return
+		}
+		choice := completion.Choices[0]
+		for _, delta := range choice.Delta.ToolCalls {
+			index := len(toolCalls) - 1
+			if delta.Index != nil {
+				index = *delta.Index
+			} else if delta.ID != "" || index < 0 {
+				// Servers without the index start every call with its ID and send the rest of it
+				// in the fragments that follow
+				index = len(toolCalls)
+			}
+			if index < 0 {
+				continue
+			}
+			for index >= len(toolCalls) {
+				toolCalls = append(toolCalls, gpt3.ChatCompletionToolCall{Type: "function"})
+			}
+			if delta.ID != "" {
+				toolCalls[index].ID = delta.ID
+			}
+			toolCalls[index].Function.Name += delta.Function.Name
+			toolCalls[index].Function.Arguments += delta.Function.Arguments
+		}
+		if choice.Delta.Content != "" {
+			text.WriteString(choice.Delta.Content)
+			onDelta(ChatDelta{Text: choice.Delta.Content})
+		}
+		if choice.FinishReason != "" {
+			result.FinishReason = choice.FinishReason
+		}
+	})
+	result.Text = text.String()
+	for i, toolCall := range toolCalls {
+		if toolCall.Function.Name == "" {
+			continue
+		}
+		if toolCall.ID == "" {
+			toolCall.ID = fmt.Sprintf("call_%d", i)
+		}
+		result.ToolCalls = append(result.ToolCalls, toolCall)
+	}
+	if err != nil && result.FinishReason == "" {
+		return result, err
+	}
+	return result, nil
+}
+
+// parseDataURL returns the media type and the base64 data of a data: URL, e.g. of the images
+// written by run_python
+func parseDataURL(url string) (string, string, bool) {
+	if !strings.HasPrefix(url, "data:") {
+		return "", "", false
+	}
+	header, data, found := strings.Cut(strings.TrimPrefix(url, "data:"), ",")
+	if !found || !strings.HasSuffix(header, ";base64") {
+		return "", "", false
+	}
+	return strings.TrimSuffix(header, ";base64"), data, true
+}
@@ -0,0 +1,232 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"strings"
+
+	"chat_bot/anthropic"
+	gpt3 "chat_bot/gpt3"
+)
+
+// The Messages API requires max_tokens, models without max_output_tokens get this limit
+const anthropicDefaultMaxTokens = 8192
+
+// Thinking budgets for the reasoning efforts of the model spec
+var anthropicThinkingBudgets = map[string]int{
+	"low":    1024,
+	"medium": 4096,
+	"high":   16384,
+}
+
+// AnthropicProvider talks to the Anthropic Messages API
+type AnthropicProvider struct {
+	client anthropic.Client
+}
+
+// anthropicMessages translates the history: system messages go to the system prompt, tool calls
+// become tool_use blocks and tool results become tool_result blocks of user messages.
+// Consecutive messages of the same role are merged, as the API expects alternating roles.
+func anthropicMessages(messages []gpt3.ChatCompletionRequestMessage) (string, []anthropic.Message) {
+	system := []string{}
+	result := []anthropic.Message{}
+	add := func(role string, blocks ...anthropic.ContentBlock) {
+		if len(blocks) == 0 {
+			return
+		}
+		if len(result) > 0 && result[len(result)-1].Role == role {
+			result[len(result)-1].Content = append(result[len(result)-1].Content, blocks...)
+			return
+		}
+		result = append(result, anthropic.Message{Role: role, Content: blocks})
+	}
+
+	for _, message := range messages {
+		blocks := []anthropic.ContentBlock{}
+		switch content := message.Content.(type) {
+		case string:
+			if strings.TrimSpace(content) != "" {
+				blocks = append(blocks, anthropic.ContentBlock{Type: anthropic.BlockTypeText, Text: content})
+			}
+		case []interface{}:
+			for _, entry := range content {
+				switch entry := entry.(type) {
+				case gpt3.ChatCompletionRequestContentEntryText:
+					if strings.TrimSpace(entry.Text) != "" {
+						blocks = append(blocks, anthropic.ContentBlock{Type: anthropic.BlockTypeText, Text: entry.Text})
+					}
+				case gpt3.ChatCompletionRequestContentEntryImage:
+					source := &anthropic.ImageSource{Type: "url", URL: entry.ImageUrl.Url}
+					if mediaType, data, ok := parseDataURL(entry.ImageUrl.Url); ok {
+						source = &anthropic.ImageSource{Type: "base64", MediaType: mediaType, Data: data}
+					}
+					blocks = append(blocks, anthropic.ContentBlock{Type: anthropic.BlockTypeImage, Source: source})
+				}
+			}
+		}
+
+		switch message.Role {
+		case "system":
+			if text, ok := message.Content.(string); ok && text != "" {
+				system = append(system, text)
+			}
+		case "assistant":
+			for _, toolCall := range message.ToolCalls {
+				input := json.RawMessage(toolCall.Function.Arguments)
+				if !json.Valid(input) {
+					input = json.RawMessage("{}")
+				}
+				blocks = append(blocks, anthropic.ContentBlock{
+					Type:  anthropic.BlockTypeToolUse,
+					ID:    toolCall.ID,
+					Name:  toolCall.Function.Name,
+					Input: input,
+				})
+			}
+			add("assistant", blocks...)
+		case "tool":
+			add("user", anthropic.ContentBlock{
+				Type:      anthropic.BlockTypeToolResult,
+				ToolUseID: message.ToolCallID,
+				Content:   messageText(message),
+			})
+		default:
+			add("user", blocks...)
+		}
+	}
+	return strings.Join(system, "\n\n"), result
+}
+
+func messageText(message gpt3.ChatCompletionRequestMessage) string {
+	text, _ := message.Content.(string)
+	return text
+}
+
+func anthropicTools(functions []gpt3.ChatCompletionRequestFunction) []anthropic.Tool {
+	tools := []anthropic.Tool{}
+	for _, function := range functions {
+		tools = append(tools, anthropic.Tool{
+			Name:        function.Name,
+			Description: function.Description,
+			InputSchema: anthropic.InputSchema{
+				Type:       "object",
+				Properties: function.Parameters.Properties,
+				Required:   function.Parameters.Required,
+			},
+		})
+	}
+	return tools
+}
+
+func (p *AnthropicProvider) newRequest(request ChatRequest) anthropic.MessagesRequest {
+	spec := request.Spec
+	system, messages := anthropicMessages(request.Messages)
+	maxTokens := request.MaxTokens
+	if spec.MaxOutputTokens == 0 && maxTokens > anthropicDefaultMaxTokens {
+		maxTokens = anthropicDefaultMaxTokens
+	}
+	messagesRequest := anthropic.MessagesRequest{
+		Model:       spec.Name,
+		MaxTokens:   maxTokens,
+		System:      system,
+		Messages:    messages,
+		Tools:       anthropicTools(request.Functions),
+		Temperature: spec.Temperature,
+	}
+	// Thinking blocks would have to be sent back with tool results, which the history does not
+	// keep, so thinking is only enabled without tools
+	budget := anthropicThinkingBudgets[spec.ReasoningEffort]
+	if spec.Reasoning && len(request.Functions) == 0 && budget > 0 && budget < maxTokens {
+		messagesRequest.Thinking = &anthropic.Thinking{Type: "enabled", BudgetTokens: budget}
+		messagesRequest.Temperature = nil
+	}
+	return messagesRequest
+}
+
+func (p *AnthropicProvider) StreamChat(ctx context.Context, request ChatRequest, onDelta func(ChatDelta)) (ChatResult, error) {
+	messagesRequest := p.newRequest(request)
+	result := ChatResult{}
+
+	if !request.Spec.Stream {
+		response, err := p.client.Messages(ctx, messagesRequest)
+		if err != nil {
+			return result, err
+		}
+		result.Text = response.Text()
+		if result.Text != "" {
+			onDelta(ChatDelta{Text: result.Text})
+		}
+		for _, block := range response.Content {
+			if block.Type == anthropic.BlockTypeToolUse {
+				result.ToolCalls = append(result.ToolCalls, gpt3.ChatCompletionToolCall{
+					ID:   block.ID,
+					Type: "function",
+					Function: gpt3.ChatCompletionResponseFunctionCall{
+						Name:      block.Name,
+						Arguments: string(block.Input),
+					},
+				})
+			}
+		}
+		result.FinishReason = response.StopReason
+		result.Usage = ChatUsage{
+			PromptTokens:     response.Usage.InputTokens,
+			CompletionTokens: response.Usage.OutputTokens,
+		}
+		return result, nil
+	}
+
+	text := strings.Builder{}
+	// Tool calls by the index of their content block
+	toolCalls := map[int]*gpt3.ChatCompletionToolCall{}
+	toolCallOrder := []int{}
+	err := p.client.MessagesStream(ctx, messagesRequest, func(event *anthropic.StreamEvent) {
+		switch event.Type {
+		case anthropic.EventMessageStart:
+			if event.Message != nil {
+				result.Usage.PromptTokens = event.Message.Usage.InputTokens
+			}
+		case anthropic.EventContentBlockStart:
+			if event.ContentBlock != nil && event.ContentBlock.Type == anthropic.BlockTypeToolUse {
+				toolCalls[event.Index] = &gpt3.ChatCompletionToolCall{
+					ID:       event.ContentBlock.ID,
+					Type:     "function",
+					Function: gpt3.ChatCompletionResponseFunctionCall{Name: event.ContentBlock.Name},
+				}
+				toolCallOrder = append(toolCallOrder, event.Index)
+			}
+		case anthropic.EventContentBlockDelta:
+			if event.Delta == nil {
+				return
+			}
+			switch event.Delta.Type {
+			case anthropic.DeltaTypeText:
+				text.WriteString(event.Delta.Text)
+				onDelta(ChatDelta{Text: event.Delta.Text})
+			case anthropic.DeltaTypeInputJSON:
+				if toolCall, ok := toolCalls[event.Index]; ok {
+					toolCall.Function.Arguments += event.Delta.PartialJSON
+				}
+			}
+		case anthropic.EventMessageDelta:
+			if event.Delta != nil && event.Delta.StopReason != "" {
+				result.FinishReason = event.Delta.StopReason
+			}
+			if event.Usage != nil {
+				result.Usage.CompletionTokens = event.Usage.OutputTokens
+			}
+		}
+	})
+	result.Text = text.String()
+	for _, index := range toolCallOrder {
+		toolCall := *toolCalls[index]
+		if toolCall.Function.Arguments == "" {
+			toolCall.Function.Arguments = "{}"
+		}
+		result.ToolCalls = append(result.ToolCalls, toolCall)
+	}
+	if err != nil {
+		return result, err
+	}
+	return result, nil
+}
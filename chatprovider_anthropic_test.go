@@ -0,0 +1,153 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"chat_bot/anthropic"
+	gpt3 "chat_bot/gpt3"
+)
+
+// newAnthropicTestProvider returns a provider whose API answers every request with body
+func newAnthropicTestProvider(t *testing.T, body string, requests *[]anthropic.MessagesRequest) *AnthropicProvider {
+	t.Helper()
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		request := anthropic.MessagesRequest{}
+		if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+			t.Errorf("invalid request body: %v", err)
+		}
+		*requests = append(*requests, request)
+		io.WriteString(w, body)
+	}))
+	t.Cleanup(server.Close)
+	return &AnthropicProvider{client: anthropic.NewClient("test-key", anthropic.WithBaseURL(server.URL))}
+}
+
+func TestAnthropicProviderStream(t *testing.T) {
+	stream := `event: message_start
+data: {"type":"message_start","message":{"usage":{"input_tokens":25,"output_tokens":1}}}
+
+event: content_block_start
+data: {"type":"content_block_start","index":0,"content_block":{"type":"text","text":""}}
+
+event: content_block_delta
+data: {"type":"content_block_delta","index":0,"delta":{"type":"text_delta","text":"Let me "}}
+
+event: content_block_delta
+data: {"type":"content_block_delta","index":0,"delta":{"type":"text_delta","text":"check."}}
+
+event: content_block_start
+data: {"type":"content_block_start","index":1,"content_block":{"type":"tool_use","id":"toolu_1","name":"google_search","input":{}}}
+
+event: content_block_delta
+data: {"type":"content_block_delta","index":1,"delta":{"type":"input_json_delta","partial_json":"{\"query\":"}}
+
+event: content_block_start
+data: {"type":"content_block_start","index":2,"content_block":{"type":"tool_use","id":"toolu_2","name":"http_get","input":{}}}
+
+event: content_block_delta
+data: {"type":"content_block_delta","index":2,"delta":{"type":"input_json_delta","partial_json":"{\"url\":\"https://example.com\"}"}}
+
+event: content_block_delta
+data: {"type":"content_block_delta","index":1,"delta":{"type":"input_json_delta","partial_json":"\"weather\"}"}}
+
+event: content_block_start
+data: {"type":"content_block_start","index":3,"content_block":{"type":"tool_use","id":"toolu_3","name":"list_tools","input":{}}}
+
+event: message_delta
+data: {"type":"message_delta","delta":{"stop_reason":"tool_use"},"usage":{"output_tokens":42}}
+
+event: message_stop
+data: {"type":"message_stop"}
+
+`
+	requests := []anthropic.MessagesRequest{}
+	provider := newAnthropicTestProvider(t, stream, &requests)
+	deltas := ""
+	result, err := provider.StreamChat(context.Background(), ChatRequest{
+		Spec:      ModelSpec{Name: "claude-test", Stream: true},
+		Messages:  []gpt3.ChatCompletionRequestMessage{{Role: "system", Content: "Be brief"}, {Role: "user", Content: "Weather?"}},
+		MaxTokens: 1000,
+	}, func(delta ChatDelta) {
+		deltas += delta.Text
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(requests) != 1 || !requests[0].Stream || requests[0].System != "Be brief" || requests[0].Model != "claude-test" {
+		t.Errorf("requests = %+v", requests)
+	}
+	if result.Text != "Let me check." || deltas != result.Text {
+		t.Errorf("text = %q, deltas = %q", result.Text, deltas)
+	}
+	expected := []struct{ id, name, arguments string }{
+		{"toolu_1", "google_search", `{"query":"weather"}`},
+		{"toolu_2", "http_get", `{"url":"https://example.com"}`},
+		// Tools without arguments send no deltas
+		{"toolu_3", "list_tools", `{}`},
+	}
+	if len(result.ToolCalls) != len(expected) {
+		t.Fatalf("tool calls = %+v", result.ToolCalls)
+	}
+	for i, call := range result.ToolCalls {
+		if call.ID != expected[i].id || call.Function.Name != expected[i].name || call.Function.Arguments != expected[i].arguments {
+			t.Errorf("tool call %d = %+v", i, call)
+		}
+	}
+	if result.FinishReason != "tool_use" || result.Usage.PromptTokens != 25 || result.Usage.CompletionTokens != 42 {
+		t.Errorf("result = %+v", result)
+	}
+}
+
+func TestAnthropicProviderMessages(t *testing.T) {
+	body := `{"id":"msg_1","type":"message","role":"assistant","content":[
+		{"type":"text","text":"Searching."},
+		{"type":"tool_use","id":"toolu_1","name":"google_search","input":{"query":"weather"}}],
+		"stop_reason":"tool_use","usage":{"input_tokens":10,"output_tokens":5}}`
+	requests := []anthropic.MessagesRequest{}
+	provider := newAnthropicTestProvider(t, body, &requests)
+	deltas := []string{}
+	result, err := provider.StreamChat(context.Background(), ChatRequest{
+		Spec:      ModelSpec{Name: "claude-test"},
+		Messages:  []gpt3.ChatCompletionRequestMessage{{Role: "user", Content: "Weather?"}},
+		MaxTokens: 1000,
+	}, func(delta ChatDelta) {
+		deltas = append(deltas, delta.Text)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(requests) != 1 || requests[0].Stream {
+		t.Errorf("requests = %+v", requests)
+	}
+	if result.Text != "Searching." || len(deltas) != 1 || deltas[0] != result.Text {
+		t.Errorf("text = %q, deltas = %q", result.Text, deltas)
+	}
+	if len(result.ToolCalls) != 1 || result.ToolCalls[0].ID != "toolu_1" || result.ToolCalls[0].Function.Name != "google_search" ||
+		result.ToolCalls[0].Function.Arguments != `{"query":"weather"}` {
+		t.Errorf("tool calls = %+v", result.ToolCalls)
+	}
+	if result.FinishReason != "tool_use" || result.Usage.PromptTokens != 10 || result.Usage.CompletionTokens != 5 {
+		t.Errorf("result = %+v", result)
+	}
+}
+
+func TestAnthropicProviderError(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusUnauthorized)
+		io.WriteString(w, `{"type":"error","error":{"type":"authentication_error","message":"invalid x-api-key"}}`)
+	}))
+	defer server.Close()
+	provider := &AnthropicProvider{client: anthropic.NewClient("wrong", anthropic.WithBaseURL(server.URL))}
+	_, err := provider.StreamChat(context.Background(), ChatRequest{
+		Spec:     ModelSpec{Name: "claude-test", Stream: true},
+		Messages: []gpt3.ChatCompletionRequestMessage{{Role: "user", Content: "Hi"}},
+	}, func(ChatDelta) {})
+	if err == nil || err.Error() != "[401:authentication_error] invalid x-api-key" {
+		t.Errorf("err = %v", err)
+	}
+}
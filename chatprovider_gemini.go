@@ -0,0 +1,306 @@
+package main
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"chat_bot/gemini"
+	gpt3 "chat_bot/gpt3"
+)
+
+const (
+	// Photos are downloaded and sent inline, larger files are skipped
+	geminiMaxImageSize      = 20 << 20
+	geminiImageTimeout      = 30 * time.Second
+	geminiImageCacheTTL     = time.Hour
+	geminiImageCacheMaxSize = 64 << 20
+)
+
+var (
+	geminiImageClient = &http.Client{Timeout: geminiImageTimeout}
+	// The history is sent with every request and every round of tool calls, its images are
+	// downloaded once. Telegram file links stay valid for at least an hour.
+	geminiImageCache, _ = newTTLCache("gemini_images", "", geminiImageCacheMaxSize)
+)
+
+// Thinking budgets for the reasoning efforts of the model spec
+var geminiThinkingBudgets = map[string]int{
+	"low":    1024,
+	"medium": 8192,
+	"high":   24576,
+}
+
+// GeminiProvider talks to the Google Gemini API
+type GeminiProvider struct {
+	client gemini.Client
+}
+
+// loadImage downloads the image, or takes it from the cache, and returns it as inline data
+func loadImage(ctx context.Context, url string) (*gemini.Blob, error) {
+	if mimeType, data, ok := parseDataURL(url); ok {
+		return &gemini.Blob{MimeType: mimeType, Data: data}, nil
+	}
+	blob := &gemini.Blob{}
+	if geminiImageCache.get(url, blob) {
+		return blob, nil
+	}
+	req, err := http.NewRequestWithContext(ctx, "GET", url, nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := geminiImageClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("unexpected status %s", resp.Status)
+	}
+	data, err := io.ReadAll(io.LimitReader(resp.Body, geminiMaxImageSize+1))
+	if err != nil {
+		return nil, err
+	}
+	if len(data) > geminiMaxImageSize {
+		return nil, errors.New("image is too large")
+	}
+	blob = &gemini.Blob{
+		MimeType: http.DetectContentType(data),
+		Data:     base64.StdEncoding.EncodeToString(data),
+	}
+	geminiImageCache.set(url, blob, geminiImageCacheTTL)
+	return blob, nil
+}
+
+// geminiContents translates the history: system messages go to the system instruction, tool
+// calls and results become functionCall and functionResponse parts, images are sent inline.
+// Consecutive messages of the same role are merged, as the API expects alternating roles.
+func geminiContents(ctx context.Context, messages []gpt3.ChatCompletionRequestMessage) (*gemini.Content, []gemini.Content) {
+	system := []gemini.Part{}
+	contents := []gemini.Content{}
+	// Gemini matches the results to the calls by the function name
+	toolNames := toolCallNames(messages)
+	add := func(role string, parts ...gemini.Part) {
+		if len(parts) == 0 {
+			return
+		}
+		if len(contents) > 0 && contents[len(contents)-1].Role == role {
+			contents[len(contents)-1].Parts = append(contents[len(contents)-1].Parts, parts...)
+			return
+		}
+		contents = append(contents, gemini.Content{Role: role, Parts: parts})
+	}
+
+	for _, message := range messages {
+		parts := []gemini.Part{}
+		switch content := message.Content.(type) {
+		case string:
+			if strings.TrimSpace(content) != "" {
+				parts = append(parts, gemini.Part{Text: content})
+			}
+		case []interface{}:
+			for _, entry := range content {
+				switch entry := entry.(type) {
+				case gpt3.ChatCompletionRequestContentEntryText:
+					if strings.TrimSpace(entry.Text) != "" {
+						parts = append(parts, gemini.Part{Text: entry.Text})
+					}
+				case gpt3.ChatCompletionRequestContentEntryImage:
+					blob, err := loadImage(ctx, entry.ImageUrl.Url)
+					if err != nil {
+						log.Printf("Failed to load image for Gemini: %v", err)
+						continue
+					}
+					parts = append(parts, gemini.Part{InlineData: blob})
+				}
+			}
+		}
+
+		switch message.Role {
+		case "system":
+			system = append(system, parts...)
+		case "assistant":
+			for _, toolCall := range message.ToolCalls {
+				args := json.RawMessage(toolCall.Function.Arguments)
+				if !json.Valid(args) {
+					args = json.RawMessage("{}")
+				}
+				parts = append(parts, gemini.Part{FunctionCall: &gemini.FunctionCall{Name: toolCall.Function.Name, Args: args}})
+			}
+			add(gemini.RoleModel, parts...)
+		case "tool":
+			add(gemini.RoleUser, gemini.Part{FunctionResponse: &gemini.FunctionResponse{
+				Name:     toolNames[message.ToolCallID],
+				Response: map[string]interface{}{"result": messageText(message)},
+			}})
+		default:
+			add(gemini.RoleUser, parts...)
+		}
+	}
+	if len(system) == 0 {
+		return nil, contents
+	}
+	return &gemini.Content{Parts: system}, contents
+}
+
+// geminiSchema converts the JSON schema of a parameter to the OpenAPI schema of Gemini
+func geminiSchema(property interface{}) *gemini.Schema {
+	// The schemas of the built-in functions are map[string]string, JSON makes all of them alike
+	object := map[string]interface{}{}
+	if data, err := json.Marshal(property); err == nil {
+		json.Unmarshal(data, &object)
+	}
+	schema := &gemini.Schema{}
+	switch types := object["type"].(type) {
+	case string:
+		schema.Type = strings.ToUpper(types)
+	case []interface{}:
+		// Gemini has no type lists, e.g. ["string", "null"] is a string
+		for _, name := range types {
+			if name, ok := name.(string); ok && name != "null" {
+				schema.Type = strings.ToUpper(name)
+				break
+			}
+		}
+	}
+	schema.Description, _ = object["description"].(string)
+	if enum, ok := object["enum"].([]interface{}); ok {
+		for _, value := range enum {
+			schema.Enum = append(schema.Enum, fmt.Sprint(value))
+		}
+	}
+	if items, ok := object["items"]; ok {
+		schema.Items = geminiSchema(items)
+	}
+	if properties, ok := object["properties"].(map[string]interface{}); ok {
+		schema.Properties = map[string]*gemini.Schema{}
+		for name, property := range properties {
+			schema.Properties[name] = geminiSchema(property)
+		}
+	}
+	if required, ok := object["required"].([]interface{}); ok {
+		for _, name := range required {
+			if name, ok := name.(string); ok {
+				schema.Required = append(schema.Required, name)
+			}
+		}
+	}
+	return schema
+}
+
+func geminiTools(functions []gpt3.ChatCompletionRequestFunction) []gemini.Tool {
+	if len(functions) == 0 {
+		return nil
+	}
+	declarations := []gemini.FunctionDeclaration{}
+	for _, function := range functions {
+		declaration := gemini.FunctionDeclaration{
+			Name:        function.Name,
+			Description: function.Description,
+		}
+		if len(function.Parameters.Properties) > 0 {
+			properties := map[string]*gemini.Schema{}
+			for name, property := range function.Parameters.Properties {
+				properties[name] = geminiSchema(property)
+			}
+			declaration.Parameters = &gemini.Schema{
+				Type:       "OBJECT",
+				Properties: properties,
+				Required:   function.Parameters.Required,
+			}
+		}
+		declarations = append(declarations, declaration)
+	}
+	return []gemini.Tool{{FunctionDeclarations: declarations}}
+}
+
+func (p *GeminiProvider) newRequest(ctx context.Context, request ChatRequest) gemini.GenerateContentRequest {
+	spec := request.Spec
+	system, contents := geminiContents(ctx, request.Messages)
+	generationConfig := &gemini.GenerationConfig{
+		Temperature:     spec.Temperature,
+		MaxOutputTokens: request.MaxTokens,
+	}
+	if budget, ok := geminiThinkingBudgets[spec.ReasoningEffort]; spec.Reasoning && ok {
+		generationConfig.ThinkingConfig = &gemini.ThinkingConfig{ThinkingBudget: &budget}
+	}
+	if format := request.ResponseFormat; format != nil && format.Type != gpt3.ResponseFormatText {
+		generationConfig.ResponseMimeType = "application/json"
+		if format.JSONSchema != nil {
+			generationConfig.ResponseJSONSchema = format.JSONSchema.Schema
+		}
+	}
+	return gemini.GenerateContentRequest{
+		Contents:          contents,
+		SystemInstruction: system,
+		Tools:             geminiTools(request.Functions),
+		GenerationConfig:  generationConfig,
+	}
+}
+
+func (p *GeminiProvider) StreamChat(ctx context.Context, request ChatRequest, onDelta func(ChatDelta)) (ChatResult, error) {
+	contentRequest := p.newRequest(ctx, request)
+	result := ChatResult{}
+	text := strings.Builder{}
+	var blockReason string
+
+	handle := func(response *gemini.GenerateContentResponse) {
+		if response.PromptFeedback != nil && response.PromptFeedback.BlockReason != "" {
+			blockReason = response.PromptFeedback.BlockReason
+		}
+		if delta := response.Text(); delta != "" {
+			text.WriteString(delta)
+			onDelta(ChatDelta{Text: delta})
+		}
+		// Gemini has no call IDs, unique ones are made up to match the results in the history
+		for _, call := range response.FunctionCalls() {
+			arguments := string(call.Args)
+			if arguments == "" {
+				arguments = "{}"
+			}
+			result.ToolCalls = append(result.ToolCalls, gpt3.ChatCompletionToolCall{
+				ID:   fmt.Sprintf("call_%d_%d", time.Now().UnixNano(), len(result.ToolCalls)),
+				Type: "function",
+				Function: gpt3.ChatCompletionResponseFunctionCall{
+					Name:      call.Name,
+					Arguments: arguments,
+				},
+			})
+		}
+		if len(response.Candidates) > 0 && response.Candidates[0].FinishReason != "" {
+			result.FinishReason = response.Candidates[0].FinishReason
+		}
+		if response.UsageMetadata != nil {
+			result.Usage = ChatUsage{
+				PromptTokens:     response.UsageMetadata.PromptTokenCount,
+				CompletionTokens: response.UsageMetadata.CandidatesTokenCount + response.UsageMetadata.ThoughtsTokenCount,
+			}
+		}
+	}
+
+	var err error
+	if request.Spec.Stream {
+		err = p.client.StreamGenerateContent(ctx, request.Spec.Name, contentRequest, handle)
+	} else {
+		var response *gemini.GenerateContentResponse
+		response, err = p.client.GenerateContent(ctx, request.Spec.Name, contentRequest)
+		if err == nil {
+			handle(response)
+		}
+	}
+	result.Text = text.String()
+	if err != nil {
+		return result, err
+	}
+	if blockReason != "" {
+		return result, fmt.Errorf("запрос заблокирован Gemini: %s", blockReason)
+	}
+	return result, nil
+}
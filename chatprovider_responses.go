@@ -0,0 +1,267 @@
+package main
+
+import (
+	"context"
+	"crypto/sha1"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"strings"
+
+	gpt3 "chat_bot/gpt3"
+)
+
+// ResponsesProvider talks to the Responses API of OpenAI. The answers are stored on the server,
+// so a conversation continues from the previous answer without sending the whole history again,
+// and reasoning models return summaries of their reasoning.
+type ResponsesProvider struct {
+	client gpt3.Client
+}
+
+// ResponseChain is the last answer of the conversation stored on the server by the Responses API
+type ResponseChain struct {
+	ID    string `json:"id"`
+	Model string `json:"model"`
+	// Length is the number of request messages the answer continues, Hash is their hash.
+	// The answer itself is the message that follows them in the history.
+	Length int    `json:"length"`
+	Hash   string `json:"hash"`
+}
+
+// hashMessages identifies the messages sent to the model, to notice when the history was edited
+func hashMessages(messages []gpt3.ChatCompletionRequestMessage) string {
+	data, err := json.Marshal(messages)
+	if err != nil {
+		return ""
+	}
+	sum := sha1.Sum(data)
+	return hex.EncodeToString(sum[:])
+}
+
+// continues returns how many of the messages are already known to the server. It is 0 when the
+// history was changed since the answer (compaction, regeneration, branching) or the model differs.
+func (chain *ResponseChain) continues(model string, messages []gpt3.ChatCompletionRequestMessage) int {
+	if chain == nil || chain.ID == "" || chain.Model != model || len(messages) <= chain.Length {
+		return 0
+	}
+	if messages[chain.Length].Role != "assistant" || hashMessages(messages[:chain.Length]) != chain.Hash {
+		return 0
+	}
+	return chain.Length + 1
+}
+
+// responsesInput translates the history: system messages become the instructions, tool calls
+// become function_call items and tool results become function_call_output items
+func responsesInput(messages []gpt3.ChatCompletionRequestMessage) (string, []gpt3.ResponseInputItem) {
+	instructions := []string{}
+	items := []gpt3.ResponseInputItem{}
+	for _, message := range messages {
+		switch message.Role {
+		case "system":
+			if text := messageText(message); text != "" {
+				instructions = append(instructions, text)
+			}
+			continue
+		case "tool":
+			text, _ := message.Content.(string)
+			items = append(items, gpt3.ResponseInputItem{
+				Type:   gpt3.ResponseItemFunctionCallOutput,
+				CallID: message.ToolCallID,
+				Output: text,
+			})
+			continue
+		}
+
+		switch content := message.Content.(type) {
+		case string:
+			if strings.TrimSpace(content) != "" {
+				items = append(items, gpt3.ResponseInputItem{Role: message.Role, Content: content})
+			}
+		case []interface{}:
+			parts := []gpt3.ResponseInputContent{}
+			for _, entry := range content {
+				switch entry := entry.(type) {
+				case gpt3.ChatCompletionRequestContentEntryText:
+					parts = append(parts, gpt3.ResponseInputContent{Type: "input_text", Text: entry.Text})
+				case gpt3.ChatCompletionRequestContentEntryImage:
+					parts = append(parts, gpt3.ResponseInputContent{
+						Type:     "input_image",
+						ImageURL: entry.ImageUrl.Url,
+						Detail:   entry.ImageUrl.Detail,
+					})
+				}
+			}
+			if len(parts) > 0 {
+				items = append(items, gpt3.ResponseInputItem{Role: message.Role, Content: parts})
+			}
+		}
+		for _, toolCall := range message.ToolCalls {
+			items = append(items, gpt3.ResponseInputItem{
+				Type:      gpt3.ResponseItemFunctionCall,
+				CallID:    toolCall.ID,
+				Name:      toolCall.Function.Name,
+				Arguments: toolCall.Function.Arguments,
+			})
+		}
+	}
+	return strings.Join(instructions, "\n\n"), items
+}
+
+func (p *ResponsesProvider) newRequest(request ChatRequest) gpt3.ResponsesRequest {
+	spec := request.Spec
+	// The instructions are not carried over from the previous answer, they are sent every time
+	instructions, _ := responsesInput(request.Messages)
+	_, input := responsesInput(request.Messages[request.PreviousMessages:])
+	responsesRequest := gpt3.ResponsesRequest{
+		Model:              spec.Name,
+		Input:              input,
+		Instructions:       instructions,
+		PreviousResponseID: request.PreviousResponseID,
+		MaxOutputTokens:    request.MaxTokens,
+	}
+	for _, function := range request.Functions {
+		responsesRequest.Tools = append(responsesRequest.Tools, gpt3.ResponseTool{
+			Type:        "function",
+			Name:        function.Name,
+			Description: function.Description,
+			Parameters:  function.Parameters,
+		})
+	}
+	if spec.WebSearch {
+		responsesRequest.Tools = append(responsesRequest.Tools, gpt3.ResponseTool{Type: "web_search"})
+	}
+	if len(responsesRequest.Tools) > 0 {
+		responsesRequest.ToolChoice = "auto"
+	}
+	if format := request.ResponseFormat; format != nil {
+		responsesRequest.Text = &gpt3.ResponseText{Format: gpt3.ResponseTextFormat{Type: format.Type}}
+		if format.JSONSchema != nil {
+			responsesRequest.Text.Format.Name = format.JSONSchema.Name
+			responsesRequest.Text.Format.Description = format.JSONSchema.Description
+			responsesRequest.Text.Format.Schema = format.JSONSchema.Schema
+			responsesRequest.Text.Format.Strict = format.JSONSchema.Strict
+		}
+	}
+	if spec.Reasoning {
+		responsesRequest.Reasoning = &gpt3.ResponseReasoning{
+			Effort:  spec.ReasoningEffort,
+			Summary: "auto",
+		}
+	} else {
+		responsesRequest.Temperature = spec.Temperature
+	}
+	return responsesRequest
+}
+
+func (p *ResponsesProvider) StreamChat(ctx context.Context, request ChatRequest, onDelta func(ChatDelta)) (ChatResult, error) {
+	responsesRequest := p.newRequest(request)
+	result := ChatResult{}
+	text := strings.Builder{}
+	// Parts of the reasoning summary and searches are separated by empty lines
+	reasoned, separate := false, false
+	reason := func(reasoning string) {
+		if separate && reasoned {
+			reasoning = "\n\n" + reasoning
+		}
+		reasoned, separate = true, false
+		onDelta(ChatDelta{Reasoning: reasoning})
+	}
+
+	// handleItem takes the completed output items that are not streamed as text
+	handleItem := func(item *gpt3.ResponseOutputItem) {
+		switch item.Type {
+		case gpt3.ResponseItemFunctionCall:
+			arguments := item.Arguments
+			if arguments == "" {
+				arguments = "{}"
+			}
+			result.ToolCalls = append(result.ToolCalls, gpt3.ChatCompletionToolCall{
+				ID:   item.CallID,
+				Type: "function",
+				Function: gpt3.ChatCompletionResponseFunctionCall{
+					Name:      item.Name,
+					Arguments: arguments,
+				},
+			})
+		case gpt3.ResponseItemWebSearchCall:
+			if item.Action != nil && item.Action.Query != "" {
+				separate = true
+				reason("🔎 " + item.Action.Query)
+				separate = true
+			}
+		}
+	}
+	// handleResponse takes the final state of the answer
+	handleResponse := func(response *gpt3.Response) error {
+		result.ResponseID = response.ID
+		result.FinishReason = response.Status
+		if response.IncompleteDetails != nil && response.IncompleteDetails.Reason != "" {
+			result.FinishReason = response.IncompleteDetails.Reason
+		}
+		if response.Usage != nil {
+			result.Usage = ChatUsage{
+				PromptTokens:     response.Usage.InputTokens,
+				CompletionTokens: response.Usage.OutputTokens,
+			}
+		}
+		if response.Status == "failed" {
+			if response.Error != nil {
+				return errors.New(response.Error.Code + ": " + response.Error.Message)
+			}
+			return errors.New("response failed")
+		}
+		return nil
+	}
+
+	if !request.Spec.Stream {
+		response, err := p.client.Responses(ctx, responsesRequest)
+		if err != nil {
+			return result, err
+		}
+		for i := range response.Output {
+			item := &response.Output[i]
+			if item.Type == gpt3.ResponseItemReasoning {
+				for _, summary := range item.Summary {
+					separate = true
+					reason(summary.Text)
+				}
+			}
+			handleItem(item)
+		}
+		result.Text = response.OutputText()
+		if result.Text != "" {
+			onDelta(ChatDelta{Text: result.Text})
+		}
+		return result, handleResponse(response)
+	}
+
+	var responseErr error
+	err := p.client.ResponsesStream(ctx, responsesRequest, func(event *gpt3.ResponseStreamEvent) {
+		switch event.Type {
+		case gpt3.ResponseEventCreated:
+			if event.Response != nil {
+				result.ResponseID = event.Response.ID
+			}
+		case gpt3.ResponseEventOutputTextDelta:
+			text.WriteString(event.Delta)
+			onDelta(ChatDelta{Text: event.Delta})
+		case gpt3.ResponseEventReasoningSummaryTextDelta:
+			reason(event.Delta)
+		case gpt3.ResponseEventReasoningSummaryTextDone:
+			separate = true
+		case gpt3.ResponseEventOutputItemDone:
+			if event.Item != nil {
+				handleItem(event.Item)
+			}
+		case gpt3.ResponseEventCompleted, gpt3.ResponseEventIncomplete, gpt3.ResponseEventFailed:
+			if event.Response != nil {
+				responseErr = handleResponse(event.Response)
+			}
+		}
+	})
+	result.Text = text.String()
+	if err != nil {
+		return result, err
+	}
+	return result, responseErr
+}
@@ -0,0 +1,82 @@
+package main
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	gpt3 "chat_bot/gpt3"
+)
+
+func TestOpenAIProviderStreamToolCalls(t *testing.T) {
+	tests := []struct {
+		name   string
+		stream string
+	}{
+		{"index", `data: {"choices":[{"delta":{"tool_calls":[{"index":0,"id":"call_a","type":"function","function":{"name":"google_search","arguments":""}}]}}]}
+
+data: {"choices":[{"delta":{"tool_calls":[{"index":1,"id":"call_b","type":"function","function":{"name":"http_get","arguments":"{\"url\":"}}]}}]}
+
+data: {"choices":[{"delta":{"tool_calls":[{"index":0,"function":{"arguments":"{\"query\":\"weather\"}"}}]}}]}
+
+data: {"choices":[{"delta":{"tool_calls":[{"index":1,"function":{"arguments":"\"https://example.com\"}"}}]}}]}
+
+data: {"choices":[{"delta":{},"finish_reason":"tool_calls"}]}
+
+data: [DONE]
+
+`},
+		// Some OpenAI-compatible servers send no index, every call starts with its ID
+		{"no index", `data: {"choices":[{"delta":{"tool_calls":[{"id":"call_a","type":"function","function":{"name":"google_search","arguments":""}}]}}]}
+
+data: {"choices":[{"delta":{"tool_calls":[{"function":{"arguments":"{\"query\":"}}]}}]}
+
+data: {"choices":[{"delta":{"tool_calls":[{"function":{"arguments":"\"weather\"}"}}]}}]}
+
+data: {"choices":[{"delta":{"tool_calls":[{"id":"call_b","type":"function","function":{"name":"http_get","arguments":"{\"url\":\"https://example.com\"}"}}]}}]}
+
+data: {"choices":[{"delta":{},"finish_reason":"tool_calls"}]}
+
+data: [DONE]
+
+`},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				if r.URL.Path != "/v1/chat/completions" {
+					t.Errorf("path = %s", r.URL.Path)
+				}
+				w.Header().Set("Content-Type", "text/event-stream")
+				io.WriteString(w, test.stream)
+			}))
+			defer server.Close()
+			provider := &OpenAIProvider{client: gpt3.NewClient("test-key", gpt3.WithBaseURL(server.URL+"/v1"))}
+			result, err := provider.StreamChat(context.Background(), ChatRequest{
+				Spec:      ModelSpec{Name: "gpt-test", Stream: true},
+				Messages:  []gpt3.ChatCompletionRequestMessage{{Role: "user", Content: "Weather?"}},
+				MaxTokens: 1000,
+			}, func(ChatDelta) {})
+			if err != nil {
+				t.Fatal(err)
+			}
+			expected := []struct{ id, name, arguments string }{
+				{"call_a", "google_search", `{"query":"weather"}`},
+				{"call_b", "http_get", `{"url":"https://example.com"}`},
+			}
+			if len(result.ToolCalls) != len(expected) {
+				t.Fatalf("tool calls = %+v", result.ToolCalls)
+			}
+			for i, call := range result.ToolCalls {
+				if call.ID != expected[i].id || call.Function.Name != expected[i].name || call.Function.Arguments != expected[i].arguments {
+					t.Errorf("tool call %d = %+v", i, call)
+				}
+			}
+			if result.FinishReason != "tool_calls" {
+				t.Errorf("finish reason = %q", result.FinishReason)
+			}
+		})
+	}
+}
@@ -0,0 +1,441 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"log"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	gpt3 "chat_bot/gpt3"
+
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api/v5"
+)
+
+const (
+	codeDefaultTimeout = 30 * time.Second
+	codeDefaultMemory  = 1024
+	// Output beyond this is cut, the model can't read more anyway
+	codeMaxOutputSize = 32 << 10
+	// Files written by a run, e.g. the CSV of a result, are limited to what Telegram accepts
+	codeMaxFileSize = 20 << 20
+	codeMaxFiles    = 10
+	// Images shown to the model, larger ones are only sent to the chat
+	codeMaxModelImageSize = 1 << 20
+	codeMaxModelImages    = 4
+	codeScriptName        = "main.py"
+)
+
+// CodeRunnerConfig enables the run_python tool. The code runs in a temporary directory, the files
+// it writes there are sent to the chat.
+type CodeRunnerConfig struct {
+	Enabled bool `yaml:"enabled"`
+	// Python is the interpreter of the built-in sandbox, python3 by default
+	Python string `yaml:"python"`
+	// Command replaces the built-in sandbox, e.g. docker run with the directory mounted. {dir} is
+	// replaced by the directory with main.py, the command is run in it.
+	Command []string `yaml:"command"`
+	// Timeout of a run in seconds
+	Timeout int `yaml:"timeout"`
+	// CPUTime in seconds, the timeout by default
+	CPUTime int `yaml:"cpu_time"`
+	// Memory of the process in megabytes
+	Memory int `yaml:"memory"`
+	// Mounts are directories shown read-only to the code of the built-in sandbox besides the
+	// system ones and the installation of the interpreter, e.g. of the libraries
+	Mounts []string `yaml:"mounts"`
+}
+
+// sandboxSpec is what the init of the built-in sandbox gets from the bot
+type sandboxSpec struct {
+	// Dir with the script, writable in the sandbox
+	Dir string `json:"dir"`
+	// Python is the absolute path of the interpreter, started with Args and Env
+	Python string   `json:"python"`
+	Args   []string `json:"args"`
+	Env    []string `json:"env"`
+	// Mounts are shown read-only at the same paths, Hidden are covered
+	Mounts []string `json:"mounts"`
+	Hidden []string `json:"hidden"`
+	// Memory and FileSize in bytes, CPUTime in seconds
+	Memory   int `json:"memory"`
+	CPUTime  int `json:"cpu_time"`
+	FileSize int `json:"file_size"`
+}
+
+const (
+	// The init of the built-in sandbox is the bot started with this argument
+	sandboxInitArg = "run-python-sandbox"
+	// Mount point of the directory of the script in the built-in sandbox
+	sandboxWorkDir = "/sandbox"
+)
+
+// System directories of the built-in sandbox, the missing ones are skipped
+var sandboxSystemMounts = []string{"/usr", "/bin", "/sbin", "/lib", "/lib32", "/lib64", "/libx32", "/etc"}
+
+// codeFile is a file written by the code
+type codeFile struct {
+	Name string
+	Data []byte
+}
+
+func (f codeFile) isImage() bool {
+	switch strings.ToLower(filepath.Ext(f.Name)) {
+	case ".png", ".jpg", ".jpeg", ".gif", ".webp":
+		return true
+	}
+	return false
+}
+
+// codeResult is what the model gets back from run_python
+type codeResult struct {
+	ExitCode int      `json:"exit_code"`
+	TimedOut bool     `json:"timed_out,omitempty"`
+	Stdout   string   `json:"stdout"`
+	Stderr   string   `json:"stderr"`
+	Files    []string `json:"files,omitempty"`
+}
+
+// Files written by run_python during the current answer, they are sent to the chat after it
+var codeFiles = make(map[int64][]codeFile)
+
+// limitedBuffer keeps the first codeMaxOutputSize bytes written to it
+type limitedBuffer struct {
+	buffer    bytes.Buffer
+	truncated bool
+}
+
+func (b *limitedBuffer) Write(data []byte) (int, error) {
+	if room := codeMaxOutputSize - b.buffer.Len(); len(data) > room {
+		b.buffer.Write(data[:room])
+		b.truncated = true
+	} else {
+		b.buffer.Write(data)
+	}
+	return len(data), nil
+}
+
+func (b *limitedBuffer) String() string {
+	if b.truncated {
+		return b.buffer.String() + "\n[вывод обрезан]"
+	}
+	return b.buffer.String()
+}
+
+// registerCodeRunner adds run_python to functions after checking that the sandbox works
+func registerCodeRunner(runner CodeRunnerConfig) error {
+	if !runner.Enabled {
+		return nil
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), codeDefaultTimeout)
+	defer cancel()
+	result, _, err := runCode(ctx, runner, "print('ok')")
+	if err != nil {
+		return err
+	}
+	if result.ExitCode != 0 || strings.TrimSpace(result.Stdout) != "ok" {
+		return fmt.Errorf("test run failed with code %d: %s", result.ExitCode, result.Stderr)
+	}
+	functions = append(functions, Function{
+		Id:   len(functions) + 1,
+		Name: "run_python",
+		Description: "Run a Python 3 script without network access and return its exit code, stdout and stderr. " +
+			"Use print for the results. Files written to the current directory, e.g. matplotlib charts saved " +
+			"with savefig('chart.png'), are sent to the user, and the images are shown to you.",
+		Args: FunctionArgs{
+			Properties: map[string]interface{}{
+				"code": map[string]string{
+					"type":        "string",
+					"description": "Python code to run",
+				},
+			},
+			Required: []string{"code"},
+		},
+		Default: 1,
+		Active:  1,
+	})
+	return nil
+}
+
+// newSandboxSpec returns the spec of the built-in sandbox for the script in dir
+func newSandboxSpec(runner CodeRunnerConfig, dir string, timeout time.Duration) (sandboxSpec, error) {
+	python := runner.Python
+	if python == "" {
+		python = "python3"
+	}
+	path, err := exec.LookPath(python)
+	if err != nil {
+		return sandboxSpec{}, err
+	}
+	if path, err = filepath.Abs(path); err != nil {
+		return sandboxSpec{}, err
+	}
+	memory := runner.Memory
+	if memory <= 0 {
+		memory = codeDefaultMemory
+	}
+	cpuTime := runner.CPUTime
+	if cpuTime <= 0 {
+		cpuTime = int(timeout / time.Second)
+	}
+
+	// The installation of the interpreter, e.g. of a virtualenv, and the one it links to
+	mounts := append([]string{}, sandboxSystemMounts...)
+	mounts = append(mounts, runner.Mounts...)
+	if resolved, err := filepath.EvalSymlinks(path); err == nil {
+		mounts = append(mounts, filepath.Dir(filepath.Dir(resolved)))
+	}
+	mounts = append(mounts, filepath.Dir(filepath.Dir(path)))
+
+	// The code must not read the config with the keys and the chats of the users
+	hidden := []string{}
+	if workDir, err := os.Getwd(); err == nil && workDir != "/" {
+		hidden = append(hidden, workDir)
+	}
+	for _, path := range []string{config.StorageDir, DefaultStorageDir, config.WebCache.Dir} {
+		if path == "" {
+			continue
+		}
+		if path, err := filepath.Abs(path); err == nil {
+			hidden = append(hidden, path)
+		}
+	}
+
+	return sandboxSpec{
+		Dir:    dir,
+		Python: path,
+		Args:   []string{codeScriptName},
+		Env: []string{
+			"PATH=/usr/local/bin:/usr/bin:/bin",
+			"HOME=" + sandboxWorkDir,
+			"TMPDIR=/tmp",
+			"LANG=C.UTF-8",
+			"MPLBACKEND=Agg",
+			"MPLCONFIGDIR=" + sandboxWorkDir + "/.matplotlib",
+			"PYTHONUNBUFFERED=1",
+			// Every BLAS thread reserves memory counted by the limit
+			"OPENBLAS_NUM_THREADS=1",
+			"OMP_NUM_THREADS=1",
+		},
+		Mounts:   sandboxMounts(mounts),
+		Hidden:   hidden,
+		Memory:   memory << 20,
+		CPUTime:  cpuTime,
+		FileSize: codeMaxFileSize,
+	}, nil
+}
+
+// sandboxMounts returns the existing directories without the ones inside others and the root
+func sandboxMounts(paths []string) []string {
+	cleaned := []string{}
+	for _, path := range paths {
+		path = filepath.Clean(path)
+		if _, err := os.Lstat(path); err == nil && filepath.IsAbs(path) && path != "/" {
+			cleaned = append(cleaned, path)
+		}
+	}
+	sort.Strings(cleaned)
+	mounts := []string{}
+	for _, path := range cleaned {
+		if len(mounts) > 0 {
+			last := mounts[len(mounts)-1]
+			if path == last || strings.HasPrefix(path, last+"/") {
+				continue
+			}
+		}
+		mounts = append(mounts, path)
+	}
+	return mounts
+}
+
+// runCode runs the code in a new temporary directory and returns the output and the files it wrote
+func runCode(ctx context.Context, runner CodeRunnerConfig, code string) (codeResult, []codeFile, error) {
+	dir, err := os.MkdirTemp("", "run_python")
+	if err != nil {
+		return codeResult{}, nil, err
+	}
+	defer os.RemoveAll(dir)
+	if err := os.WriteFile(filepath.Join(dir, codeScriptName), []byte(code), 0644); err != nil {
+		return codeResult{}, nil, err
+	}
+	// Hidden files, e.g. the caches of the libraries, are not sent to the chat
+	if err := os.Mkdir(filepath.Join(dir, ".tmp"), 0755); err != nil {
+		return codeResult{}, nil, err
+	}
+
+	timeout := codeDefaultTimeout
+	if runner.Timeout > 0 {
+		timeout = time.Duration(runner.Timeout) * time.Second
+	}
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	stdout := &limitedBuffer{}
+	stderr := &limitedBuffer{}
+	var cmd *exec.Cmd
+	if len(runner.Command) > 0 {
+		args := []string{}
+		for _, arg := range runner.Command {
+			args = append(args, strings.ReplaceAll(arg, "{dir}", dir))
+		}
+		cmd = runnerCommand(args)
+		cmd.Env = []string{"PATH=" + os.Getenv("PATH"), "HOME=" + dir}
+	} else {
+		spec, err := newSandboxSpec(runner, dir, timeout)
+		if err != nil {
+			return codeResult{}, nil, err
+		}
+		if cmd, err = sandboxCommand(spec); err != nil {
+			return codeResult{}, nil, err
+		}
+	}
+	cmd.Dir = dir
+	cmd.Stdout = stdout
+	cmd.Stderr = stderr
+	if err := cmd.Start(); err != nil {
+		return codeResult{}, nil, fmt.Errorf("failed to start the sandbox: %w", err)
+	}
+	done := make(chan error, 1)
+	go func() {
+		done <- cmd.Wait()
+	}()
+	timedOut := false
+	select {
+	case err = <-done:
+	case <-ctx.Done():
+		// The code may have started processes of its own
+		killSandbox(cmd)
+		err = <-done
+		timedOut = true
+	}
+
+	result := codeResult{Stdout: stdout.String(), Stderr: stderr.String(), TimedOut: timedOut}
+	var exitErr interface{ ExitCode() int }
+	if errors.As(err, &exitErr) {
+		result.ExitCode = exitErr.ExitCode()
+	} else if err != nil {
+		return codeResult{}, nil, err
+	}
+	if timedOut {
+		result.Stderr += fmt.Sprintf("\nПревышено время выполнения %v", timeout)
+	}
+
+	files := []codeFile{}
+	filepath.WalkDir(dir, func(path string, entry fs.DirEntry, err error) error {
+		if err != nil {
+			return nil
+		}
+		if strings.HasPrefix(entry.Name(), ".") && entry.IsDir() {
+			return filepath.SkipDir
+		}
+		name, _ := filepath.Rel(dir, path)
+		if !entry.Type().IsRegular() || name == codeScriptName || strings.HasPrefix(entry.Name(), ".") {
+			return nil
+		}
+		info, err := entry.Info()
+		if err != nil || info.Size() > codeMaxFileSize || len(files) >= codeMaxFiles {
+			result.Files = append(result.Files, name+" (не отправлен)")
+			return nil
+		}
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return nil
+		}
+		files = append(files, codeFile{Name: name, Data: data})
+		result.Files = append(result.Files, name)
+		return nil
+	})
+	return result, files, nil
+}
+
+// callRunPython runs the code of the model and keeps the files for the chat
+func callRunPython(chatID int64, args string) (string, error) {
+	if !config.CodeRunner.Enabled {
+		return "", errors.New("выполнение кода отключено")
+	}
+	arguments := struct {
+		Code string `json:"code"`
+	}{}
+	if err := json.Unmarshal([]byte(args), &arguments); err != nil {
+		return "", errors.New("Ошибка парсинга аргументов: " + err.Error())
+	}
+	if strings.TrimSpace(arguments.Code) == "" {
+		return "", errors.New("код не задан")
+	}
+	result, files, err := runCode(context.Background(), config.CodeRunner, arguments.Code)
+	if err != nil {
+		return "", err
+	}
+	mu.Lock()
+	codeFiles[chatID] = append(codeFiles[chatID], files...)
+	mu.Unlock()
+	output, err := json.Marshal(result)
+	if err != nil {
+		return "", err
+	}
+	return string(output), nil
+}
+
+// codeImagesMessage shows the images written by the code to the model. Tool results can't contain
+// images, so they are added as a user message after the results.
+func codeImagesMessage(files []codeFile) (gpt3.ChatCompletionRequestMessage, bool) {
+	content := []interface{}{}
+	for _, file := range files {
+		if !file.isImage() || len(file.Data) > codeMaxModelImageSize || len(content) >= codeMaxModelImages {
+			continue
+		}
+		content = append(content, gpt3.ChatCompletionRequestContentEntryImage{
+			Type: "image_url",
+			ImageUrl: gpt3.ChatCompletionRequestImageUrl{
+				Url:    "data:" + http.DetectContentType(file.Data) + ";base64," + base64.StdEncoding.EncodeToString(file.Data),
+				Detail: "low",
+			},
+		})
+	}
+	if len(content) == 0 {
+		return gpt3.ChatCompletionRequestMessage{}, false
+	}
+	content = append([]interface{}{gpt3.ChatCompletionRequestContentEntryText{
+		Type: "text",
+		Text: "Изображения, созданные run_python:",
+	}}, content...)
+	return gpt3.ChatCompletionRequestMessage{Role: "user", Content: content}, true
+}
+
+// sendCodeFiles sends the files written by run_python during the answer, images as photos
+func sendCodeFiles(bot *tgbotapi.BotAPI, chatID int64, replyToMessageID int) {
+	mu.Lock()
+	files := codeFiles[chatID]
+	delete(codeFiles, chatID)
+	mu.Unlock()
+	sort.SliceStable(files, func(i, j int) bool {
+		return files[i].isImage() && !files[j].isImage()
+	})
+	for _, file := range files {
+		data := tgbotapi.FileBytes{Name: filepath.Base(file.Name), Bytes: file.Data}
+		var message tgbotapi.Chattable
+		// Telegram doesn't accept larger photos
+		if file.isImage() && len(file.Data) <= 10<<20 {
+			photo := tgbotapi.NewPhoto(chatID, data)
+			photo.ReplyToMessageID = replyToMessageID
+			message = photo
+		} else {
+			document := tgbotapi.NewDocument(chatID, data)
+			document.ReplyToMessageID = replyToMessageID
+			message = document
+		}
+		if _, err := bot.Send(message); err != nil {
+			log.Printf("Failed to send file %s: %v", file.Name, err)
+		}
+	}
+}
@@ -0,0 +1,240 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"syscall"
+)
+
+const (
+	// prctl options and securebits missing from syscall
+	prSetNoNewPrivs   = 38
+	prCapbsetDrop     = 24
+	prSetSecurebits   = 28
+	secbitNoroot      = 1 << 0
+	secbitNorootLock  = 1 << 1
+	stRelatime        = 0x1000
+	sandboxMaxCapsNum = 64
+)
+
+// sandboxCommand runs the spec in new user, mount, PID, network and IPC namespaces. The bot
+// itself is started again as the init of the sandbox, it builds the file system and starts Python.
+func sandboxCommand(spec sandboxSpec) (*exec.Cmd, error) {
+	data, err := json.Marshal(spec)
+	if err != nil {
+		return nil, err
+	}
+	cmd := exec.Command("/proc/self/exe", sandboxInitArg, string(data))
+	// Nothing of the environment of the bot, e.g. the keys, is passed to the sandbox
+	cmd.Env = []string{}
+	cmd.SysProcAttr = &syscall.SysProcAttr{
+		Setpgid:    true,
+		Pdeathsig:  syscall.SIGKILL,
+		Cloneflags: syscall.CLONE_NEWUSER | syscall.CLONE_NEWNS | syscall.CLONE_NEWPID | syscall.CLONE_NEWNET | syscall.CLONE_NEWIPC,
+		// The init is root of the namespace to be able to mount, it gives up the capabilities before
+		// starting Python
+		UidMappings: []syscall.SysProcIDMap{{ContainerID: 0, HostID: os.Getuid(), Size: 1}},
+		GidMappings: []syscall.SysProcIDMap{{ContainerID: 0, HostID: os.Getgid(), Size: 1}},
+	}
+	return cmd, nil
+}
+
+// runnerCommand runs the command of the config in its own process group
+func runnerCommand(args []string) *exec.Cmd {
+	cmd := exec.Command(args[0], args[1:]...)
+	cmd.SysProcAttr = &syscall.SysProcAttr{
+		Setpgid:   true,
+		Pdeathsig: syscall.SIGKILL,
+	}
+	return cmd
+}
+
+// killSandbox kills the process group of the command
+func killSandbox(cmd *exec.Cmd) {
+	syscall.Kill(-cmd.Process.Pid, syscall.SIGKILL)
+}
+
+// runSandboxInit is the init of the sandbox started by sandboxCommand. The root is an empty
+// read-only tmpfs with the system directories and the interpreter mounted read-only and the
+// directory of the script writable, the files of the bot are hidden. It doesn't return.
+func runSandboxInit(data string) {
+	// Capabilities are per thread, they must be dropped on the thread that starts Python
+	runtime.LockOSThread()
+	spec := sandboxSpec{}
+	err := json.Unmarshal([]byte(data), &spec)
+	if err == nil {
+		err = setupSandbox(spec)
+	}
+	if err == nil {
+		err = syscall.Exec(spec.Python, append([]string{spec.Python}, spec.Args...), spec.Env)
+	}
+	fmt.Fprintf(os.Stderr, "sandbox: %v\n", err)
+	os.Exit(127)
+}
+
+func setupSandbox(spec sandboxSpec) error {
+	// Mounts of the sandbox must not propagate to the system
+	if err := syscall.Mount("", "/", "", syscall.MS_REC|syscall.MS_PRIVATE, ""); err != nil {
+		return fmt.Errorf("private mounts: %w", err)
+	}
+	root := filepath.Join(spec.Dir, ".root")
+	if err := os.MkdirAll(root, 0700); err != nil {
+		return err
+	}
+	if err := syscall.Mount("tmpfs", root, "tmpfs", syscall.MS_NOSUID|syscall.MS_NODEV, "mode=0755"); err != nil {
+		return fmt.Errorf("root: %w", err)
+	}
+	for _, path := range spec.Mounts {
+		if err := bindReadOnly(path, filepath.Join(root, path)); err != nil {
+			return fmt.Errorf("mount %s: %w", path, err)
+		}
+	}
+
+	if err := os.MkdirAll(filepath.Join(root, "dev"), 0755); err != nil {
+		return err
+	}
+	if err := syscall.Mount("tmpfs", filepath.Join(root, "dev"), "tmpfs", syscall.MS_NOSUID|syscall.MS_NOEXEC, "mode=0755"); err != nil {
+		return fmt.Errorf("dev: %w", err)
+	}
+	for _, device := range []string{"null", "zero", "full", "random", "urandom"} {
+		target := filepath.Join(root, "dev", device)
+		if err := os.WriteFile(target, nil, 0666); err != nil {
+			return err
+		}
+		if err := syscall.Mount("/dev/"+device, target, "", syscall.MS_BIND, ""); err != nil {
+			return fmt.Errorf("dev %s: %w", device, err)
+		}
+	}
+
+	for _, dir := range []string{sandboxWorkDir, "/tmp", "/proc"} {
+		if err := os.MkdirAll(filepath.Join(root, dir), 0755); err != nil {
+			return err
+		}
+	}
+	if err := syscall.Mount(spec.Dir, filepath.Join(root, sandboxWorkDir), "", syscall.MS_BIND|syscall.MS_NOSUID|syscall.MS_NODEV, ""); err != nil {
+		return fmt.Errorf("work dir: %w", err)
+	}
+	if err := syscall.Mount(filepath.Join(spec.Dir, ".tmp"), filepath.Join(root, "tmp"), "", syscall.MS_BIND|syscall.MS_NOSUID|syscall.MS_NODEV, ""); err != nil {
+		return fmt.Errorf("tmp: %w", err)
+	}
+	// The proc of the new PID namespace can't be mounted where the proc of the system has masked
+	// paths, e.g. in Docker, Python works without it
+	syscall.Mount("proc", filepath.Join(root, "proc"), "proc", syscall.MS_NOSUID|syscall.MS_NODEV|syscall.MS_NOEXEC, "")
+
+	// The mounted directories may contain the bot, e.g. /usr/src/app
+	for _, path := range spec.Hidden {
+		if err := hidePath(root, path); err != nil {
+			return fmt.Errorf("hide %s: %w", path, err)
+		}
+	}
+
+	if err := syscall.Mount("", root, "", syscall.MS_REMOUNT|syscall.MS_RDONLY|syscall.MS_NOSUID|syscall.MS_NODEV, ""); err != nil {
+		return fmt.Errorf("read-only root: %w", err)
+	}
+	if err := syscall.Chdir(root); err != nil {
+		return err
+	}
+	if err := syscall.PivotRoot(".", "."); err != nil {
+		return fmt.Errorf("pivot_root: %w", err)
+	}
+	// The old root is on top of the new one after pivot_root(".", ".")
+	if err := syscall.Unmount(".", syscall.MNT_DETACH); err != nil {
+		return fmt.Errorf("unmount the old root: %w", err)
+	}
+	if err := syscall.Chdir(sandboxWorkDir); err != nil {
+		return err
+	}
+
+	limits := []struct {
+		resource int
+		value    int
+	}{
+		{syscall.RLIMIT_AS, spec.Memory},
+		{syscall.RLIMIT_CPU, spec.CPUTime},
+		{syscall.RLIMIT_FSIZE, spec.FileSize},
+	}
+	for _, limit := range limits {
+		value := uint64(limit.value)
+		if err := syscall.Setrlimit(limit.resource, &syscall.Rlimit{Cur: value, Max: value}); err != nil {
+			return fmt.Errorf("limit %d: %w", limit.resource, err)
+		}
+	}
+	return dropCapabilities()
+}
+
+// bindReadOnly mounts source at target read-only, symlinks such as /bin -> usr/bin are copied
+func bindReadOnly(source string, target string) error {
+	info, err := os.Lstat(source)
+	if err != nil {
+		return err
+	}
+	if info.Mode()&os.ModeSymlink != 0 {
+		link, err := os.Readlink(source)
+		if err != nil {
+			return err
+		}
+		if err := os.MkdirAll(filepath.Dir(target), 0755); err != nil {
+			return err
+		}
+		return os.Symlink(link, target)
+	}
+	if err := os.MkdirAll(target, 0755); err != nil {
+		return err
+	}
+	if err := syscall.Mount(source, target, "", syscall.MS_BIND|syscall.MS_REC, ""); err != nil {
+		return err
+	}
+	// A mount of another user namespace can only be remounted with the flags it already has
+	var stat syscall.Statfs_t
+	if err := syscall.Statfs(source, &stat); err != nil {
+		return err
+	}
+	flags := uintptr(syscall.MS_REMOUNT | syscall.MS_BIND | syscall.MS_RDONLY | syscall.MS_NOSUID | syscall.MS_NODEV)
+	flags |= uintptr(stat.Flags) & (syscall.MS_NOEXEC | syscall.MS_NOATIME | syscall.MS_NODIRATIME)
+	if stat.Flags&stRelatime != 0 {
+		flags |= syscall.MS_RELATIME
+	}
+	return syscall.Mount("", target, "", flags, "")
+}
+
+// hidePath covers the directory with an empty read-only tmpfs or the file with /dev/null
+func hidePath(root string, path string) error {
+	target := filepath.Join(root, path)
+	info, err := os.Stat(target)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if info.IsDir() {
+		return syscall.Mount("tmpfs", target, "tmpfs", syscall.MS_RDONLY|syscall.MS_NOSUID|syscall.MS_NODEV|syscall.MS_NOEXEC, "size=0")
+	}
+	return syscall.Mount(filepath.Join(root, "dev/null"), target, "", syscall.MS_BIND, "")
+}
+
+// dropCapabilities leaves Python without the capabilities of the root of the namespace, e.g. to
+// change the mounts
+func dropCapabilities() error {
+	if _, _, errno := syscall.RawSyscall(syscall.SYS_PRCTL, prSetNoNewPrivs, 1, 0); errno != 0 {
+		return fmt.Errorf("no_new_privs: %w", errno)
+	}
+	for capability := 0; capability < sandboxMaxCapsNum; capability++ {
+		// Numbers past the last capability of the kernel are invalid
+		if _, _, errno := syscall.RawSyscall(syscall.SYS_PRCTL, prCapbsetDrop, uintptr(capability), 0); errno == syscall.EINVAL {
+			break
+		} else if errno != 0 {
+			return fmt.Errorf("drop capability %d: %w", capability, errno)
+		}
+	}
+	// Root gets no capabilities when it starts Python
+	if _, _, errno := syscall.RawSyscall(syscall.SYS_PRCTL, prSetSecurebits, secbitNoroot|secbitNorootLock, 0); errno != 0 {
+		return fmt.Errorf("securebits: %w", errno)
+	}
+	return nil
+}
@@ -0,0 +1,30 @@
+//go:build !linux
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+)
+
+// sandboxCommand fails, the built-in sandbox needs Linux namespaces
+func sandboxCommand(spec sandboxSpec) (*exec.Cmd, error) {
+	return nil, errors.New("the built-in sandbox requires Linux, set code_runner.command")
+}
+
+// runnerCommand runs the command of the config
+func runnerCommand(args []string) *exec.Cmd {
+	return exec.Command(args[0], args[1:]...)
+}
+
+// killSandbox kills the command, the processes it started may outlive it
+func killSandbox(cmd *exec.Cmd) {
+	cmd.Process.Kill()
+}
+
+func runSandboxInit(data string) {
+	fmt.Fprintln(os.Stderr, "sandbox: the built-in sandbox requires Linux")
+	os.Exit(127)
+}
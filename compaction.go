@@ -0,0 +1,188 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"strings"
+
+	gpt3 "chat_bot/gpt3"
+)
+
+const (
+	DefaultCompactionThreshold    = 0.8
+	DefaultCompactionModel        = "gpt-4.1-mini"
+	DefaultCompactionKeepMessages = 6
+
+	compactionSummaryPrefix = "Summary of the earlier part of the conversation:\n"
+	compactionPrompt        = "Summarize the conversation below so that it can replace it as context for continuing the dialog. " +
+		"Keep facts, decisions, names, numbers, code, URLs and open questions. Write in the language of the conversation. " +
+		"Do not add anything that is not in the conversation."
+	// Long function outputs are cut in the transcript that is sent for summarization
+	compactionMaxMessageLength = 4000
+)
+
+// compactHistoryIfNeeded replaces older turns of the conversation with a summary once the history
+// takes more than compaction_threshold of the model context. The system prompt and the most
+// recent messages are kept verbatim. Returns true if the history was compacted.
+func compactHistoryIfNeeded(ctx context.Context, chatID int64, model string, contextSize int, reservedTokens int) (bool, error) {
+	threshold := config.CompactionThreshold
+	if threshold <= 0 {
+		threshold = DefaultCompactionThreshold
+	}
+	keepMessages := config.CompactionKeepMessages
+	if keepMessages <= 0 {
+		keepMessages = DefaultCompactionKeepMessages
+	}
+
+	mu.Lock()
+	history := append([]gpt3.ChatCompletionRequestMessage{}, conversationHistory[chatID]...)
+	mu.Unlock()
+
+	totalTokens := tokenCounter.CountMessages(model, history)
+	if float64(totalTokens+reservedTokens) <= threshold*float64(contextSize) {
+		return false, nil
+	}
+
+	// Leading system messages stay as they are
+	start := 0
+	for start < len(history) && history[start].Role == "system" && !isCompactionSummary(history[start]) {
+		start++
+	}
+	// Split on a user message so that function calls are never separated from their results
+	split := len(history) - keepMessages
+	for split > start && history[split].Role != "user" {
+		split--
+	}
+	if split <= start+1 {
+		return false, nil
+	}
+
+	summary, err := summarizeMessages(ctx, model, history[start:split])
+	if err != nil {
+		return false, err
+	}
+	compacted := append([]gpt3.ChatCompletionRequestMessage{}, history[:start]...)
+	compacted = append(compacted, gpt3.ChatCompletionRequestMessage{
+		Role:    "system",
+		Content: compactionSummaryPrefix + summary,
+	})
+	compacted = append(compacted, history[split:]...)
+	removed := split - start - 1
+
+	mu.Lock()
+	defer mu.Unlock()
+	if len(conversationHistory[chatID]) < len(history) {
+		// The history was reset while the summary was generated
+		return false, nil
+	}
+	conversationHistory[chatID] = append(compacted, conversationHistory[chatID][len(history):]...)
+
+	// Summarized messages cannot be edited or branched from anymore
+	conversation := activeConversationLocked(chatID)
+	turns := []Turn{}
+	for _, turn := range conversation.Turns {
+		if turn.Index >= split {
+			turn.Index -= removed
+			turns = append(turns, turn)
+		}
+	}
+	conversation.Turns = turns
+	log.Printf("Compacted history of chat %d: %d messages replaced by a summary", chatID, split-start)
+	return true, nil
+}
+
+func isCompactionSummary(message gpt3.ChatCompletionRequestMessage) bool {
+	text, ok := message.Content.(string)
+	return ok && strings.HasPrefix(text, compactionSummaryPrefix)
+}
+
+// summarizeMessages generates the summary with compaction_model. Conversations with a model of
+// another provider or API are summarized by the same model, so that they never leave that provider
+// and the request goes to the API the provider speaks.
+func summarizeMessages(ctx context.Context, chatModel string, messages []gpt3.ChatCompletionRequestMessage) (string, error) {
+	transcript := strings.Builder{}
+	for _, message := range messages {
+		text := ""
+		switch content := message.Content.(type) {
+		case string:
+			text = content
+		default:
+			text = "[image]"
+		}
+		if functionCall, ok := message.FunctionCall.(gpt3.ChatCompletionResponseFunctionCall); ok {
+			text = "call " + functionCall.Name + "(" + functionCall.Arguments + ")"
+		}
+		for _, toolCall := range message.ToolCalls {
+			text = strings.TrimSpace(text + "\ncall " + formatToolCall(toolCall))
+		}
+		if text == "" {
+			continue
+		}
+		if len([]rune(text)) > compactionMaxMessageLength {
+			text = substr(text, 0, compactionMaxMessageLength) + "…"
+		}
+		role := message.Role
+		if message.Name != "" {
+			role += " " + message.Name
+		}
+		transcript.WriteString(role + ": " + text + "\n\n")
+	}
+
+	model := config.CompactionModel
+	if model == "" {
+		model = DefaultCompactionModel
+	}
+	spec := modelRegistry.Get(model)
+	chatSpec := modelRegistry.Get(chatModel)
+	if !sameBackend(spec, chatSpec) {
+		spec = chatSpec
+	}
+	provider, err := chatProviderForModel(spec)
+	if err != nil {
+		return "", fmt.Errorf("failed to summarize history: %w", err)
+	}
+	messages = []gpt3.ChatCompletionRequestMessage{
+		{
+			Role:    "system",
+			Content: compactionPrompt,
+		},
+		{
+			Role:    "user",
+			Content: transcript.String(),
+		},
+	}
+	maxTokens := spec.ContextWindow - (tokenCounter.CountMessages(spec.Name, messages) + 100)
+	if maxTokens < 10 {
+		return "", fmt.Errorf("failed to summarize history: the transcript does not fit in the context of %s", spec.Name)
+	}
+	if spec.MaxOutputTokens > 0 && spec.MaxOutputTokens < maxTokens {
+		maxTokens = spec.MaxOutputTokens
+	}
+	// The summary is not shown to the user, there is nothing to stream
+	spec.Stream = false
+	result, err := provider.StreamChat(ctx, ChatRequest{
+		Spec:      spec,
+		Messages:  messages,
+		MaxTokens: maxTokens,
+	}, func(ChatDelta) {})
+	if err != nil {
+		return "", fmt.Errorf("failed to summarize history: %w", err)
+	}
+	if strings.TrimSpace(result.Text) == "" {
+		return "", fmt.Errorf("failed to summarize history: empty response")
+	}
+	return strings.TrimSpace(result.Text), nil
+}
+
+// sameBackend reports whether the models are served by the same API of the same endpoint, so
+// that a conversation with one of them may be sent to the other
+func sameBackend(a ModelSpec, b ModelSpec) bool {
+	vendor := func(api string) string {
+		if api == "" || api == APIResponses {
+			return APIOpenAI
+		}
+		return api
+	}
+	return a.Provider == b.Provider && vendor(a.API) == vendor(b.API)
+}
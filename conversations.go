@@ -0,0 +1,385 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"strconv"
+	"strings"
+	"time"
+
+	gpt3 "chat_bot/gpt3"
+
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api/v5"
+)
+
+const conversationCallbackPrefix = "chat:"
+
+type Conversation struct {
+	ID      string    `json:"id"`
+	Title   string    `json:"title"`
+	Created time.Time `json:"created"`
+	Turns   []Turn    `json:"turns,omitempty"`
+	// ResponseChain is the last answer stored on the server, for models of the Responses API
+	ResponseChain *ResponseChain `json:"response_chain,omitempty"`
+}
+
+// Turn links a user message in the conversation history to the Telegram message it came from
+// and to the Telegram messages of the answer
+type Turn struct {
+	// Index is the position of the user message in the conversation history
+	Index           int   `json:"index"`
+	UserMessageID   int   `json:"user_message_id"`
+	ReplyMessageIDs []int `json:"reply_message_ids"`
+}
+
+// Conversations of every chat, the history of the active one lives in conversationHistory
+var chatConversations = make(map[int64][]Conversation)
+
+// The answer being generated is added to the active conversation when it is finished, so the
+// conversations can't change until then
+var errGenerating = errors.New("дождитесь окончания текущего ответа")
+
+// switching marks the chats whose active conversation is being replaced, guarded by mu. The
+// history is loaded and saved without mu, no answer may start in between.
+var switching = make(map[int64]bool)
+
+// beginSwitchLocked marks the chat as switching unless an answer is being generated. endSwitch
+// must be called once the new conversation is active.
+func beginSwitchLocked(chatID int64) error {
+	if generating[chatID] || switching[chatID] {
+		return errGenerating
+	}
+	switching[chatID] = true
+	return nil
+}
+
+func endSwitch(chatID int64) {
+	mu.Lock()
+	delete(switching, chatID)
+	mu.Unlock()
+}
+
+// ensureConversationLocked returns the active conversation ID of the chat, creating the first
+// conversation if there is none yet. mu must be held.
+func ensureConversationLocked(chatID int64) string {
+	user := userSettingsMap[chatID]
+	if user.ConversationID != "" && findConversationLocked(chatID, user.ConversationID) >= 0 {
+		return user.ConversationID
+	}
+	conversations := chatConversations[chatID]
+	if len(conversations) > 0 {
+		user.ConversationID = conversations[len(conversations)-1].ID
+	} else {
+		user.ConversationID = newConversationLocked(chatID, "").ID
+	}
+	userSettingsMap[chatID] = user
+	return user.ConversationID
+}
+
+func findConversationLocked(chatID int64, conversationID string) int {
+	for i, conversation := range chatConversations[chatID] {
+		if conversation.ID == conversationID {
+			return i
+		}
+	}
+	return -1
+}
+
+// activeConversationLocked returns the active conversation of the chat. The pointer is only valid
+// while mu is held.
+func activeConversationLocked(chatID int64) *Conversation {
+	index := findConversationLocked(chatID, ensureConversationLocked(chatID))
+	return &chatConversations[chatID][index]
+}
+
+// resetTurnsLocked forgets the Telegram messages of the active conversation, must be called
+// whenever its history is replaced. mu must be held.
+func resetTurnsLocked(chatID int64) {
+	activeConversationLocked(chatID).Turns = nil
+}
+
+// validTurnLocked checks that the turn still points at a user message of the history
+func validTurnLocked(chatID int64, turn Turn) bool {
+	history := conversationHistory[chatID]
+	if turn.Index < 0 || turn.Index >= len(history) || history[turn.Index].Role != "user" {
+		return false
+	}
+	_, ok := history[turn.Index].Content.(string)
+	return ok
+}
+
+// lastTurnLocked returns the most recent valid turn of the active conversation
+func lastTurnLocked(chatID int64) (Turn, bool) {
+	turns := activeConversationLocked(chatID).Turns
+	for i := len(turns) - 1; i >= 0; i-- {
+		if validTurnLocked(chatID, turns[i]) {
+			return turns[i], true
+		}
+	}
+	return Turn{}, false
+}
+
+// findTurnLocked returns the position in Turns of the turn that has the given user message
+// or one of the answer messages
+func findTurnLocked(chatID int64, messageID int, byReply bool) int {
+	turns := activeConversationLocked(chatID).Turns
+	for i, turn := range turns {
+		if !validTurnLocked(chatID, turn) {
+			continue
+		}
+		if !byReply && turn.UserMessageID == messageID {
+			return i
+		}
+		if byReply {
+			for _, id := range turn.ReplyMessageIDs {
+				if id == messageID {
+					return i
+				}
+			}
+		}
+	}
+	return -1
+}
+
+// truncateToTurnLocked drops the user message of the turn and everything after it from the history
+// together with the later turns. Returns the dropped turns.
+func truncateToTurnLocked(chatID int64, turnIndex int) []Turn {
+	conversation := activeConversationLocked(chatID)
+	turn := conversation.Turns[turnIndex]
+	dropped := append([]Turn{}, conversation.Turns[turnIndex:]...)
+	conversation.Turns = conversation.Turns[:turnIndex]
+	conversationHistory[chatID] = append([]gpt3.ChatCompletionRequestMessage{}, conversationHistory[chatID][:turn.Index]...)
+	return dropped
+}
+
+// recordTurn remembers the Telegram messages of a new answer and removes the regenerate button
+// from the previous answer
+func recordTurn(bot *tgbotapi.BotAPI, chatID int64, index int, userMessageID int, replyMessageIDs []int) {
+	if len(replyMessageIDs) == 0 {
+		return
+	}
+	mu.Lock()
+	previous, hasPrevious := lastTurnLocked(chatID)
+	conversation := activeConversationLocked(chatID)
+	turns := []Turn{}
+	for _, turn := range conversation.Turns {
+		if turn.Index < index {
+			turns = append(turns, turn)
+		}
+	}
+	conversation.Turns = append(turns, Turn{
+		Index:           index,
+		UserMessageID:   userMessageID,
+		ReplyMessageIDs: replyMessageIDs,
+	})
+	mu.Unlock()
+	if hasPrevious && previous.Index != index {
+		removeRegenerateButton(bot, chatID, previous.ReplyMessageIDs)
+	}
+}
+
+func newConversationLocked(chatID int64, title string) Conversation {
+	maxID := 0
+	for _, conversation := range chatConversations[chatID] {
+		if id, err := strconv.Atoi(conversation.ID); err == nil && id > maxID {
+			maxID = id
+		}
+	}
+	conversation := Conversation{
+		ID:      strconv.Itoa(maxID + 1),
+		Title:   title,
+		Created: time.Now().UTC(),
+	}
+	chatConversations[chatID] = append(chatConversations[chatID], conversation)
+	return conversation
+}
+
+// conversationTitle returns the title of the conversation or the beginning of its first user message
+func conversationTitle(conversation Conversation, history []gpt3.ChatCompletionRequestMessage) string {
+	if conversation.Title != "" {
+		return conversation.Title
+	}
+	for _, message := range history {
+		if text, ok := message.Content.(string); ok && message.Role == "user" && strings.TrimSpace(text) != "" {
+			title := strings.Join(strings.Fields(text), " ")
+			if len([]rune(title)) > 30 {
+				title = substr(title, 0, 30) + "…"
+			}
+			return title
+		}
+	}
+	return "Беседа " + conversation.ID
+}
+
+// startConversation saves the active conversation and makes a new empty one active
+func startConversation(chatID int64, title string) (Conversation, error) {
+	mu.Lock()
+	err := beginSwitchLocked(chatID)
+	mu.Unlock()
+	if err != nil {
+		return Conversation{}, err
+	}
+	defer endSwitch(chatID)
+	saveChat(chatID)
+	mu.Lock()
+	conversation := newConversationLocked(chatID, title)
+	user := userSettingsMap[chatID]
+	user.ConversationID = conversation.ID
+	userSettingsMap[chatID] = user
+	conversationHistory[chatID] = []gpt3.ChatCompletionRequestMessage{}
+	mu.Unlock()
+	saveChat(chatID)
+	return conversation, nil
+}
+
+// switchConversation saves the active conversation and loads the history of another one
+func switchConversation(chatID int64, conversationID string) error {
+	mu.Lock()
+	if findConversationLocked(chatID, conversationID) < 0 {
+		mu.Unlock()
+		return fmt.Errorf("беседа %s не найдена", conversationID)
+	}
+	err := beginSwitchLocked(chatID)
+	mu.Unlock()
+	if err != nil {
+		return err
+	}
+	defer endSwitch(chatID)
+	saveChat(chatID)
+	history, err := store.LoadHistory(chatID, conversationID)
+	if err != nil {
+		return err
+	}
+	mu.Lock()
+	user := userSettingsMap[chatID]
+	user.ConversationID = conversationID
+	userSettingsMap[chatID] = user
+	conversationHistory[chatID] = history
+	mu.Unlock()
+	saveChat(chatID)
+	return nil
+}
+
+func renameConversation(chatID int64, conversationID string, title string) error {
+	mu.Lock()
+	index := findConversationLocked(chatID, conversationID)
+	if index < 0 {
+		mu.Unlock()
+		return fmt.Errorf("беседа %s не найдена", conversationID)
+	}
+	chatConversations[chatID][index].Title = title
+	mu.Unlock()
+	saveChat(chatID)
+	return nil
+}
+
+// deleteConversation removes the conversation, if it was active the most recent remaining one becomes active
+func deleteConversation(chatID int64, conversationID string) error {
+	mu.Lock()
+	index := findConversationLocked(chatID, conversationID)
+	if index < 0 {
+		mu.Unlock()
+		return fmt.Errorf("беседа %s не найдена", conversationID)
+	}
+	if err := beginSwitchLocked(chatID); err != nil {
+		mu.Unlock()
+		return err
+	}
+	conversations := chatConversations[chatID]
+	chatConversations[chatID] = append(conversations[:index:index], conversations[index+1:]...)
+	wasActive := userSettingsMap[chatID].ConversationID == conversationID
+	mu.Unlock()
+	defer endSwitch(chatID)
+
+	if err := store.DeleteHistory(chatID, conversationID); err != nil {
+		log.Printf("Failed to delete history for chat %d: %v", chatID, err)
+	}
+	if !wasActive {
+		saveChat(chatID)
+		return nil
+	}
+
+	mu.Lock()
+	user := userSettingsMap[chatID]
+	user.ConversationID = ""
+	userSettingsMap[chatID] = user
+	activeID := ensureConversationLocked(chatID)
+	mu.Unlock()
+	history, err := store.LoadHistory(chatID, activeID)
+	if err != nil {
+		return err
+	}
+	mu.Lock()
+	conversationHistory[chatID] = history
+	mu.Unlock()
+	saveChat(chatID)
+	return nil
+}
+
+func conversationsKeyboard(chatID int64) (string, tgbotapi.InlineKeyboardMarkup) {
+	mu.Lock()
+	conversations := append([]Conversation{}, chatConversations[chatID]...)
+	activeID := userSettingsMap[chatID].ConversationID
+	activeHistory := conversationHistory[chatID]
+	mu.Unlock()
+
+	rows := [][]tgbotapi.InlineKeyboardButton{}
+	for _, conversation := range conversations {
+		history := activeHistory
+		if conversation.ID != activeID {
+			var err error
+			history, err = store.LoadHistory(chatID, conversation.ID)
+			if err != nil {
+				log.Printf("Failed to load history for chat %d: %v", chatID, err)
+			}
+		}
+		title := conversation.ID + ". " + conversationTitle(conversation, history)
+		if conversation.ID == activeID {
+			title = "✅ " + title
+		}
+		rows = append(rows, tgbotapi.NewInlineKeyboardRow(
+			tgbotapi.NewInlineKeyboardButtonData(title, conversationCallbackPrefix+"switch:"+conversation.ID),
+			tgbotapi.NewInlineKeyboardButtonData("🗑", conversationCallbackPrefix+"delete:"+conversation.ID),
+		))
+	}
+	rows = append(rows, tgbotapi.NewInlineKeyboardRow(
+		tgbotapi.NewInlineKeyboardButtonData("➕ Новая беседа", conversationCallbackPrefix+"new"),
+	))
+	return "Ваши беседы:", tgbotapi.NewInlineKeyboardMarkup(rows...)
+}
+
+func handleConversationCallback(bot *tgbotapi.BotAPI, query *tgbotapi.CallbackQuery) {
+	chatID := query.Message.Chat.ID
+	action := strings.TrimPrefix(query.Data, conversationCallbackPrefix)
+	answer := ""
+	switch {
+	case action == "new":
+		if _, err := startConversation(chatID, ""); err != nil {
+			answer = "Ошибка: " + err.Error()
+		} else {
+			answer = "Начата новая беседа"
+		}
+	case strings.HasPrefix(action, "switch:"):
+		if err := switchConversation(chatID, strings.TrimPrefix(action, "switch:")); err != nil {
+			answer = "Ошибка: " + err.Error()
+		} else {
+			answer = "Беседа переключена"
+		}
+	case strings.HasPrefix(action, "delete:"):
+		if err := deleteConversation(chatID, strings.TrimPrefix(action, "delete:")); err != nil {
+			answer = "Ошибка: " + err.Error()
+		} else {
+			answer = "Беседа удалена"
+		}
+	}
+	callback := tgbotapi.NewCallback(query.ID, answer)
+	if _, err := bot.Request(callback); err != nil {
+		log.Printf("Failed to answer callback: %v", err)
+	}
+	text, keyboard := conversationsKeyboard(chatID)
+	msg := tgbotapi.NewEditMessageTextAndMarkup(chatID, query.Message.MessageID, text, keyboard)
+	if _, err := bot.Send(msg); err != nil {
+		log.Printf("Failed to edit message: %v", err)
+	}
+}
@@ -0,0 +1,42 @@
+package main
+
+import (
+	"strings"
+
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api/v5"
+)
+
+// handleEditedMessage replaces the edited user message in the conversation, drops everything
+// after it and regenerates the answer into the bot's original reply messages
+func handleEditedMessage(bot *tgbotapi.BotAPI, message *tgbotapi.Message) {
+	if !contains(config.AllowedUsers, message.From.UserName) {
+		return
+	}
+	chatID := message.Chat.ID
+	messageText := strings.TrimSpace(message.Text)
+	if messageText == "" {
+		return
+	}
+
+	mu.Lock()
+	user := userSettingsMap[chatID]
+	busy := generating[chatID] || switching[chatID]
+	turnPos := findTurnLocked(chatID, message.MessageID, false)
+	editMessageIDs := []int{}
+	if turnPos >= 0 {
+		editMessageIDs = activeConversationLocked(chatID).Turns[turnPos].ReplyMessageIDs
+	}
+	mu.Unlock()
+
+	// Messages from other conversations or from before the messages were tracked are ignored
+	if turnPos < 0 || !isChatModel(user.Model) {
+		return
+	}
+	if busy {
+		msg := tgbotapi.NewMessage(chatID, "Дождитесь окончания текущего ответа, затем отредактируйте сообщение ещё раз.")
+		msg.ReplyToMessageID = message.MessageID
+		bot.Send(msg)
+		return
+	}
+	rerunTurn(bot, chatID, turnPos, messageText, editMessageIDs)
+}
@@ -4,18 +4,13 @@ import (
 	"context"
 	"encoding/json"
 	"errors"
-	"io/ioutil"
-	"net/http"
 	"strings"
-
-	googlesearch "chat_bot/googlesearch"
-
-	"github.com/jaytaylor/html2text"
 )
 
 type FunctionArgs struct {
-	Properties map[string]map[string]string `json:"properties"`
-	Required   []string                     `json:"required"`
+	// Properties are the JSON schemas of the arguments by name
+	Properties map[string]interface{} `json:"properties"`
+	Required   []string               `json:"required"`
 }
 
 type Function struct {
@@ -31,13 +26,21 @@ var functions = []Function{
 	{
 		Id:          1,
 		Name:        "http_get",
-		Description: "Load data from the Internet, HTML is converted to text",
+		Description: "Load data from the Internet. Only the main text, title, author and links of HTML pages are returned, JSON is indented and the text of PDFs is extracted. Long documents are split into pages. Addresses of private networks are not available",
 		Args: FunctionArgs{
-			Properties: map[string]map[string]string{
-				"url": {
+			Properties: map[string]interface{}{
+				"url": map[string]string{
 					"type":        "string",
 					"description": "URL to load data from",
 				},
+				"selector": map[string]string{
+					"type":        "string",
+					"description": "CSS selector of the elements of an HTML page to return instead of the main text, e.g. table.prices",
+				},
+				"page": map[string]string{
+					"type":        "integer",
+					"description": "Page of a long document, starting from 1",
+				},
 			},
 			Required: []string{"url"},
 		},
@@ -45,15 +48,36 @@ var functions = []Function{
 		Active:  1,
 	},
 	{
-		Id:          2,
+		Id: 2,
+		// The name is kept for the tool choices saved by the users, the search goes to the
+		// providers of the config
 		Name:        "google_search",
-		Description: "Search Google",
+		Description: "Search the web, returns the titles, URLs and snippets of the results",
 		Args: FunctionArgs{
-			Properties: map[string]map[string]string{
-				"query": {
+			Properties: map[string]interface{}{
+				"query": map[string]string{
 					"type":        "string",
 					"description": "Query to search",
 				},
+				"country": map[string]string{
+					"type":        "string",
+					"description": "ISO 3166-1 alpha-2 code of the country of the results, e.g. de, the region of the user by default",
+				},
+				"language": map[string]string{
+					"type":        "string",
+					"description": "ISO 639-1 code of the language of the results, e.g. en, the language of the user by default",
+				},
+				"limit": map[string]interface{}{
+					"type":        "integer",
+					"description": "Number of results, 10 by default",
+					"minimum":     1,
+					"maximum":     searchMaxLimit,
+				},
+				"page": map[string]interface{}{
+					"type":        "integer",
+					"description": "Page of the results, starting from 1",
+					"minimum":     1,
+				},
 			},
 			Required: []string{"query"},
 		},
@@ -62,65 +86,151 @@ var functions = []Function{
 	},
 }
 
-func JsonEscape(str string) string {
-	return strings.ReplaceAll(strings.ReplaceAll(str, `\`, `\\`), `"`, `\"`)
+// functionArgsFromSchema returns the arguments of a function described by a JSON object schema
+func functionArgsFromSchema(schema map[string]interface{}) (FunctionArgs, error) {
+	args := FunctionArgs{Properties: map[string]interface{}{}}
+	if schemaType, ok := schema["type"]; ok && schemaType != "object" {
+		return args, errors.New("parameters must be an object schema")
+	}
+	if properties, ok := schema["properties"].(map[string]interface{}); ok {
+		args.Properties = properties
+	}
+	if required, ok := schema["required"].([]interface{}); ok {
+		for _, name := range required {
+			if name, ok := name.(string); ok {
+				args.Required = append(args.Required, name)
+			}
+		}
+	}
+	return args, nil
+}
+
+const (
+	// A function result may take this share of the context of the model, longer results are split
+	// into pages
+	functionResultContextShare = 0.25
+	functionResultMinTokens    = 1000
+	functionResultMaxTokens    = 32000
+)
+
+// FunctionContext is the conversation a function is called in
+type FunctionContext struct {
+	ChatID int64
+	// Model gets the result, the size of its context limits the size of the result
+	Model ModelSpec
 }
 
-func ParseArguments(args string) (map[string]string, error) {
-	arguments := make(map[string]string)
-	argumentsS := args
-	if len(argumentsS) > 0 && argumentsS[len(argumentsS)-1] != '}' {
-		argumentsS += "}"
+// resultTokens is the number of tokens a result of a function may take
+func (call FunctionContext) resultTokens() int {
+	tokens := int(float64(call.Model.ContextWindow) * functionResultContextShare)
+	if tokens < functionResultMinTokens {
+		return functionResultMinTokens
 	}
-	err := json.Unmarshal([]byte(argumentsS), &arguments)
-	if err != nil {
-		return nil, errors.New("Ошибка парсинга аргументов: " + err.Error())
+	if tokens > functionResultMaxTokens {
+		return functionResultMaxTokens
 	}
-	return arguments, nil
+	return tokens
 }
 
-func CallFunction(name string, args string) (string, error) {
+func CallFunction(call FunctionContext, name string, args string) (string, error) {
 	switch name {
 	case "http_get":
-		arguments, err := ParseArguments(args)
-		if err != nil {
-			return "", err
+		arguments := struct {
+			URL      string `json:"url"`
+			Selector string `json:"selector"`
+			Page     int    `json:"page"`
+		}{}
+		if err := json.Unmarshal([]byte(args), &arguments); err != nil {
+			return "", errors.New("Ошибка парсинга аргументов: " + err.Error())
 		}
-		return HttpGet(arguments["url"])
+		return HttpGet(call, arguments.URL, arguments.Selector, arguments.Page)
 	case "google_search":
-		arguments, err := ParseArguments(args)
-		if err != nil {
-			return "", err
+		arguments := struct {
+			Query    string `json:"query"`
+			Country  string `json:"country"`
+			Language string `json:"language"`
+			Limit    int    `json:"limit"`
+			Page     int    `json:"page"`
+		}{}
+		if err := json.Unmarshal([]byte(args), &arguments); err != nil {
+			return "", errors.New("Ошибка парсинга аргументов: " + err.Error())
 		}
-		return GoogleSearch(arguments["query"])
+		options := SearchOptions{
+			Country:  arguments.Country,
+			Language: arguments.Language,
+			Limit:    arguments.Limit,
+			Page:     arguments.Page,
+		}
+		return WebSearch(call, arguments.Query, options)
+	case "run_python":
+		return callRunPython(call.ChatID, args)
 	default:
+		if tool, ok := webhookTools[name]; ok {
+			return callWebhookTool(call, tool, args)
+		}
+		if tool, ok := mcpTools[name]; ok {
+			return callMCPTool(tool, args)
+		}
 		return "", errors.New("Неизвестная функция " + name)
 	}
 }
 
-func HttpGet(url string) (string, error) {
-	resp, err := http.Get(url)
+// searchOutput is what the model gets back from google_search
+type searchOutput struct {
+	Provider string         `json:"provider,omitempty"`
+	Results  []SearchResult `json:"results"`
+}
+
+// WebSearch searches with the configured providers, the next one is tried when one fails. The
+// country and language the model didn't choose are those of the user.
+func WebSearch(call FunctionContext, query string, options SearchOptions) (string, error) {
+	if strings.TrimSpace(query) == "" {
+		return "", errors.New("пустой запрос")
+	}
+	options.Country = strings.ToLower(strings.TrimSpace(options.Country))
+	options.Language = strings.ToLower(strings.TrimSpace(options.Language))
+	for _, code := range []string{options.Country, options.Language} {
+		if code != "" && !searchCodeRegexp.MatchString(code) {
+			return "", errors.New("некорректный код страны или языка " + code + ", нужен двухбуквенный код")
+		}
+	}
+	mu.Lock()
+	userOptions := searchOptionsForUser(userSettingsMap[call.ChatID])
+	mu.Unlock()
+	if options.Country == "" {
+		options.Country = userOptions.Country
+	}
+	if options.Language == "" {
+		options.Language = userOptions.Language
+	}
+	if options.Limit <= 0 {
+		options.Limit = searchDefaultLimit
+	}
+	if options.Limit > searchMaxLimit {
+		options.Limit = searchMaxLimit
+	}
+	if options.Page <= 0 {
+		options.Page = 1
+	}
+	key := searchCacheKey(query, options)
+	cached := searchOutput{}
+	if searchCache.get(key, &cached) {
+		output, err := json.Marshal(cached)
+		return string(output), err
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 2*searchDefaultTimeout)
+	defer cancel()
+	provider, results, err := searchWithFallback(ctx, searchProviders, query, options)
 	if err != nil {
 		return "", err
 	}
-
-	defer resp.Body.Close()
-
-	body, err := ioutil.ReadAll(resp.Body)
+	result := searchOutput{Provider: provider, Results: results}
+	if len(results) > 0 {
+		searchCache.set(key, result, searchCacheTTL())
+	}
+	output, err := json.Marshal(result)
 	if err != nil {
 		return "", err
 	}
-	text, _ := html2text.FromString(string(body), html2text.Options{OmitLinks: true, TextOnly: true})
-	return `{
-		"output": "` + JsonEscape(strings.TrimSuffix(string(text), "\n")) + `"
-	}`, nil
-}
-
-func GoogleSearch(query string) (string, error) {
-	ctx := context.Background()
-	result, _ := googlesearch.Search(ctx, query)
-	resultS, _ := json.Marshal(result)
-	return `{
-		"result": "` + JsonEscape(string(resultS)) + `"
-	}`, nil
+	return string(output), nil
 }
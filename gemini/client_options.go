@@ -0,0 +1,47 @@
+package gemini
+
+import (
+	"net/http"
+	"time"
+)
+
+// ClientOption are options that can be passed when creating a new client
+type ClientOption func(*client) error
+
+// WithBaseURL is a client option that allows you to override the default base url of the client.
+// The default base url is "https://generativelanguage.googleapis.com/v1beta"
+func WithBaseURL(baseURL string) ClientOption {
+	return func(c *client) error {
+		c.baseURL = baseURL
+		return nil
+	}
+}
+
+// WithHeaders is a client option that adds extra headers to every request, e.g. x-goog-user-project.
+// The headers override the default ones.
+func WithHeaders(headers map[string]string) ClientOption {
+	return func(c *client) error {
+		c.headers = make(map[string]string, len(headers))
+		for key, value := range headers {
+			c.headers[key] = value
+		}
+		return nil
+	}
+}
+
+// WithHTTPClient allows you to override the internal http.Client used
+func WithHTTPClient(httpClient *http.Client) ClientOption {
+	return func(c *client) error {
+		c.httpClient = httpClient
+		return nil
+	}
+}
+
+// WithTimeout is a client option that allows you to override the default timeout duration of requests
+// for the client. If you are overriding the http client as well, just include the timeout there.
+func WithTimeout(timeout time.Duration) ClientOption {
+	return func(c *client) error {
+		c.httpClient.Timeout = timeout
+		return nil
+	}
+}
@@ -0,0 +1,161 @@
+// Package gemini is a client of the Google Gemini API (generativelanguage.googleapis.com)
+package gemini
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"time"
+)
+
+const (
+	defaultBaseURL = "https://generativelanguage.googleapis.com/v1beta"
+	// Streamed answers of thinking models can take a long time
+	defaultTimeout = 10000 * time.Minute
+)
+
+var dataPrefix = []byte("data: ")
+
+// A Client is an API client to communicate with the Gemini API
+type Client interface {
+	// GenerateContent generates the answer of the model to the conversation
+	GenerateContent(ctx context.Context, model string, request GenerateContentRequest) (*GenerateContentResponse, error)
+
+	// StreamGenerateContent generates the answer and streams it through multiple calls to onData,
+	// every chunk has the parts generated since the previous one
+	StreamGenerateContent(ctx context.Context, model string, request GenerateContentRequest, onData func(*GenerateContentResponse)) error
+}
+
+type client struct {
+	baseURL    string
+	apiKey     string
+	headers    map[string]string
+	httpClient *http.Client
+}
+
+// NewClient returns a new Gemini API client. An apiKey is required by the Google endpoint
+func NewClient(apiKey string, options ...ClientOption) Client {
+	c := &client{
+		baseURL: defaultBaseURL,
+		apiKey:  apiKey,
+		httpClient: &http.Client{
+			Timeout: defaultTimeout,
+		},
+	}
+	for _, o := range options {
+		o(c)
+	}
+	return c
+}
+
+func (c *client) GenerateContent(ctx context.Context, model string, request GenerateContentRequest) (*GenerateContentResponse, error) {
+	req, err := c.newRequest(ctx, model, "generateContent", request)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := c.performRequest(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	output := new(GenerateContentResponse)
+	if err := json.NewDecoder(resp.Body).Decode(output); err != nil {
+		return nil, fmt.Errorf("invalid json response: %w", err)
+	}
+	return output, nil
+}
+
+func (c *client) StreamGenerateContent(ctx context.Context, model string, request GenerateContentRequest, onData func(*GenerateContentResponse)) error {
+	req, err := c.newRequest(ctx, model, "streamGenerateContent", request)
+	if err != nil {
+		return err
+	}
+	query := req.URL.Query()
+	query.Set("alt", "sse")
+	req.URL.RawQuery = query.Encode()
+	resp, err := c.performRequest(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	// The stream is completed when the server closes the connection
+	reader := bufio.NewReader(resp.Body)
+	for {
+		line, err := reader.ReadBytes('\n')
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		line = bytes.TrimSpace(line)
+		if !bytes.HasPrefix(line, dataPrefix) {
+			continue
+		}
+		output := new(GenerateContentResponse)
+		if err := json.Unmarshal(bytes.TrimPrefix(line, dataPrefix), output); err != nil {
+			return fmt.Errorf("invalid json stream data: %w", err)
+		}
+		onData(output)
+	}
+}
+
+func (c *client) newRequest(ctx context.Context, model string, method string, request GenerateContentRequest) (*http.Request, error) {
+	body, err := json.Marshal(request)
+	if err != nil {
+		return nil, fmt.Errorf("failed encoding json: %w", err)
+	}
+	endpoint := c.baseURL + "/models/" + url.PathEscape(model) + ":" + method
+	req, err := http.NewRequestWithContext(ctx, "POST", endpoint, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if len(c.apiKey) > 0 {
+		req.Header.Set("x-goog-api-key", c.apiKey)
+	}
+	for key, value := range c.headers {
+		req.Header.Set(key, value)
+	}
+	return req, nil
+}
+
+func (c *client) performRequest(req *http.Request) (*http.Response, error) {
+	resp, err := c.httpClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if err := checkForSuccess(resp); err != nil {
+		return nil, err
+	}
+	return resp, nil
+}
+
+// returns an error if this response includes an error.
+func checkForSuccess(resp *http.Response) error {
+	if resp.StatusCode >= 200 && resp.StatusCode < 300 {
+		return nil
+	}
+	defer resp.Body.Close()
+	data, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return fmt.Errorf("failed to read from body: %w", err)
+	}
+	var result APIErrorResponse
+	if err := json.Unmarshal(data, &result); err != nil || result.Error.Message == "" {
+		return APIError{
+			Code:    resp.StatusCode,
+			Status:  "Unexpected",
+			Message: string(data),
+		}
+	}
+	result.Error.Code = resp.StatusCode
+	return result.Error
+}
@@ -0,0 +1,162 @@
+package gemini
+
+import (
+	"encoding/json"
+	"fmt"
+)
+
+// Roles of the contents, the system prompt is passed separately as SystemInstruction
+const (
+	RoleUser  = "user"
+	RoleModel = "model"
+)
+
+// APIError represents an error that occured on an API
+type APIError struct {
+	Code    int    `json:"code"`
+	Status  string `json:"status"`
+	Message string `json:"message"`
+}
+
+func (e APIError) Error() string {
+	return fmt.Sprintf("[%d:%s] %s", e.Code, e.Status, e.Message)
+}
+
+// APIErrorResponse is the full error response that has been returned by the API
+type APIErrorResponse struct {
+	Error APIError `json:"error"`
+}
+
+// Blob is inline media data, Data is base64 encoded
+type Blob struct {
+	MimeType string `json:"mimeType"`
+	Data     string `json:"data"`
+}
+
+// FileData refers to a file uploaded with the File API or to a Cloud Storage URI
+type FileData struct {
+	MimeType string `json:"mimeType,omitempty"`
+	FileURI  string `json:"fileUri"`
+}
+
+type FunctionCall struct {
+	Name string          `json:"name"`
+	Args json.RawMessage `json:"args,omitempty"`
+}
+
+type FunctionResponse struct {
+	Name string `json:"name"`
+	// Response must be a JSON object
+	Response map[string]interface{} `json:"response"`
+}
+
+// Part is one part of a content, only one of the fields is set
+type Part struct {
+	Text             string            `json:"text,omitempty"`
+	InlineData       *Blob             `json:"inlineData,omitempty"`
+	FileData         *FileData         `json:"fileData,omitempty"`
+	FunctionCall     *FunctionCall     `json:"functionCall,omitempty"`
+	FunctionResponse *FunctionResponse `json:"functionResponse,omitempty"`
+	// Thought is set on the parts with the summary of the model thinking
+	Thought bool `json:"thought,omitempty"`
+}
+
+type Content struct {
+	Role  string `json:"role,omitempty"`
+	Parts []Part `json:"parts"`
+}
+
+// Schema is the OpenAPI schema of the function parameters, types are upper case: OBJECT, STRING...
+type Schema struct {
+	Type        string             `json:"type"`
+	Description string             `json:"description,omitempty"`
+	Properties  map[string]*Schema `json:"properties,omitempty"`
+	Required    []string           `json:"required,omitempty"`
+	Enum        []string           `json:"enum,omitempty"`
+	Items       *Schema            `json:"items,omitempty"`
+}
+
+type FunctionDeclaration struct {
+	Name        string  `json:"name"`
+	Description string  `json:"description,omitempty"`
+	Parameters  *Schema `json:"parameters,omitempty"`
+}
+
+type Tool struct {
+	FunctionDeclarations []FunctionDeclaration `json:"functionDeclarations,omitempty"`
+}
+
+type ThinkingConfig struct {
+	ThinkingBudget *int `json:"thinkingBudget,omitempty"`
+}
+
+type GenerationConfig struct {
+	Temperature     *float32        `json:"temperature,omitempty"`
+	MaxOutputTokens int             `json:"maxOutputTokens,omitempty"`
+	ThinkingConfig  *ThinkingConfig `json:"thinkingConfig,omitempty"`
+	// ResponseMimeType is "application/json" for JSON output
+	ResponseMimeType string `json:"responseMimeType,omitempty"`
+	// ResponseJSONSchema is the JSON schema the JSON output follows
+	ResponseJSONSchema json.RawMessage `json:"responseJsonSchema,omitempty"`
+}
+
+// GenerateContentRequest is a request for the generateContent and streamGenerateContent methods
+type GenerateContentRequest struct {
+	Contents          []Content         `json:"contents"`
+	SystemInstruction *Content          `json:"systemInstruction,omitempty"`
+	Tools             []Tool            `json:"tools,omitempty"`
+	GenerationConfig  *GenerationConfig `json:"generationConfig,omitempty"`
+}
+
+type Candidate struct {
+	Content      Content `json:"content"`
+	FinishReason string  `json:"finishReason"`
+	Index        int     `json:"index"`
+}
+
+type UsageMetadata struct {
+	PromptTokenCount     int `json:"promptTokenCount"`
+	CandidatesTokenCount int `json:"candidatesTokenCount"`
+	ThoughtsTokenCount   int `json:"thoughtsTokenCount"`
+	TotalTokenCount      int `json:"totalTokenCount"`
+}
+
+type PromptFeedback struct {
+	BlockReason string `json:"blockReason"`
+}
+
+// GenerateContentResponse is the response of generateContent and every chunk of streamGenerateContent
+type GenerateContentResponse struct {
+	Candidates     []Candidate     `json:"candidates"`
+	UsageMetadata  *UsageMetadata  `json:"usageMetadata,omitempty"`
+	PromptFeedback *PromptFeedback `json:"promptFeedback,omitempty"`
+	ModelVersion   string          `json:"modelVersion"`
+}
+
+// Text returns the text parts of the first candidate joined together, thoughts are skipped
+func (r *GenerateContentResponse) Text() string {
+	text := ""
+	if len(r.Candidates) == 0 {
+		return text
+	}
+	for _, part := range r.Candidates[0].Content.Parts {
+		if !part.Thought {
+			text += part.Text
+		}
+	}
+	return text
+}
+
+// FunctionCalls returns the function calls of the first candidate
+func (r *GenerateContentResponse) FunctionCalls() []FunctionCall {
+	calls := []FunctionCall{}
+	if len(r.Candidates) == 0 {
+		return calls
+	}
+	for _, part := range r.Candidates[0].Content.Parts {
+		if part.FunctionCall != nil {
+			calls = append(calls, *part.FunctionCall)
+		}
+	}
+	return calls
+}
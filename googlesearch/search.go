@@ -267,6 +267,9 @@ type SearchOptions struct {
 
 	// FollowNextPage, when set, scrapes subsequent result pages.
 	FollowNextPage bool
+
+	// BaseURL replaces the localized Google homepage, e.g. with a test server.
+	BaseURL string
 }
 
 // Search returns a list of search results from Google.
@@ -373,6 +376,9 @@ func Search(ctx context.Context, searchTerm string, opts ...SearchOptions) ([]Re
 	})
 
 	url := buildUrl(searchTerm, opts[0].CountryCode, lc, limit, opts[0].Start)
+	if opts[0].BaseURL != "" {
+		url = strings.TrimSuffix(opts[0].BaseURL, "/") + "/search?" + strings.SplitN(url, "?", 2)[1]
+	}
 
 	if opts[0].ProxyAddr != "" {
 		rp, err := proxy.RoundRobinProxySwitcher(opts[0].ProxyAddr)
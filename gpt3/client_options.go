@@ -41,6 +41,18 @@ func WithBaseURL(baseURL string) ClientOption {
 	}
 }
 
+// WithHeaders is a client option that adds extra headers to every request, e.g. for proxies or
+// self-hosted OpenAI-compatible servers. The headers override the default ones.
+func WithHeaders(headers map[string]string) ClientOption {
+	return func(c *client) error {
+		c.headers = make(map[string]string, len(headers))
+		for key, value := range headers {
+			c.headers[key] = value
+		}
+		return nil
+	}
+}
+
 // WithHTTPClient allows you to override the internal http.Client used
 func WithHTTPClient(httpClient *http.Client) ClientOption {
 	return func(c *client) error {
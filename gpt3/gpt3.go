@@ -58,9 +58,10 @@ const (
 )
 
 const (
-	defaultBaseURL        = "https://api.openai.com/v1"
-	defaultUserAgent      = "go-gpt3"
-	defaultTimeoutSeconds = 30
+	defaultBaseURL   = "https://api.openai.com/v1"
+	defaultUserAgent = "go-gpt3"
+	// Streamed answers of reasoning models can take a long time
+	defaultTimeout = 10000 * time.Minute
 )
 
 func getEngineURL(engine string) string {
@@ -114,6 +115,14 @@ type Client interface {
 	// Moderation performs a moderation check on the given text against an OpenAI classifier to determine whether the
 	// provided content complies with OpenAI's usage policies.
 	Moderation(ctx context.Context, request ModerationRequest) (*ModerationResponse, error)
+
+	// Responses creates a model response with the Responses API, which keeps the conversation
+	// state on the server and returns reasoning summaries
+	Responses(ctx context.Context, request ResponsesRequest) (*Response, error)
+
+	// ResponsesStream creates a model response and streams the typed events through multiple
+	// calls to onEvent
+	ResponsesStream(ctx context.Context, request ResponsesRequest, onEvent func(*ResponseStreamEvent)) error
 }
 
 type client struct {
@@ -123,12 +132,13 @@ type client struct {
 	httpClient    *http.Client
 	defaultEngine string
 	idOrg         string
+	headers       map[string]string
 }
 
 // NewClient returns a new OpenAI GPT-3 API client. An apiKey is required to use the client
 func NewClient(apiKey string, options ...ClientOption) Client {
 	httpClient := &http.Client{
-		Timeout: time.Duration(defaultTimeoutSeconds * time.Second),
+		Timeout: defaultTimeout,
 	}
 
 	c := &client{
@@ -407,10 +417,7 @@ func (c *client) Moderation(ctx context.Context, request ModerationRequest) (*Mo
 }
 
 func (c *client) performRequest(req *http.Request) (*http.Response, error) {
-	client := http.Client{
-		Timeout: 10000 * time.Minute,
-	}
-	resp, err := client.Do(req)
+	resp, err := c.httpClient.Do(req)
 	if err != nil {
 		return nil, err
 	}
@@ -477,6 +484,11 @@ func (c *client) newRequest(ctx context.Context, method, path string, payload in
 		req.Header.Set("OpenAI-Organization", c.idOrg)
 	}
 	req.Header.Set("Content-type", "application/json")
-	req.Header.Set("Authorization", fmt.Sprintf("Bearer %s", c.apiKey))
+	if len(c.apiKey) > 0 {
+		req.Header.Set("Authorization", fmt.Sprintf("Bearer %s", c.apiKey))
+	}
+	for key, value := range c.headers {
+		req.Header.Set(key, value)
+	}
 	return req, nil
 }
@@ -1,6 +1,9 @@
 package gpt3
 
-import "fmt"
+import (
+	"encoding/json"
+	"fmt"
+)
 
 // APIError represents an error that occured on an API
 type APIError struct {
@@ -57,19 +60,40 @@ type ChatCompletionRequestMessage struct {
 	// Content is the content of the message
 	Content      interface{} `json:"content"`
 	FunctionCall interface{} `json:"function_call,omitempty"`
+
+	// ToolCalls are the tools called by the assistant in this message
+	ToolCalls []ChatCompletionToolCall `json:"tool_calls,omitempty"`
+	// ToolCallID is the call that a message with the "tool" role is the result of
+	ToolCallID string `json:"tool_call_id,omitempty"`
 }
 
 type ChatCompletionRequestFunctionParameters struct {
-	Type       string                       `json:"type"`
-	Properties map[string]map[string]string `json:"properties"`
-	Required   []string                     `json:"required"`
+	Type string `json:"type"`
+	// Properties are the JSON schemas of the parameters by name
+	Properties map[string]interface{} `json:"properties"`
+	Required   []string               `json:"required"`
 }
 
 type ChatCompletionRequestFunction struct {
 	Name         string                                  `json:"name"`
 	Description  string                                  `json:"description"`
 	Parameters   ChatCompletionRequestFunctionParameters `json:"parameters"`
-	FunctionCall string                                  `json:"function_call"`
+	FunctionCall string                                  `json:"function_call,omitempty"`
+}
+
+// ChatCompletionRequestTool is a tool the model may call, only functions are supported
+type ChatCompletionRequestTool struct {
+	Type     string                        `json:"type"`
+	Function ChatCompletionRequestFunction `json:"function"`
+}
+
+// ChatCompletionToolCall is a call of a tool by the model. In streamed deltas Index tells which call
+// the fragment belongs to and the arguments come in pieces.
+type ChatCompletionToolCall struct {
+	Index    *int                               `json:"index,omitempty"`
+	ID       string                             `json:"id,omitempty"`
+	Type     string                             `json:"type,omitempty"`
+	Function ChatCompletionResponseFunctionCall `json:"function"`
 }
 
 // ChatCompletionRequest is a request for the chat completion API
@@ -80,8 +104,17 @@ type ChatCompletionRequest struct {
 	// Messages is a list of messages to use as the context for the chat completion.
 	Messages []ChatCompletionRequestMessage `json:"messages"`
 
+	// Deprecated: use Tools
 	Functions []ChatCompletionRequestFunction `json:"functions,omitempty"`
 
+	Tools []ChatCompletionRequestTool `json:"tools,omitempty"`
+
+	// ToolChoice is "none", "auto", "required" or an object that forces a specific function
+	ToolChoice interface{} `json:"tool_choice,omitempty"`
+
+	// ParallelToolCalls allows the model to call several tools in one message, on by default
+	ParallelToolCalls *bool `json:"parallel_tool_calls,omitempty"`
+
 	// What sampling temperature to use, between 0 and 2. Higher values like 0.8 will make the output more random, while lower values like 0.2 will make it more focused and deterministic
 	Temperature *float32 `json:"temperature,omitempty"`
 
@@ -96,6 +129,9 @@ type ChatCompletionRequest struct {
 	// Whether or not to stream responses back as they are generated
 	Stream bool `json:"stream,omitempty"`
 
+	// Options of the stream, only allowed when streaming
+	StreamOptions *ChatCompletionStreamOptions `json:"stream_options,omitempty"`
+
 	// Up to 4 sequences where the API will stop generating further tokens.
 	Stop []string `json:"stop,omitempty"`
 
@@ -104,6 +140,9 @@ type ChatCompletionRequest struct {
 
 	ReasoningEffort string `json:"reasoning_effort,omitempty"`
 
+	// ResponseFormat makes the model answer with a JSON object, optionally following a JSON schema
+	ResponseFormat *ChatCompletionResponseFormat `json:"response_format,omitempty"`
+
 	// (-2, 2) Penalize tokens that haven't appeared yet in the history.
 	PresencePenalty float32 `json:"presence_penalty,omitempty"`
 
@@ -117,6 +156,33 @@ type ChatCompletionRequest struct {
 	User string `json:"user,omitempty"`
 }
 
+type ChatCompletionStreamOptions struct {
+	// IncludeUsage adds a last chunk with the usage of the whole request and no choices
+	IncludeUsage bool `json:"include_usage"`
+}
+
+// Types of the response format
+const (
+	ResponseFormatText       = "text"
+	ResponseFormatJSONObject = "json_object"
+	ResponseFormatJSONSchema = "json_schema"
+)
+
+type ChatCompletionResponseFormat struct {
+	// Type is "text", "json_object" or "json_schema". The messages must mention JSON for json_object.
+	Type       string                    `json:"type"`
+	JSONSchema *ChatCompletionJSONSchema `json:"json_schema,omitempty"`
+}
+
+type ChatCompletionJSONSchema struct {
+	// Name may contain a-z, A-Z, 0-9, underscores and dashes, up to 64 characters
+	Name        string          `json:"name"`
+	Description string          `json:"description,omitempty"`
+	Schema      json.RawMessage `json:"schema,omitempty"`
+	// Strict makes the model follow the schema exactly, it supports only a subset of JSON schema
+	Strict *bool `json:"strict,omitempty"`
+}
+
 // CompletionRequest is a request for the completions API
 type CompletionRequest struct {
 	// A list of string prompts to use.
@@ -197,6 +263,7 @@ type ChatCompletionResponseMessage struct {
 	Role         string                             `json:"role"`
 	Content      string                             `json:"content"`
 	FunctionCall ChatCompletionResponseFunctionCall `json:"function_call"`
+	ToolCalls    []ChatCompletionToolCall           `json:"tool_calls"`
 }
 
 // ChatCompletionResponseChoice is one of the choices returned in the response to the Chat Completions API
@@ -375,3 +442,70 @@ type ModerationResponse struct {
 	Model   string             `json:"model"`
 	Results []ModerationResult `json:"results"`
 }
+
+// UnmarshalJSON restores typed content entries and function calls so that a message decoded
+// from JSON (e.g. a persisted conversation history) can be sent back to the API unchanged.
+func (m *ChatCompletionRequestMessage) UnmarshalJSON(data []byte) error {
+	var raw struct {
+		Role         string                   `json:"role"`
+		Name         string                   `json:"name"`
+		Content      json.RawMessage          `json:"content"`
+		FunctionCall json.RawMessage          `json:"function_call"`
+		ToolCalls    []ChatCompletionToolCall `json:"tool_calls"`
+		ToolCallID   string                   `json:"tool_call_id"`
+	}
+	if err := json.Unmarshal(data, &raw); err != nil {
+		return err
+	}
+	m.Role = raw.Role
+	m.Name = raw.Name
+	m.Content = ""
+	m.FunctionCall = nil
+	m.ToolCalls = raw.ToolCalls
+	m.ToolCallID = raw.ToolCallID
+
+	if len(raw.Content) > 0 && string(raw.Content) != "null" {
+		var text string
+		if err := json.Unmarshal(raw.Content, &text); err == nil {
+			m.Content = text
+		} else {
+			var entries []json.RawMessage
+			if err := json.Unmarshal(raw.Content, &entries); err != nil {
+				return fmt.Errorf("invalid message content: %w", err)
+			}
+			content := []interface{}{}
+			for _, entry := range entries {
+				var entryType struct {
+					Type string `json:"type"`
+				}
+				if err := json.Unmarshal(entry, &entryType); err != nil {
+					return fmt.Errorf("invalid message content entry: %w", err)
+				}
+				switch entryType.Type {
+				case "image_url":
+					image := ChatCompletionRequestContentEntryImage{}
+					if err := json.Unmarshal(entry, &image); err != nil {
+						return fmt.Errorf("invalid image content entry: %w", err)
+					}
+					content = append(content, image)
+				default:
+					text := ChatCompletionRequestContentEntryText{}
+					if err := json.Unmarshal(entry, &text); err != nil {
+						return fmt.Errorf("invalid text content entry: %w", err)
+					}
+					content = append(content, text)
+				}
+			}
+			m.Content = content
+		}
+	}
+
+	if len(raw.FunctionCall) > 0 && string(raw.FunctionCall) != "null" {
+		functionCall := ChatCompletionResponseFunctionCall{}
+		if err := json.Unmarshal(raw.FunctionCall, &functionCall); err != nil {
+			return fmt.Errorf("invalid function call: %w", err)
+		}
+		m.FunctionCall = functionCall
+	}
+	return nil
+}
@@ -0,0 +1,278 @@
+package gpt3
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+)
+
+// Item types of the Responses API
+const (
+	ResponseItemMessage            = "message"
+	ResponseItemReasoning          = "reasoning"
+	ResponseItemFunctionCall       = "function_call"
+	ResponseItemFunctionCallOutput = "function_call_output"
+	ResponseItemWebSearchCall      = "web_search_call"
+)
+
+// Streaming event types of the Responses API
+const (
+	ResponseEventCreated                   = "response.created"
+	ResponseEventInProgress                = "response.in_progress"
+	ResponseEventCompleted                 = "response.completed"
+	ResponseEventFailed                    = "response.failed"
+	ResponseEventIncomplete                = "response.incomplete"
+	ResponseEventOutputItemAdded           = "response.output_item.added"
+	ResponseEventOutputItemDone            = "response.output_item.done"
+	ResponseEventOutputTextDelta           = "response.output_text.delta"
+	ResponseEventOutputTextDone            = "response.output_text.done"
+	ResponseEventReasoningSummaryTextDelta = "response.reasoning_summary_text.delta"
+	ResponseEventReasoningSummaryTextDone  = "response.reasoning_summary_text.done"
+	ResponseEventFunctionCallArgsDelta     = "response.function_call_arguments.delta"
+	ResponseEventFunctionCallArgsDone      = "response.function_call_arguments.done"
+	ResponseEventWebSearchCallInProgress   = "response.web_search_call.in_progress"
+	ResponseEventWebSearchCallSearching    = "response.web_search_call.searching"
+	ResponseEventWebSearchCallCompleted    = "response.web_search_call.completed"
+	ResponseEventError                     = "error"
+)
+
+// ResponseInputContent is a part of an input message: input_text or input_image
+type ResponseInputContent struct {
+	Type     string `json:"type"`
+	Text     string `json:"text,omitempty"`
+	ImageURL string `json:"image_url,omitempty"`
+	Detail   string `json:"detail,omitempty"`
+}
+
+// ResponseInputItem is an item of the request input: a message (Role and Content), a function call
+// made by the model or the output of a function call
+type ResponseInputItem struct {
+	Type string `json:"type,omitempty"`
+	Role string `json:"role,omitempty"`
+	// Content is a string or []ResponseInputContent
+	Content interface{} `json:"content,omitempty"`
+
+	// function_call and function_call_output
+	CallID    string `json:"call_id,omitempty"`
+	Name      string `json:"name,omitempty"`
+	Arguments string `json:"arguments,omitempty"`
+	Output    string `json:"output,omitempty"`
+}
+
+// ResponseTool is a function (Name, Description, Parameters) or a built-in tool like web_search
+type ResponseTool struct {
+	Type        string      `json:"type"`
+	Name        string      `json:"name,omitempty"`
+	Description string      `json:"description,omitempty"`
+	Parameters  interface{} `json:"parameters,omitempty"`
+}
+
+type ResponseReasoning struct {
+	// Effort is "minimal", "low", "medium" or "high"
+	Effort string `json:"effort,omitempty"`
+	// Summary is "auto", "concise" or "detailed", empty for no summary
+	Summary string `json:"summary,omitempty"`
+}
+
+// ResponseTextFormat is the format of the text output, the Responses API counterpart of
+// ChatCompletionResponseFormat with the fields of the JSON schema inlined
+type ResponseTextFormat struct {
+	// Type is "text", "json_object" or "json_schema"
+	Type        string          `json:"type"`
+	Name        string          `json:"name,omitempty"`
+	Description string          `json:"description,omitempty"`
+	Schema      json.RawMessage `json:"schema,omitempty"`
+	Strict      *bool           `json:"strict,omitempty"`
+}
+
+type ResponseText struct {
+	Format ResponseTextFormat `json:"format"`
+}
+
+// ResponsesRequest is a request for the Responses API
+type ResponsesRequest struct {
+	Model string `json:"model"`
+	// Input is a string or []ResponseInputItem
+	Input        interface{} `json:"input"`
+	Instructions string      `json:"instructions,omitempty"`
+	// PreviousResponseID continues the conversation stored on the server, Input only has the new items
+	PreviousResponseID string             `json:"previous_response_id,omitempty"`
+	Tools              []ResponseTool     `json:"tools,omitempty"`
+	ToolChoice         interface{}        `json:"tool_choice,omitempty"`
+	ParallelToolCalls  *bool              `json:"parallel_tool_calls,omitempty"`
+	Reasoning          *ResponseReasoning `json:"reasoning,omitempty"`
+	MaxOutputTokens    int                `json:"max_output_tokens,omitempty"`
+	Temperature        *float32           `json:"temperature,omitempty"`
+	Text               *ResponseText      `json:"text,omitempty"`
+	// Store keeps the response on the server so that it can be used as PreviousResponseID, on by default
+	Store *bool `json:"store,omitempty"`
+
+	// Whether to stream back results or not. Don't set this value in the request yourself
+	// as it will be overriden depending on if you use ResponsesStream or Responses methods.
+	Stream bool `json:"stream,omitempty"`
+}
+
+// ResponseOutputContent is a part of an output message (output_text) or of a reasoning summary (summary_text)
+type ResponseOutputContent struct {
+	Type string `json:"type"`
+	Text string `json:"text"`
+}
+
+type ResponseWebSearchAction struct {
+	Type  string `json:"type"`
+	Query string `json:"query"`
+}
+
+// ResponseOutputItem is an item generated by the model
+type ResponseOutputItem struct {
+	Type   string `json:"type"`
+	ID     string `json:"id"`
+	Status string `json:"status"`
+
+	// message
+	Role    string                  `json:"role"`
+	Content []ResponseOutputContent `json:"content"`
+
+	// reasoning
+	Summary []ResponseOutputContent `json:"summary"`
+
+	// function_call
+	CallID    string `json:"call_id"`
+	Name      string `json:"name"`
+	Arguments string `json:"arguments"`
+
+	// web_search_call
+	Action *ResponseWebSearchAction `json:"action,omitempty"`
+}
+
+type ResponseUsage struct {
+	InputTokens  int `json:"input_tokens"`
+	OutputTokens int `json:"output_tokens"`
+	TotalTokens  int `json:"total_tokens"`
+}
+
+type ResponseError struct {
+	Code    string `json:"code"`
+	Message string `json:"message"`
+}
+
+type ResponseIncompleteDetails struct {
+	Reason string `json:"reason"`
+}
+
+// Response is the full response of the Responses API
+type Response struct {
+	ID                string                     `json:"id"`
+	Object            string                     `json:"object"`
+	Status            string                     `json:"status"`
+	Model             string                     `json:"model"`
+	Output            []ResponseOutputItem       `json:"output"`
+	Usage             *ResponseUsage             `json:"usage,omitempty"`
+	Error             *ResponseError             `json:"error,omitempty"`
+	IncompleteDetails *ResponseIncompleteDetails `json:"incomplete_details,omitempty"`
+}
+
+// OutputText returns the text of the output messages joined together
+func (r *Response) OutputText() string {
+	text := ""
+	for _, item := range r.Output {
+		if item.Type != ResponseItemMessage {
+			continue
+		}
+		for _, content := range item.Content {
+			if content.Type == "output_text" {
+				text += content.Text
+			}
+		}
+	}
+	return text
+}
+
+// ResponseStreamEvent is one server-sent event of a streamed response
+type ResponseStreamEvent struct {
+	Type           string `json:"type"`
+	SequenceNumber int    `json:"sequence_number"`
+
+	// response.created, response.completed, response.failed, response.incomplete
+	Response *Response `json:"response,omitempty"`
+
+	OutputIndex  int    `json:"output_index"`
+	ItemID       string `json:"item_id"`
+	ContentIndex int    `json:"content_index"`
+	SummaryIndex int    `json:"summary_index"`
+
+	// response.output_item.added and response.output_item.done
+	Item *ResponseOutputItem `json:"item,omitempty"`
+
+	// *.delta events
+	Delta string `json:"delta"`
+	// *.done events
+	Text      string `json:"text"`
+	Arguments string `json:"arguments"`
+
+	// error
+	Code    string `json:"code"`
+	Message string `json:"message"`
+}
+
+func (c *client) Responses(ctx context.Context, request ResponsesRequest) (*Response, error) {
+	request.Stream = false
+	req, err := c.newRequest(ctx, "POST", "/responses", request)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := c.performRequest(req)
+	if err != nil {
+		return nil, err
+	}
+
+	output := new(Response)
+	if err := getResponseObject(resp, output); err != nil {
+		return nil, err
+	}
+	return output, nil
+}
+
+func (c *client) ResponsesStream(ctx context.Context, request ResponsesRequest, onEvent func(*ResponseStreamEvent)) error {
+	request.Stream = true
+	req, err := c.newRequest(ctx, "POST", "/responses", request)
+	if err != nil {
+		return err
+	}
+	resp, err := c.performRequest(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	// The stream is completed when the server closes the connection after the final event
+	reader := bufio.NewReader(resp.Body)
+	for {
+		line, err := reader.ReadBytes('\n')
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		line = bytes.TrimSpace(line)
+		if !bytes.HasPrefix(line, dataPrefix) {
+			continue
+		}
+		line = bytes.TrimPrefix(line, dataPrefix)
+		if bytes.HasPrefix(line, doneSequence) {
+			return nil
+		}
+		event := new(ResponseStreamEvent)
+		if err := json.Unmarshal(line, event); err != nil {
+			return fmt.Errorf("invalid json stream data: %v", err)
+		}
+		if event.Type == ResponseEventError {
+			return APIError{Type: event.Code, Message: event.Message}
+		}
+		onEvent(event)
+	}
+}
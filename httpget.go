@@ -0,0 +1,406 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"syscall"
+	"time"
+	"unicode/utf8"
+
+	"github.com/jaytaylor/html2text"
+	"github.com/ledongthuc/pdf"
+	"golang.org/x/net/html/charset"
+)
+
+const (
+	httpGetTimeout      = 20 * time.Second
+	httpGetMaxRedirects = 5
+	// Text pages are cut at this size, larger PDFs are refused as they can't be read partially
+	httpGetMaxBodySize = 5 << 20
+)
+
+// Types of the errors of http_get, the model gets them as the prefix of the error
+const (
+	httpGetErrorInvalidURL  = "invalid_url"
+	httpGetErrorBlocked     = "blocked_address"
+	httpGetErrorRedirects   = "too_many_redirects"
+	httpGetErrorTimeout     = "timeout"
+	httpGetErrorNetwork     = "network_error"
+	httpGetErrorStatus      = "http_status"
+	httpGetErrorTooLarge    = "too_large"
+	httpGetErrorContentType = "unsupported_content_type"
+	httpGetErrorParse       = "parse_error"
+	httpGetErrorSelector    = "invalid_selector"
+	httpGetErrorPage        = "page_out_of_range"
+)
+
+// httpGetError is an error of http_get, Type tells the model what went wrong
+type httpGetError struct {
+	Type    string
+	Message string
+}
+
+func (e *httpGetError) Error() string {
+	return e.Type + ": " + e.Message
+}
+
+// The bot runs inside a private network, the model must not reach it. These are the private,
+// loopback, link-local and other special-purpose ranges of IANA.
+var blockedNetworks = parseNetworks(
+	"0.0.0.0/8", "10.0.0.0/8", "100.64.0.0/10", "127.0.0.0/8", "169.254.0.0/16", "172.16.0.0/12",
+	"192.0.0.0/24", "192.0.2.0/24", "192.168.0.0/16", "198.18.0.0/15", "198.51.100.0/24", "203.0.113.0/24",
+	"224.0.0.0/4", "240.0.0.0/4",
+	"::/128", "::1/128", "64:ff9b::/96", "64:ff9b:1::/48", "100::/64", "2001:db8::/32", "2002::/16",
+	"fc00::/7", "fe80::/10", "ff00::/8",
+)
+
+func parseNetworks(cidrs ...string) []*net.IPNet {
+	networks := []*net.IPNet{}
+	for _, cidr := range cidrs {
+		_, network, err := net.ParseCIDR(cidr)
+		if err != nil {
+			panic(err)
+		}
+		networks = append(networks, network)
+	}
+	return networks
+}
+
+// isBlockedIP reports whether http_get must not connect to the address
+func isBlockedIP(ip net.IP) bool {
+	if ip4 := ip.To4(); ip4 != nil {
+		// IPv4-mapped IPv6 addresses are checked as IPv4
+		ip = ip4
+	}
+	for _, network := range blockedNetworks {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// httpGetDialControl refuses connections to blocked addresses
+func httpGetDialControl(network, address string, conn syscall.RawConn) error {
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return err
+	}
+	if ip := net.ParseIP(host); ip == nil || isBlockedIP(ip) {
+		return &httpGetError{Type: httpGetErrorBlocked, Message: "адрес " + host + " находится во внутренней сети"}
+	}
+	return nil
+}
+
+// httpGetClient checks the address of every connection when it is made, after the name is resolved,
+// so redirects and names that resolve to another address the second time (DNS rebinding) can't
+// reach the internal network
+var httpGetClient = &http.Client{
+	Timeout: httpGetTimeout,
+	Transport: &http.Transport{
+		// A proxy would make the connections instead of the dialer
+		Proxy: nil,
+		DialContext: (&net.Dialer{
+			Timeout: 10 * time.Second,
+			Control: httpGetDialControl,
+		}).DialContext,
+		TLSHandshakeTimeout:   10 * time.Second,
+		ResponseHeaderTimeout: httpGetTimeout,
+		MaxIdleConns:          10,
+		IdleConnTimeout:       time.Minute,
+	},
+	CheckRedirect: func(req *http.Request, via []*http.Request) error {
+		if len(via) >= httpGetMaxRedirects {
+			return &httpGetError{Type: httpGetErrorRedirects, Message: fmt.Sprintf("больше %d перенаправлений", httpGetMaxRedirects)}
+		}
+		if req.URL.Scheme != "http" && req.URL.Scheme != "https" {
+			return &httpGetError{Type: httpGetErrorInvalidURL, Message: "перенаправление на " + req.URL.Scheme + ":"}
+		}
+		return nil
+	},
+}
+
+// httpGetResult is what the model gets back from http_get
+type httpGetResult struct {
+	URL         string `json:"url"`
+	ContentType string `json:"content_type"`
+	Title       string `json:"title,omitempty"`
+	Byline      string `json:"byline,omitempty"`
+	Page        int    `json:"page"`
+	Pages       int    `json:"pages"`
+	Truncated   bool   `json:"truncated,omitempty"`
+	Output      string `json:"output"`
+}
+
+// httpGetResponse is a loaded URL
+type httpGetResponse struct {
+	// URL is the address after the redirects
+	URL         string `json:"url"`
+	ContentType string `json:"content_type"`
+	MediaType   string `json:"media_type"`
+	Body        []byte `json:"body"`
+	// Truncated is set when the body was cut at httpGetMaxBodySize
+	Truncated bool `json:"truncated,omitempty"`
+	// TTL is how long the response may be reused according to its headers
+	TTL time.Duration `json:"-"`
+}
+
+// fetchURLCached returns the cached response of the URL or loads it
+func fetchURLCached(rawURL string) (*httpGetResponse, error) {
+	u, err := url.Parse(strings.TrimSpace(rawURL))
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return nil, &httpGetError{Type: httpGetErrorInvalidURL, Message: "нужен адрес http:// или https://"}
+	}
+	response := &httpGetResponse{}
+	if httpGetCache.get(u.String(), response) {
+		return response, nil
+	}
+	response, err = fetchURL(u)
+	if err != nil {
+		return nil, err
+	}
+	httpGetCache.set(u.String(), response, response.TTL)
+	return response, nil
+}
+
+// fetchURL loads the URL, the responses with an error status are returned as errors
+func fetchURL(u *url.URL) (*httpGetResponse, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), httpGetTimeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u.String(), nil)
+	if err != nil {
+		return nil, &httpGetError{Type: httpGetErrorInvalidURL, Message: err.Error()}
+	}
+	req.Header.Set("User-Agent", "Mozilla/5.0 (compatible; chat_bot)")
+	req.Header.Set("Accept", "text/html, application/json, text/plain, application/pdf;q=0.9, */*;q=0.5")
+	resp, err := httpGetClient.Do(req)
+	if err != nil {
+		return nil, httpGetRequestError(err)
+	}
+	defer resp.Body.Close()
+
+	body, err := io.ReadAll(io.LimitReader(resp.Body, httpGetMaxBodySize+1))
+	if err != nil {
+		return nil, httpGetRequestError(err)
+	}
+	response := &httpGetResponse{
+		URL:  resp.Request.URL.String(),
+		Body: body,
+		TTL:  httpCacheTTL(resp.Header, httpGetDefaultTTL),
+	}
+	if len(body) > httpGetMaxBodySize {
+		response.Body = body[:httpGetMaxBodySize]
+		response.Truncated = true
+	}
+	response.ContentType = resp.Header.Get("Content-Type")
+	if response.ContentType == "" {
+		response.ContentType = http.DetectContentType(response.Body)
+	}
+	response.MediaType, _, _ = mime.ParseMediaType(response.ContentType)
+
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		message := resp.Status
+		if text, err := httpGetText(response.MediaType, response.ContentType, response.Body); err == nil && strings.TrimSpace(text) != "" {
+			message += ": " + substr(strings.TrimSpace(text), 0, 500)
+		}
+		return nil, &httpGetError{Type: httpGetErrorStatus, Message: message}
+	}
+	if response.MediaType == "application/pdf" && response.Truncated {
+		return nil, &httpGetError{Type: httpGetErrorTooLarge, Message: fmt.Sprintf("PDF больше %d МБ", httpGetMaxBodySize>>20)}
+	}
+	return response, nil
+}
+
+// HttpGet loads the URL and returns the page of its content that fits the context of the model.
+// Only the article of an HTML page is returned, or the elements of the CSS selector. JSON is
+// indented and the text of PDFs is extracted.
+func HttpGet(call FunctionContext, rawURL string, selector string, page int) (string, error) {
+	response, err := fetchURLCached(rawURL)
+	if err != nil {
+		return "", err
+	}
+	document := article{}
+	if response.MediaType == "text/html" || response.MediaType == "application/xhtml+xml" {
+		base, _ := url.Parse(response.URL)
+		document, err = extractArticle(decodeText(response.Body, response.ContentType), base, selector)
+		if err != nil {
+			return "", err
+		}
+	} else if selector != "" {
+		return "", &httpGetError{Type: httpGetErrorSelector, Message: "селектор применим только к HTML, получен " + response.MediaType}
+	} else if document.Text, err = httpGetText(response.MediaType, response.ContentType, response.Body); err != nil {
+		return "", err
+	}
+
+	text := strings.TrimSpace(document.Text)
+	if len(document.Links) > 0 {
+		links := []string{}
+		for _, link := range document.Links {
+			links = append(links, "- "+link.Text+": "+link.URL)
+		}
+		text += "\n\nLinks:\n" + strings.Join(links, "\n")
+	}
+	pages := paginateText(text, call.Model.Name, call.resultTokens())
+	if page <= 0 {
+		page = 1
+	}
+	if page > len(pages) {
+		return "", &httpGetError{Type: httpGetErrorPage, Message: fmt.Sprintf("в документе %d стр.", len(pages))}
+	}
+	output, err := json.Marshal(httpGetResult{
+		URL:         response.URL,
+		ContentType: response.MediaType,
+		Title:       document.Title,
+		Byline:      document.Byline,
+		Page:        page,
+		Pages:       len(pages),
+		Truncated:   response.Truncated,
+		Output:      pages[page-1],
+	})
+	if err != nil {
+		return "", err
+	}
+	return string(output), nil
+}
+
+// paginateText splits the text into pages of at most the given number of tokens of the model,
+// at line breaks where possible. The text is tokenized once and cut by the offsets of the tokens.
+func paginateText(text string, model string, tokens int) []string {
+	if tokens < 1 {
+		tokens = 1
+	}
+	offsets := tokenCounter.TokenOffsets(model, text)
+	pages := []string{}
+	start := 0
+	// first is the first token that ends after start
+	first := 0
+	for first < len(offsets) {
+		last := first + tokens
+		cut := len(text)
+		if last < len(offsets) {
+			cut = offsets[last-1]
+			if newline := strings.LastIndexByte(text[start:cut], '\n'); newline >= 0 {
+				cut = start + newline + 1
+			} else {
+				// Lines longer than a page, e.g. of minified JSON, are cut between characters
+				for cut > start && !utf8.RuneStart(text[cut]) {
+					cut--
+				}
+				if cut == start {
+					_, size := utf8.DecodeRuneInString(text[start:])
+					cut = start + size
+				}
+			}
+		}
+		if page := strings.TrimSpace(text[start:cut]); page != "" {
+			pages = append(pages, page)
+		}
+		start = cut
+		for first < len(offsets) && offsets[first] <= start {
+			first++
+		}
+	}
+	if len(pages) == 0 {
+		pages = append(pages, "")
+	}
+	return pages
+}
+
+// httpGetText converts the body to text according to its type
+func httpGetText(mediaType string, contentType string, body []byte) (string, error) {
+	switch {
+	case mediaType == "application/pdf":
+		return pdfText(body)
+	case mediaType == "application/json" || strings.HasSuffix(mediaType, "+json"):
+		indented := bytes.Buffer{}
+		if err := json.Indent(&indented, body, "", "  "); err == nil {
+			return indented.String(), nil
+		}
+		// A truncated or broken document is returned as is
+		return decodeText(body, contentType), nil
+	case mediaType == "text/html" || mediaType == "application/xhtml+xml":
+		text, err := html2text.FromString(decodeText(body, contentType), html2text.Options{OmitLinks: true, TextOnly: true})
+		if err != nil {
+			return "", &httpGetError{Type: httpGetErrorParse, Message: err.Error()}
+		}
+		return text, nil
+	case strings.HasPrefix(mediaType, "text/") || strings.HasSuffix(mediaType, "+xml") ||
+		mediaType == "application/xml" || mediaType == "application/javascript":
+		return decodeText(body, contentType), nil
+	}
+	return "", &httpGetError{Type: httpGetErrorContentType, Message: "содержимое типа " + mediaType + " не является текстом"}
+}
+
+// decodeText converts the text from the charset of the Content-Type or the HTML meta tag to UTF-8
+func decodeText(body []byte, contentType string) string {
+	reader, err := charset.NewReader(bytes.NewReader(body), contentType)
+	if err != nil {
+		return string(body)
+	}
+	text, err := io.ReadAll(reader)
+	if err != nil {
+		return string(body)
+	}
+	return string(text)
+}
+
+// pdfText extracts the text of the pages of the PDF
+func pdfText(body []byte) (text string, err error) {
+	// The PDF reader panics on some malformed files
+	defer func() {
+		if r := recover(); r != nil {
+			text, err = "", &httpGetError{Type: httpGetErrorParse, Message: fmt.Sprintf("не удалось прочитать PDF: %v", r)}
+		}
+	}()
+	reader, err := pdf.NewReader(bytes.NewReader(body), int64(len(body)))
+	if err != nil {
+		return "", &httpGetError{Type: httpGetErrorParse, Message: "не удалось прочитать PDF: " + err.Error()}
+	}
+	pages := []string{}
+	fonts := make(map[string]*pdf.Font)
+	for i := 1; i <= reader.NumPage(); i++ {
+		page := reader.Page(i)
+		if page.V.IsNull() {
+			continue
+		}
+		// Fonts are shared by the pages, parsing them once is much faster
+		for _, name := range page.Fonts() {
+			if _, ok := fonts[name]; !ok {
+				font := page.Font(name)
+				fonts[name] = &font
+			}
+		}
+		pageText, err := page.GetPlainText(fonts)
+		if err != nil {
+			continue
+		}
+		pages = append(pages, strings.TrimSpace(pageText))
+	}
+	text = strings.TrimSpace(strings.Join(pages, "\n\n"))
+	if text == "" {
+		return "", &httpGetError{Type: httpGetErrorParse, Message: "в PDF нет текста, возможно это отсканированный документ"}
+	}
+	return text, nil
+}
+
+// httpGetRequestError returns the typed error of a failed request
+func httpGetRequestError(err error) error {
+	var getErr *httpGetError
+	if errors.As(err, &getErr) {
+		return getErr
+	}
+	var netErr net.Error
+	if errors.Is(err, context.DeadlineExceeded) || (errors.As(err, &netErr) && netErr.Timeout()) {
+		return &httpGetError{Type: httpGetErrorTimeout, Message: fmt.Sprintf("нет ответа за %v", httpGetTimeout)}
+	}
+	return &httpGetError{Type: httpGetErrorNetwork, Message: err.Error()}
+}
@@ -0,0 +1,96 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+)
+
+func TestIsBlockedIP(t *testing.T) {
+	tests := []struct {
+		ip      string
+		blocked bool
+	}{
+		{"127.0.0.1", true},
+		{"127.1.2.3", true},
+		{"0.0.0.0", true},
+		{"10.0.0.1", true},
+		{"172.16.0.1", true},
+		{"172.31.255.255", true},
+		{"192.168.1.1", true},
+		{"100.64.0.1", true},
+		{"169.254.169.254", true},
+		{"224.0.0.1", true},
+		{"::ffff:127.0.0.1", true},
+		{"::ffff:10.0.0.1", true},
+		{"::ffff:169.254.169.254", true},
+		{"::1", true},
+		{"::", true},
+		{"fc00::1", true},
+		{"fd12:3456::1", true},
+		{"fe80::1", true},
+		{"ff02::1", true},
+		{"64:ff9b::a9fe:a9fe", true},
+		{"8.8.8.8", false},
+		{"172.32.0.1", false},
+		{"::ffff:8.8.8.8", false},
+		{"2606:4700:4700::1111", false},
+	}
+	for _, test := range tests {
+		ip := net.ParseIP(test.ip)
+		if ip == nil {
+			t.Fatalf("invalid IP %s", test.ip)
+		}
+		if blocked := isBlockedIP(ip); blocked != test.blocked {
+			t.Errorf("isBlockedIP(%s) = %v, want %v", test.ip, blocked, test.blocked)
+		}
+	}
+}
+
+func TestFetchURLBlocksLoopback(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		t.Error("the request reached the server")
+	}))
+	defer server.Close()
+	u, _ := url.Parse(server.URL)
+	_, err := fetchURL(u)
+	getErr := &httpGetError{}
+	if !errors.As(err, &getErr) || getErr.Type != httpGetErrorBlocked {
+		t.Errorf("err = %v", err)
+	}
+}
+
+func TestHttpGetClientBlocksRedirectToLoopback(t *testing.T) {
+	internal := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		t.Error("the redirect reached the internal server")
+	}))
+	defer internal.Close()
+	redirects := 0
+	redirector := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		redirects++
+		http.Redirect(w, r, internal.URL+"/admin", http.StatusFound)
+	}))
+	defer redirector.Close()
+
+	// The redirecting server stands for a public site, every other connection goes through the
+	// dialer of http_get
+	transport := httpGetClient.Transport.(*http.Transport).Clone()
+	dialer := &net.Dialer{Control: httpGetDialControl}
+	transport.DialContext = func(ctx context.Context, network, address string) (net.Conn, error) {
+		if address == "public.example:80" {
+			return (&net.Dialer{}).DialContext(ctx, network, redirector.Listener.Addr().String())
+		}
+		return dialer.DialContext(ctx, network, address)
+	}
+	client := &http.Client{Transport: transport, CheckRedirect: httpGetClient.CheckRedirect}
+
+	_, err := client.Get("http://public.example/")
+	getErr := &httpGetError{}
+	if redirects != 1 || !errors.As(err, &getErr) || getErr.Type != httpGetErrorBlocked {
+		t.Errorf("redirects = %d, err = %v", redirects, err)
+	}
+}
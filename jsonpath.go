@@ -0,0 +1,127 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// jsonPathStep selects a key of objects, an index of arrays or, with wildcard, every child
+type jsonPathStep struct {
+	key      string
+	index    int
+	isIndex  bool
+	wildcard bool
+}
+
+// parseJSONPath parses the simple JSONPath expressions: $.key, $['key'], $[0], $[-1], $[*] and $.*
+func parseJSONPath(path string) ([]jsonPathStep, error) {
+	path = strings.TrimSpace(path)
+	if path == "" {
+		return nil, nil
+	}
+	if !strings.HasPrefix(path, "$") {
+		return nil, fmt.Errorf("JSONPath должен начинаться с $: %s", path)
+	}
+	steps := []jsonPathStep{}
+	rest := path[1:]
+	for rest != "" {
+		step := jsonPathStep{}
+		switch {
+		case strings.HasPrefix(rest, ".."):
+			return nil, fmt.Errorf("рекурсивный спуск не поддерживается в JSONPath: %s", path)
+		case strings.HasPrefix(rest, ".*"):
+			step.wildcard = true
+			rest = rest[2:]
+		case rest[0] == '.':
+			rest = rest[1:]
+			end := strings.IndexAny(rest, ".[")
+			if end < 0 {
+				end = len(rest)
+			}
+			step.key = rest[:end]
+			rest = rest[end:]
+			if step.key == "" {
+				return nil, fmt.Errorf("пустое имя поля в JSONPath: %s", path)
+			}
+		case rest[0] == '[':
+			end := strings.Index(rest, "]")
+			if end < 0 {
+				return nil, fmt.Errorf("нет закрывающей скобки в JSONPath: %s", path)
+			}
+			inner := strings.TrimSpace(rest[1:end])
+			rest = rest[end+1:]
+			switch {
+			case inner == "*":
+				step.wildcard = true
+			case len(inner) >= 2 && (inner[0] == '\'' || inner[0] == '"') && inner[len(inner)-1] == inner[0]:
+				step.key = inner[1 : len(inner)-1]
+			default:
+				index, err := strconv.Atoi(inner)
+				if err != nil {
+					return nil, fmt.Errorf("неверный индекс %s в JSONPath: %s", inner, path)
+				}
+				step.index, step.isIndex = index, true
+			}
+		default:
+			return nil, fmt.Errorf("неверный JSONPath: %s", path)
+		}
+		steps = append(steps, step)
+	}
+	return steps, nil
+}
+
+// evalJSONPath selects a part of a value decoded from JSON. An expression with a wildcard returns
+// the list of the selected values, the others return the value itself.
+func evalJSONPath(value interface{}, path string) (interface{}, error) {
+	steps, err := parseJSONPath(path)
+	if err != nil {
+		return nil, err
+	}
+	nodes := []interface{}{value}
+	multiple := false
+	for _, step := range steps {
+		next := []interface{}{}
+		for _, node := range nodes {
+			switch node := node.(type) {
+			case map[string]interface{}:
+				if step.wildcard {
+					keys := make([]string, 0, len(node))
+					for key := range node {
+						keys = append(keys, key)
+					}
+					sort.Strings(keys)
+					for _, key := range keys {
+						next = append(next, node[key])
+					}
+				} else if !step.isIndex {
+					if child, ok := node[step.key]; ok {
+						next = append(next, child)
+					}
+				}
+			case []interface{}:
+				if step.wildcard {
+					next = append(next, node...)
+				} else if step.isIndex {
+					i := step.index
+					if i < 0 {
+						i += len(node)
+					}
+					if i >= 0 && i < len(node) {
+						next = append(next, node[i])
+					}
+				}
+			}
+		}
+		multiple = multiple || step.wildcard
+		nodes = next
+	}
+	if multiple {
+		return nodes, nil
+	}
+	if len(nodes) == 0 {
+		return nil, fmt.Errorf("по пути %s ничего не найдено", path)
+	}
+	return nodes[0], nil
+}
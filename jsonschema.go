@@ -0,0 +1,183 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"math"
+	"regexp"
+	"unicode/utf8"
+)
+
+// validateJSONSchema checks the value decoded from JSON against the schema. It supports the part
+// of JSON schema used for structured outputs: type, enum, const, properties, required,
+// additionalProperties, items, anyOf, the length and range limits and pattern.
+func validateJSONSchema(value interface{}, schema map[string]interface{}, path string) error {
+	if path == "" {
+		path = "$"
+	}
+	if types, ok := schema["type"]; ok {
+		if !matchesJSONType(value, types) {
+			return fmt.Errorf("%s: ожидается тип %v, получено %s", path, types, jsonType(value))
+		}
+	}
+	if enum, ok := schema["enum"].([]interface{}); ok {
+		found := false
+		for _, option := range enum {
+			if jsonEqual(value, option) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return fmt.Errorf("%s: значение не входит в enum", path)
+		}
+	}
+	if constant, ok := schema["const"]; ok && !jsonEqual(value, constant) {
+		return fmt.Errorf("%s: ожидается значение %v", path, constant)
+	}
+	if anyOf, ok := schema["anyOf"].([]interface{}); ok {
+		var firstErr error
+		for _, option := range anyOf {
+			optionSchema, _ := option.(map[string]interface{})
+			err := validateJSONSchema(value, optionSchema, path)
+			if err == nil {
+				firstErr = nil
+				break
+			}
+			if firstErr == nil {
+				firstErr = err
+			}
+		}
+		if firstErr != nil {
+			return firstErr
+		}
+	}
+
+	switch value := value.(type) {
+	case map[string]interface{}:
+		properties, _ := schema["properties"].(map[string]interface{})
+		if required, ok := schema["required"].([]interface{}); ok {
+			for _, name := range required {
+				if name, ok := name.(string); ok {
+					if _, found := value[name]; !found {
+						return fmt.Errorf("%s: нет обязательного поля %s", path, name)
+					}
+				}
+			}
+		}
+		for name, property := range value {
+			propertyPath := path + "." + name
+			if propertySchema, ok := properties[name].(map[string]interface{}); ok {
+				if err := validateJSONSchema(property, propertySchema, propertyPath); err != nil {
+					return err
+				}
+				continue
+			}
+			switch additional := schema["additionalProperties"].(type) {
+			case bool:
+				if !additional {
+					return fmt.Errorf("%s: лишнее поле", propertyPath)
+				}
+			case map[string]interface{}:
+				if err := validateJSONSchema(property, additional, propertyPath); err != nil {
+					return err
+				}
+			}
+		}
+	case []interface{}:
+		if min, ok := schema["minItems"].(float64); ok && float64(len(value)) < min {
+			return fmt.Errorf("%s: меньше %v элементов", path, min)
+		}
+		if max, ok := schema["maxItems"].(float64); ok && float64(len(value)) > max {
+			return fmt.Errorf("%s: больше %v элементов", path, max)
+		}
+		if items, ok := schema["items"].(map[string]interface{}); ok {
+			for i, item := range value {
+				if err := validateJSONSchema(item, items, fmt.Sprintf("%s[%d]", path, i)); err != nil {
+					return err
+				}
+			}
+		}
+	case string:
+		length := float64(utf8.RuneCountInString(value))
+		if min, ok := schema["minLength"].(float64); ok && length < min {
+			return fmt.Errorf("%s: строка короче %v символов", path, min)
+		}
+		if max, ok := schema["maxLength"].(float64); ok && length > max {
+			return fmt.Errorf("%s: строка длиннее %v символов", path, max)
+		}
+		if pattern, ok := schema["pattern"].(string); ok {
+			re, err := regexp.Compile(pattern)
+			if err == nil && !re.MatchString(value) {
+				return fmt.Errorf("%s: строка не соответствует шаблону %s", path, pattern)
+			}
+		}
+	case float64:
+		if min, ok := schema["minimum"].(float64); ok && value < min {
+			return fmt.Errorf("%s: значение меньше %v", path, min)
+		}
+		if max, ok := schema["maximum"].(float64); ok && value > max {
+			return fmt.Errorf("%s: значение больше %v", path, max)
+		}
+	}
+	return nil
+}
+
+// matchesJSONType checks the value against "type", a type name or a list of them
+func matchesJSONType(value interface{}, types interface{}) bool {
+	switch types := types.(type) {
+	case string:
+		actual := jsonType(value)
+		return actual == types || (types == "number" && actual == "integer")
+	case []interface{}:
+		for _, name := range types {
+			if matchesJSONType(value, name) {
+				return true
+			}
+		}
+		return false
+	}
+	return true
+}
+
+func jsonType(value interface{}) string {
+	switch value := value.(type) {
+	case nil:
+		return "null"
+	case bool:
+		return "boolean"
+	case string:
+		return "string"
+	case float64:
+		if value == math.Trunc(value) {
+			return "integer"
+		}
+		return "number"
+	case []interface{}:
+		return "array"
+	case map[string]interface{}:
+		return "object"
+	}
+	return "unknown"
+}
+
+func jsonEqual(a, b interface{}) bool {
+	dataA, errA := json.Marshal(a)
+	dataB, errB := json.Marshal(b)
+	return errA == nil && errB == nil && string(dataA) == string(dataB)
+}
+
+// parseJSONSchema checks that the text is a JSON schema object and returns it compacted, the order
+// of the properties is kept as the model follows it
+func parseJSONSchema(text string) (json.RawMessage, map[string]interface{}, error) {
+	schema := map[string]interface{}{}
+	if err := json.Unmarshal([]byte(text), &schema); err != nil {
+		return nil, nil, fmt.Errorf("схема не является JSON-объектом: %w", err)
+	}
+	compacted := bytes.Buffer{}
+	if err := json.Compact(&compacted, []byte(text)); err != nil {
+		return nil, nil, err
+	}
+	return compacted.Bytes(), schema, nil
+}
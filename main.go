@@ -25,7 +25,6 @@ import (
 	"cloud.google.com/go/translate/apiv3/translatepb"
 	openai "github.com/0x9ef/openai-go"
 	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api/v5"
-	tokenizer "github.com/samber/go-gpt-3-encoder"
 )
 
 const (
@@ -43,7 +42,7 @@ const (
 	GPT54Model            = "gpt-5.4"
 	GPT35TurboModel       = "gpt-3.5-turbo-0613"
 	GPT35TurboModel16k    = "gpt-3.5-turbo-16k"
-	BardModel             = "bard"
+	GeminiModel           = "gemini-2.5-flash"
 	DalleModel            = "dall-e-3"
 	MidjourneyModel       = "midjourney"
 )
@@ -56,29 +55,57 @@ var config Config
 // Store conversation history per user
 var conversationHistory = make(map[int64][]gpt3.ChatCompletionRequestMessage)
 var userSettingsMap = make(map[int64]User)
+
+// generating marks the chats whose answer is being generated, guarded by mu
+var generating = make(map[int64]bool)
 var mu = &sync.Mutex{}
 
 type User struct {
 	Model                string
 	SystemPrompt         string
 	State                string
-	CurrentContext       *context.CancelFunc
-	CurrentMessageBuffer string
-	BardChatbot          *BardChatbot
+	ConversationID       string
+	CurrentContext       *context.CancelFunc `json:"-"`
+	CurrentMessageBuffer string              `json:"-"`
+	// ResponseSchema makes the answers JSON, SchemaTemplates are the schemas saved by the user
+	ResponseSchema  *ResponseSchema   `json:",omitempty"`
+	SchemaTemplates map[string]string `json:",omitempty"`
+	// Tools are the functions the user turned on or off, the others are on by their Default
+	Tools map[string]bool `json:",omitempty"`
+	// LanguageCode is the language of the Telegram client, e.g. ru or pt-br, the default of the
+	// search region. SearchCountry and SearchLanguage are set by the user with /search_locale.
+	LanguageCode   string `json:",omitempty"`
+	SearchCountry  string `json:",omitempty"`
+	SearchLanguage string `json:",omitempty"`
 }
 
 type Config struct {
-	DebugMode                        string   `yaml:"debug_mode"`
-	TelegramToken                    string   `yaml:"telegram_token"`
-	OpenAIKey                        string   `yaml:"openai_api_key"`
-	BardSession                      string   `yaml:"bard_session_id"`
-	AllowedUsers                     []string `yaml:"allowed_telegram_usernames"`
-	BardAllowedUsers                 []string `yaml:"bard_allowed_telegram_usernames"`
-	MidjourneyToken                  string   `yaml:"midjourney_token"`
-	MidjourneyChannelId              string   `yaml:"midjourney_channel_id"`
-	MidjourneyTranslateRUENUsernames []string `yaml:"midjourney_translate_ru_en_usernames"`
-	GoogleCloudProjectName           string   `yaml:"google_cloud_project_name"`
-	GoogleCloudKeyfile               string   `yaml:"google_cloud_keyfile"`
+	DebugMode                        string                 `yaml:"debug_mode"`
+	TelegramToken                    string                 `yaml:"telegram_token"`
+	OpenAIKey                        string                 `yaml:"openai_api_key"`
+	AllowedUsers                     []string               `yaml:"allowed_telegram_usernames"`
+	MidjourneyToken                  string                 `yaml:"midjourney_token"`
+	MidjourneyChannelId              string                 `yaml:"midjourney_channel_id"`
+	MidjourneyTranslateRUENUsernames []string               `yaml:"midjourney_translate_ru_en_usernames"`
+	GoogleCloudProjectName           string                 `yaml:"google_cloud_project_name"`
+	GoogleCloudKeyfile               string                 `yaml:"google_cloud_keyfile"`
+	StorageType                      string                 `yaml:"storage_type"`
+	StorageDir                       string                 `yaml:"storage_dir"`
+	CompactionThreshold              float64                `yaml:"compaction_threshold"`
+	CompactionModel                  string                 `yaml:"compaction_model"`
+	CompactionKeepMessages           int                    `yaml:"compaction_keep_messages"`
+	DefaultModel                     string                 `yaml:"default_model"`
+	Models                           []ModelSpec            `yaml:"models"`
+	ModelSwitchKeepHistory           bool                   `yaml:"model_switch_keep_history"`
+	Providers                        []ProviderConfig       `yaml:"providers"`
+	AnthropicKey                     string                 `yaml:"anthropic_key"`
+	GeminiKey                        string                 `yaml:"gemini_key"`
+	SchemaTemplates                  []SchemaTemplate       `yaml:"schema_templates"`
+	WebhookTools                     []WebhookTool          `yaml:"webhook_tools"`
+	MCPServers                       []MCPServerConfig      `yaml:"mcp_servers"`
+	CodeRunner                       CodeRunnerConfig       `yaml:"code_runner"`
+	SearchProviders                  []SearchProviderConfig `yaml:"search_providers"`
+	WebCache                         WebCacheConfig         `yaml:"web_cache"`
 }
 
 func ReadConfig() (Config, error) {
@@ -209,6 +236,9 @@ func detectLanguage(projectID string, text string) (string, error) {
 }
 
 func main() {
+	if len(os.Args) > 2 && os.Args[1] == sandboxInitArg {
+		runSandboxInit(os.Args[2])
+	}
 
 	var err error
 	config, err = ReadConfig()
@@ -216,9 +246,39 @@ func main() {
 		log.Fatalf("Failed to read config: %v", err)
 	}
 	// Initialize the OpenAI API client
-	//customOpenAIAPIEndpoint := os.Getenv("CUSTOM_OPENAI_API_ENDPOINT")
-	//openaiClientGPT4 = gpt3.NewClient(config.OpenAIKey, gpt3.WithBaseURL(customOpenAIAPIEndpoint+"/v1"))
 	openaiClient = gpt3.NewClient(config.OpenAIKey)
+	providerClients, err = newProviderClients(config.Providers)
+	if err != nil {
+		log.Fatalf("Failed to configure providers: %v", err)
+	}
+	modelRegistry = newModelRegistry(defaultModelSpecs, config.Models)
+	if err := validateModelProviders(modelRegistry, providerClients); err != nil {
+		log.Fatalf("Failed to configure models: %v", err)
+	}
+	if err := validateSchemaTemplates(config.SchemaTemplates); err != nil {
+		log.Fatalf("Failed to configure schema templates: %v", err)
+	}
+	if err := registerWebhookTools(config.WebhookTools); err != nil {
+		log.Fatalf("Failed to configure webhook tools: %v", err)
+	}
+	if err := connectMCPServers(config.MCPServers); err != nil {
+		log.Fatalf("Failed to configure MCP servers: %v", err)
+	}
+	searchProviders, err = newSearchProviders(config.SearchProviders)
+	if err != nil {
+		log.Fatalf("Failed to configure search providers: %v", err)
+	}
+	if err := newWebCaches(config.WebCache); err != nil {
+		log.Fatalf("Failed to configure web cache: %v", err)
+	}
+	if err := registerCodeRunner(config.CodeRunner); err != nil {
+		log.Fatalf("Failed to configure code runner: %v", err)
+	}
+
+	store, err = NewStore(config)
+	if err != nil {
+		log.Fatalf("Failed to open storage: %v", err)
+	}
 
 	// Initialize the Telegram bot
 	bot, err := tgbotapi.NewBotAPI(config.TelegramToken)
@@ -243,22 +303,55 @@ func main() {
 	// Handle updates
 	for update := range updates {
 		go func(update tgbotapi.Update) {
+			if update.EditedMessage != nil {
+				loadChat(update.EditedMessage.Chat.ID)
+				handleEditedMessage(bot, update.EditedMessage)
+				return
+			}
 			if update.Message == nil && update.CallbackQuery == nil {
 				return
 			}
+			if update.Message != nil {
+				loadChat(update.Message.Chat.ID)
+			} else if update.CallbackQuery.Message != nil {
+				loadChat(update.CallbackQuery.Message.Chat.ID)
+			}
 			if update.Message != nil {
 				if update.Message.IsCommand() {
 					handleCommand(bot, update)
 				} else {
 					handleMessage(bot, update)
 				}
-			} else {
+			} else if !handleCallbackQuery(bot, update.CallbackQuery) {
 				handleMessage(bot, update)
 			}
 		}(update)
 	}
 }
 
+// handleCallbackQuery handles inline buttons of the bot menus, other callbacks (Midjourney buttons)
+// are passed to handleMessage
+func handleCallbackQuery(bot *tgbotapi.BotAPI, query *tgbotapi.CallbackQuery) bool {
+	if query.Message == nil || !contains(config.AllowedUsers, query.From.UserName) {
+		return false
+	}
+	switch {
+	case strings.HasPrefix(query.Data, conversationCallbackPrefix):
+		handleConversationCallback(bot, query)
+	case strings.HasPrefix(query.Data, branchCallbackPrefix):
+		handleBranchCallback(bot, query)
+	case strings.HasPrefix(query.Data, modelCallbackPrefix):
+		handleModelCallback(bot, query)
+	case strings.HasPrefix(query.Data, toolsCallbackPrefix):
+		handleToolsCallback(bot, query)
+	case query.Data == regenerateCallbackData:
+		handleRegenerateCallback(bot, query)
+	default:
+		return false
+	}
+	return true
+}
+
 func contains(s []string, e string) bool {
 	for _, a := range s {
 		if a == e {
@@ -380,35 +473,24 @@ func handleMessage(bot *tgbotapi.BotAPI, update tgbotapi.Update) {
 		state = userSettingsMap[update.Message.Chat.ID].State
 		model = userSettingsMap[update.Message.Chat.ID].Model
 		if model == "" {
-			model = DefaultModel
+			model = defaultModel()
 		}
+		setLanguageCodeLocked(update.Message.Chat.ID, update.Message.From.LanguageCode)
 		mu.Unlock()
 		if state == StateWaitingForSystemPrompt {
 			mu.Lock()
-			userSettingsMap[update.Message.Chat.ID] = User{
-				Model:        model,
-				SystemPrompt: update.Message.Text,
-				State:        StateDefault,
-			}
+			user := userSettingsMap[update.Message.Chat.ID]
+			user.Model = model
+			user.SystemPrompt = update.Message.Text
+			user.State = StateDefault
+			userSettingsMap[update.Message.Chat.ID] = user
 			mu.Unlock()
+			saveChat(update.Message.Chat.ID)
 			msg := tgbotapi.NewMessage(update.Message.Chat.ID, "Системный промпт установлен.")
 			bot.Send(msg)
 			return
 		}
 	}
-	/*generatedText, err := generateTextWithGPT(update.Message.Text, update.Message.Chat.ID, model)
-	if err != nil {
-		log.Printf("Failed to generate text with GPT: %v", err)
-		return
-	}
-
-	msg := tgbotapi.NewMessage(update.Message.Chat.ID, generatedText)
-	msg.ReplyToMessageID = update.Message.MessageID
-
-	_, err = bot.Send(msg)
-	if err != nil {
-		log.Printf("Failed to send message: %v", err)
-	}*/
 	messageText := ""
 	inputPhotoUrl := ""
 	if update.Message != nil {
@@ -435,8 +517,7 @@ func handleMessage(bot *tgbotapi.BotAPI, update tgbotapi.Update) {
 			messageText = update.Message.Caption
 			inputPhotoUrl, _ = bot.GetFileDirectURL(update.Message.Photo[len(update.Message.Photo)-1].FileID)
 			time.Sleep(500 * time.Millisecond)
-			_, settingsExists := userSettingsMap[update.Message.Chat.ID]
-			if inputPhotoUrl != "" && (!settingsExists || userSettingsMap[update.Message.Chat.ID].Model == GPT45PreviewModel || userSettingsMap[update.Message.Chat.ID].Model == "") {
+			if inputPhotoUrl != "" && modelRegistry.Get(model).acceptsImages() {
 				chatID := update.Message.Chat.ID
 				mu.Lock()
 				conversationHistory[chatID] = append(conversationHistory[chatID], gpt3.ChatCompletionRequestMessage{
@@ -473,40 +554,17 @@ func handleMessage(bot *tgbotapi.BotAPI, update tgbotapi.Update) {
 		}
 	}
 	if messageText != "" {
-		if userSettingsMap[chatId].Model == BardModel {
-			response, err := userSettingsMap[chatId].BardChatbot.Ask(messageText)
-			if err != nil {
-				msg := tgbotapi.NewMessage(chatId, "Ошибка обращаения к Bard: "+err.Error())
-				msg.ReplyToMessageID = update.Message.MessageID
-				msg.DisableWebPagePreview = true
-				_, err := bot.Send(msg)
-				if err != nil {
-					fmt.Println(err)
-				}
-			} else {
-				response = userSettingsMap[chatId].BardChatbot.PrepareForTelegramMarkdown(response)
-				msg := tgbotapi.NewMessage(chatId, response)
-				msg.ParseMode = "Markdown"
-				msg.ReplyToMessageID = update.Message.MessageID
-				_, err := bot.Send(msg)
-				if err != nil {
-					log.Printf("Failed to send message as Markdown: %v"+response, err)
-					msg := tgbotapi.NewMessage(chatId, response)
-					msg.ReplyToMessageID = update.Message.MessageID
-					msg.DisableWebPagePreview = true
-					_, err := bot.Send(msg)
-					if err != nil {
-						log.Printf("Failed to send message: %v", err)
-					}
-				}
-			}
-		} else if userSettingsMap[chatId].Model == DalleModel {
+		spec := modelRegistry.Get(userSettingsMap[chatId].Model)
+		if spec.Kind == ModelKindImage {
+			mu.Lock()
 			conversationHistory[chatId] = []gpt3.ChatCompletionRequestMessage{
 				{
 					Role:    "user",
 					Content: messageText,
 				},
 			}
+			resetTurnsLocked(chatId)
+			mu.Unlock()
 			result := DalleGenerations(config.OpenAIKey, messageText, 1, "1024x1024")
 			if len(result.Data) == 0 {
 				msg := tgbotapi.NewMessage(chatId, "Ошибка при отправке запроса к OpenAI: "+fmt.Sprint(result))
@@ -531,7 +589,7 @@ func handleMessage(bot *tgbotapi.BotAPI, update tgbotapi.Update) {
 					log.Printf("Failed to send message: %v", err)
 				}
 			}
-		} else if userSettingsMap[chatId].Model == MidjourneyModel {
+		} else if spec.Kind == ModelKindMidjourney {
 			//startTime := time.Now().UTC().Add(-time.Hour * 24 * 7)
 			startTime := time.Now().UTC()
 			startTimeTimestamp := startTime.Format(time.RFC3339)
@@ -1017,369 +1075,404 @@ func handleMessage(bot *tgbotapi.BotAPI, update tgbotapi.Update) {
 			if update.Message == nil {
 				return
 			}
-			generatedTextStream, err := generateTextStreamWithGPT(messageText, chatId, model)
-			if err != nil {
-				log.Printf("Failed to generate text stream with GPT: %v", err)
+			if inputPhotoUrl == "" && offerBranch(bot, update.Message) {
 				return
 			}
-			text := ""
-			messageID := 0
-			startTime := time.Now().UTC()
-			messagesCount := 0
-			messageIDs := make([]int, 0)
-			messages := make([]string, 0)
-			if model == O4MiniModel {
-				for generatedText := range generatedTextStream {
-					if generatedText == "" {
-						continue
-					}
-					// This model generates 1 long message, slice it into 4k characters
-					// Send several telegram messages 4k long
-					runes := []rune(generatedText)
-					for i := 0; i < len(runes); i += 4000 {
-						end := i + 4000
-						if end > len(runes) {
-							end = len(runes)
-						}
-						msgText := string(runes[i:end])
-						msgText2 := telegramPrepareMarkdownMessageV1(msgText)
-						msg := tgbotapi.NewMessage(chatId, msgText2)
-						msg.ParseMode = "Markdown"
-						if i == 0 {
-							msg.ReplyToMessageID = update.Message.MessageID
-						}
-						msg.DisableWebPagePreview = true
-						_, err := bot.Send(msg)
-						if err != nil {
-							log.Printf("Failed to send message as markdown: %v", err)
-							// send as plain text
-							msg := tgbotapi.NewMessage(chatId, msgText)
-							if i == 0 {
-								msg.ReplyToMessageID = update.Message.MessageID
-							}
-							msg.DisableWebPagePreview = true
-							_, err := bot.Send(msg)
-							if err != nil {
-								log.Printf("Failed to send message as plaintext: %v", err)
-							}
-						}
-					}
-				}
-			} else {
-				for generatedText := range generatedTextStream {
-					if generatedText == "" {
-						continue
-					}
+			answerMessage(bot, chatId, update.Message.MessageID, messageText, model)
+		}
+	}
+	CompleteResponse(chatId)
+}
 
-					if text == "" {
-						// Send the first message
-						messagesCount++
-						msgText := generatedText
-						msgText2 := strings.TrimSpace(msgText) + "..."
-						msg := tgbotapi.NewMessage(chatId, msgText2)
-						msg.ReplyToMessageID = update.Message.MessageID
-						msg.DisableWebPagePreview = true
-						msg_, err := bot.Send(msg)
-						if err != nil {
-							log.Printf("Failed to send message: %v", err)
-						}
-						messageID = msg_.MessageID
-						messageIDs = append(messageIDs, messageID)
-						messages = append(messages, msgText2)
-						fmt.Println("Message ID: ", msg_.MessageID)
-						text += generatedText
-						continue
-					}
+// answerMessage generates the answer to a new user message and remembers it as a turn of the conversation
+func answerMessage(bot *tgbotapi.BotAPI, chatId int64, userMessageID int, messageText string, model string) {
+	mu.Lock()
+	turnIndex := len(conversationHistory[chatId])
+	mu.Unlock()
+	messageIDs := replyWithGPT(bot, chatId, userMessageID, messageText, model, nil)
+	recordTurn(bot, chatId, turnIndex, userMessageID, messageIDs)
+}
 
-					text += generatedText
-					if int(time.Since(startTime).Milliseconds()) < 3000 {
-						continue
-					}
-					startTime = time.Now().UTC()
-
-					msgText := text
-					// if the length of the text is too long, send a new message
-					if len(msgText) > messagesCount*4000 {
-						// edit the previous message
-						msgText2 := substr(msgText, (messagesCount-1)*4000, 4000)
-						msgText3 := telegramPrepareMarkdownMessageV1(msgText2)
-						if msgText3 != messages[messagesCount-1] {
-							msg := tgbotapi.NewEditMessageText(chatId, messageID, msgText3)
-							msg.ParseMode = "Markdown"
-							msg.DisableWebPagePreview = true
-							_, err := bot.Send(msg)
-							if err != nil {
-								log.Printf("Failed to edit message: %v", err)
-								msgText3 = strings.TrimSpace(msgText2) + "..."
-								if msgText3 != messages[messagesCount-1] {
-									msg := tgbotapi.NewEditMessageText(chatId, messageID, msgText3)
-									msg.DisableWebPagePreview = true
-									_, err = bot.Send(msg)
-									messages[messagesCount-1] = msgText3
-								}
-							}
-						}
-						messages[messagesCount-1] = msgText3
+// replyWithGPT generates the answer to messageText and streams it into Telegram messages.
+// If editMessageIDs are given, those messages are edited instead of sending new ones.
+// Returns IDs of the messages that contain the answer.
+func replyWithGPT(bot *tgbotapi.BotAPI, chatId int64, replyToMessageID int, messageText string, model string, editMessageIDs []int) []int {
+	generatedTextStream, err := generateTextStream(messageText, chatId, model)
+	if err != nil {
+		log.Printf("Failed to generate text stream: %v", err)
+		msg := tgbotapi.NewMessage(chatId, "Ошибка: "+err.Error())
+		msg.ReplyToMessageID = replyToMessageID
+		bot.Send(msg)
+		return nil
+	}
+	mu.Lock()
+	schema := userSettingsMap[chatId].ResponseSchema
+	mu.Unlock()
+	var messageIDs []int
+	if schema != nil {
+		messageIDs = replyWithJSON(bot, chatId, replyToMessageID, schema, generatedTextStream, editMessageIDs)
+	} else {
+		messageIDs = streamReply(bot, chatId, replyToMessageID, model, generatedTextStream, editMessageIDs)
+	}
+	sendCodeFiles(bot, chatId, replyToMessageID)
+	return messageIDs
+}
 
-						// Create new message
-						messagesCount++
-						msgText2 = substr(msgText, (messagesCount-1)*4000, 4000)
-						msgText3 = strings.TrimSpace(telegramPrepareMarkdownMessageV1(msgText2)) + "..."
-						msgNew := tgbotapi.NewMessage(chatId, msgText3)
-						msgNew.ParseMode = "Markdown"
-						msgNew.ReplyToMessageID = messageID
-						msgNew.DisableWebPagePreview = true
-						msg_, err := bot.Send(msgNew)
-						if err != nil {
-							log.Printf("Failed to send message: %v", err)
-							msgText3 = strings.TrimSpace(msgText2) + "..."
-							msg := tgbotapi.NewEditMessageText(chatId, messageID, msgText3)
-							msg.DisableWebPagePreview = true
-							msg_, err = bot.Send(msg)
-							messageID = msg_.MessageID
-							messageIDs = append(messageIDs, messageID)
-							messages = append(messages, msgText3)
-							continue
-						}
-						messageID = msg_.MessageID
-						messageIDs = append(messageIDs, messageID)
-						messages = append(messages, msgText2)
+func regenerateKeyboard() tgbotapi.InlineKeyboardMarkup {
+	return tgbotapi.NewInlineKeyboardMarkup(
+		tgbotapi.NewInlineKeyboardRow(
+			tgbotapi.NewInlineKeyboardButtonData("🔄 Перегенерировать", regenerateCallbackData),
+		),
+	)
+}
+
+func streamReply(bot *tgbotapi.BotAPI, chatId int64, replyToMessageID int, model string, generatedTextStream chan string, editMessageIDs []int) []int {
+	var err error
+	text := ""
+	messageID := 0
+	startTime := time.Now().UTC()
+	messagesCount := 0
+	messageIDs := make([]int, 0)
+	messages := make([]string, 0)
+
+	// newMessage sends a new message or reuses the next of editMessageIDs
+	newMessage := func(msgText string, parseMode string, replyTo int) (int, error) {
+		if len(messageIDs) < len(editMessageIDs) {
+			editID := editMessageIDs[len(messageIDs)]
+			msg := tgbotapi.NewEditMessageText(chatId, editID, msgText)
+			msg.ParseMode = parseMode
+			msg.DisableWebPagePreview = true
+			_, err := bot.Send(msg)
+			if err != nil && !strings.Contains(err.Error(), "message is not modified") {
+				return 0, err
+			}
+			return editID, nil
+		}
+		msg := tgbotapi.NewMessage(chatId, msgText)
+		msg.ParseMode = parseMode
+		msg.ReplyToMessageID = replyTo
+		msg.DisableWebPagePreview = true
+		msg_, err := bot.Send(msg)
+		return msg_.MessageID, err
+	}
+
+	if !modelRegistry.Get(model).Stream {
+		for generatedText := range generatedTextStream {
+			if generatedText == "" {
+				continue
+			}
+			// This model generates 1 long message, slice it into 4k characters
+			// Send several telegram messages 4k long
+			runes := []rune(generatedText)
+			for i := 0; i < len(runes); i += 4000 {
+				end := i + 4000
+				if end > len(runes) {
+					end = len(runes)
+				}
+				msgText := string(runes[i:end])
+				msgText2 := telegramPrepareMarkdownMessageV1(msgText)
+				replyTo := 0
+				if i == 0 {
+					replyTo = replyToMessageID
+				}
+				messageID, err := newMessage(msgText2, "Markdown", replyTo)
+				if err != nil {
+					log.Printf("Failed to send message as markdown: %v", err)
+					// send as plain text
+					messageID, err = newMessage(msgText, "", replyTo)
+					if err != nil {
+						log.Printf("Failed to send message as plaintext: %v", err)
 						continue
 					}
+				}
+				messageIDs = append(messageIDs, messageID)
+			}
+		}
+		if len(messageIDs) > 0 {
+			msg := tgbotapi.NewEditMessageReplyMarkup(chatId, messageIDs[len(messageIDs)-1], regenerateKeyboard())
+			bot.Send(msg)
+		}
+		deleteUnusedMessages(bot, chatId, messageIDs, editMessageIDs)
+		return messageIDs
+	}
 
-					// Update all messages
-					for i, messageID := range messageIDs {
-						msgText2 := ""
-						msgText2 = substr(msgText, i*4000, 4000)
-						msgText3 := strings.TrimSpace(telegramPrepareMarkdownMessageV1(msgText2))
-						if i == len(messageIDs)-1 {
-							msgText3 += "..."
-						}
-						if msgText3 == messages[i] {
-							continue
-						}
+	for generatedText := range generatedTextStream {
+		if generatedText == "" {
+			continue
+		}
+
+		if text == "" {
+			// Send the first message
+			messagesCount++
+			msgText := generatedText
+			msgText2 := strings.TrimSpace(msgText) + "..."
+			messageID, err = newMessage(msgText2, "", replyToMessageID)
+			if err != nil {
+				log.Printf("Failed to send message: %v", err)
+			}
+			messageIDs = append(messageIDs, messageID)
+			messages = append(messages, msgText2)
+			fmt.Println("Message ID: ", messageID)
+			text += generatedText
+			continue
+		}
+
+		text += generatedText
+		if int(time.Since(startTime).Milliseconds()) < 3000 {
+			continue
+		}
+		startTime = time.Now().UTC()
+
+		msgText := text
+		// if the length of the text is too long, send a new message
+		if len(msgText) > messagesCount*4000 {
+			// edit the previous message
+			msgText2 := substr(msgText, (messagesCount-1)*4000, 4000)
+			msgText3 := telegramPrepareMarkdownMessageV1(msgText2)
+			if msgText3 != messages[messagesCount-1] {
+				msg := tgbotapi.NewEditMessageText(chatId, messageID, msgText3)
+				msg.ParseMode = "Markdown"
+				msg.DisableWebPagePreview = true
+				_, err := bot.Send(msg)
+				if err != nil {
+					log.Printf("Failed to edit message: %v", err)
+					msgText3 = strings.TrimSpace(msgText2) + "..."
+					if msgText3 != messages[messagesCount-1] {
 						msg := tgbotapi.NewEditMessageText(chatId, messageID, msgText3)
-						msg.ParseMode = "Markdown"
 						msg.DisableWebPagePreview = true
 						_, err = bot.Send(msg)
-						if err != nil {
-							log.Printf("Failed to edit message (Markdown): %v, message: %s", err, msgText2)
-							msgText3 = strings.TrimSpace(msgText2)
-							if i == len(messageIDs)-1 {
-								msgText3 += "..."
-							}
-							if msgText3 == messages[i] {
-								continue
-							}
-							msg := tgbotapi.NewEditMessageText(chatId, messageID, msgText3)
-							msg.DisableWebPagePreview = true
-							_, err = bot.Send(msg)
-							if err != nil {
-								log.Printf("Failed to edit message (Plaintext): %v, message: %s", err, msgText2)
-							}
-							messages[i] = msgText3
-						}
-						messages[i] = msgText3
+						messages[messagesCount-1] = msgText3
 					}
+				}
+			}
+			messages[messagesCount-1] = msgText3
+
+			// Create new message
+			messagesCount++
+			msgText2 = substr(msgText, (messagesCount-1)*4000, 4000)
+			msgText3 = strings.TrimSpace(telegramPrepareMarkdownMessageV1(msgText2)) + "..."
+			newMessageID, err := newMessage(msgText3, "Markdown", messageID)
+			if err != nil {
+				log.Printf("Failed to send message: %v", err)
+				msgText3 = strings.TrimSpace(msgText2) + "..."
+				newMessageID, err = newMessage(msgText3, "", messageID)
+				if err != nil {
+					log.Printf("Failed to send message: %v", err)
+				}
+				messageID = newMessageID
+				messageIDs = append(messageIDs, messageID)
+				messages = append(messages, msgText3)
+				continue
+			}
+			messageID = newMessageID
+			messageIDs = append(messageIDs, messageID)
+			messages = append(messages, msgText2)
+			continue
+		}
+
+		// Update all messages
+		for i, messageID := range messageIDs {
+			msgText2 := ""
+			msgText2 = substr(msgText, i*4000, 4000)
+			msgText3 := strings.TrimSpace(telegramPrepareMarkdownMessageV1(msgText2))
+			if i == len(messageIDs)-1 {
+				msgText3 += "..."
+			}
+			if msgText3 == messages[i] {
+				continue
+			}
+			msg := tgbotapi.NewEditMessageText(chatId, messageID, msgText3)
+			msg.ParseMode = "Markdown"
+			msg.DisableWebPagePreview = true
+			_, err = bot.Send(msg)
+			if err != nil {
+				log.Printf("Failed to edit message (Markdown): %v, message: %s", err, msgText2)
+				msgText3 = strings.TrimSpace(msgText2)
+				if i == len(messageIDs)-1 {
+					msgText3 += "..."
+				}
+				if msgText3 == messages[i] {
 					continue
 				}
-				msgText := text
-				//fmt.Println("Whole text:\n\n", msgText)
-				//fmt.Println("Whole message:\n\n", msgText)
-				// Update all messages
-				for i, messageID := range messageIDs {
-					text = substr(msgText, i*4000, 4000)
-					msgText3 := strings.TrimSpace(telegramPrepareMarkdownMessageV1(text))
-					if msgText3 == messages[i] {
-						continue
-					}
-					msg := tgbotapi.NewEditMessageText(chatId, messageID, msgText3)
-					msg.ParseMode = "Markdown"
-					msg.DisableWebPagePreview = true
-					_, err = bot.Send(msg)
-					if err != nil {
-						log.Printf("Failed to edit message (Markdown): %v, message: %s", err, text)
-						msgText3 = strings.TrimSpace(text)
-						if msgText3 == messages[i] {
-							continue
-						}
-						msg := tgbotapi.NewEditMessageText(chatId, messageID, text)
-						msg.DisableWebPagePreview = true
-						_, err = bot.Send(msg)
-						if err != nil {
-							log.Printf("Failed to edit message (Plaintext): %v, message: %s", err, text)
-						}
-					}
+				msg := tgbotapi.NewEditMessageText(chatId, messageID, msgText3)
+				msg.DisableWebPagePreview = true
+				_, err = bot.Send(msg)
+				if err != nil {
+					log.Printf("Failed to edit message (Plaintext): %v, message: %s", err, msgText2)
 				}
+				messages[i] = msgText3
 			}
+			messages[i] = msgText3
+		}
+		continue
+	}
+	msgText := text
+	// Update all messages, the last one gets the regenerate button
+	for i, messageID := range messageIDs {
+		text = substr(msgText, i*4000, 4000)
+		msgText3 := strings.TrimSpace(telegramPrepareMarkdownMessageV1(text))
+		var markup *tgbotapi.InlineKeyboardMarkup
+		if i == len(messageIDs)-1 {
+			keyboard := regenerateKeyboard()
+			markup = &keyboard
+		}
+		if msgText3 == messages[i] {
+			if markup != nil {
+				bot.Send(tgbotapi.NewEditMessageReplyMarkup(chatId, messageID, *markup))
+			}
+			continue
+		}
+		msg := tgbotapi.NewEditMessageText(chatId, messageID, msgText3)
+		msg.ParseMode = "Markdown"
+		msg.DisableWebPagePreview = true
+		msg.ReplyMarkup = markup
+		_, err = bot.Send(msg)
+		if err != nil {
+			log.Printf("Failed to edit message (Markdown): %v, message: %s", err, text)
+			msgText3 = strings.TrimSpace(text)
+			if msgText3 == messages[i] {
+				if markup != nil {
+					bot.Send(tgbotapi.NewEditMessageReplyMarkup(chatId, messageID, *markup))
+				}
+				continue
+			}
+			msg := tgbotapi.NewEditMessageText(chatId, messageID, text)
+			msg.DisableWebPagePreview = true
+			msg.ReplyMarkup = markup
+			_, err = bot.Send(msg)
+			if err != nil {
+				log.Printf("Failed to edit message (Plaintext): %v, message: %s", err, text)
+			}
+		}
+	}
+	deleteUnusedMessages(bot, chatId, messageIDs, editMessageIDs)
+	return messageIDs
+}
+
+// deleteUnusedMessages removes the edited messages that the new answer did not need
+func deleteUnusedMessages(bot *tgbotapi.BotAPI, chatId int64, messageIDs []int, editMessageIDs []int) {
+	for i := len(messageIDs); i < len(editMessageIDs); i++ {
+		if _, err := bot.Request(tgbotapi.NewDeleteMessage(chatId, editMessageIDs[i])); err != nil {
+			log.Printf("Failed to delete message: %v", err)
 		}
 	}
-	CompleteResponse(chatId)
 }
 
 func handleCommand(bot *tgbotapi.BotAPI, update tgbotapi.Update) {
 	command := update.Message.Command()
 	commandArg := update.Message.CommandArguments()
+	defer saveChat(update.Message.Chat.ID)
 	switch command {
 	case "start":
 		// Reset the conversation history for the user
 		mu.Lock()
 		model := ""
-		model = DefaultModel
+		model = defaultModel()
 		conversationHistory[update.Message.Chat.ID] = []gpt3.ChatCompletionRequestMessage{
 			{
 				Role:    "system",
 				Content: DefaultSystemPrompt,
 			},
 		}
+		resetTurnsLocked(update.Message.Chat.ID)
 		userSettingsMap[update.Message.Chat.ID] = User{
-			Model:        model,
-			SystemPrompt: DefaultSystemPrompt,
+			ConversationID:  userSettingsMap[update.Message.Chat.ID].ConversationID,
+			Model:           model,
+			SystemPrompt:    DefaultSystemPrompt,
+			SchemaTemplates: userSettingsMap[update.Message.Chat.ID].SchemaTemplates,
+			Tools:           userSettingsMap[update.Message.Chat.ID].Tools,
+			LanguageCode:    userSettingsMap[update.Message.Chat.ID].LanguageCode,
+			SearchCountry:   userSettingsMap[update.Message.Chat.ID].SearchCountry,
+			SearchLanguage:  userSettingsMap[update.Message.Chat.ID].SearchLanguage,
 		}
 		mu.Unlock()
 		msg := tgbotapi.NewMessage(update.Message.Chat.ID, "Добро пожаловать в GPT Телеграм-бот!")
 		msg.ReplyMarkup = tgbotapi.NewRemoveKeyboard(true)
 		bot.Send(msg)
 	case "new":
-		// Reset the conversation history for the user
-		mu.Lock()
-		conversationHistory[update.Message.Chat.ID] = []gpt3.ChatCompletionRequestMessage{}
-		/*
-			conversationHistory[update.Message.Chat.ID] = []gpt3.ChatCompletionRequestMessage{
-				{
-					Role:    "system",
-					Content: userSettingsMap[update.Message.Chat.ID].SystemPrompt,
-				},
-			}*/
-
-		userSettingsMap[update.Message.Chat.ID].BardChatbot.Reset()
-		mu.Unlock()
-		msg := tgbotapi.NewMessage(update.Message.Chat.ID, "История беседы очищена.")
-		msg.ReplyMarkup = tgbotapi.NewRemoveKeyboard(true)
-		bot.Send(msg)
-	case "gpt5":
-		mu.Lock()
-		userSettingsMap[update.Message.Chat.ID] = User{
-			Model: GPT54Model,
+		// Start a new conversation, the previous one stays available in /chats
+		if _, err := startConversation(update.Message.Chat.ID, commandArg); err != nil {
+			msg := tgbotapi.NewMessage(update.Message.Chat.ID, "Ошибка: "+err.Error())
+			bot.Send(msg)
+			return
 		}
-		// Reset the conversation history for the user
-		conversationHistory[update.Message.Chat.ID] = []gpt3.ChatCompletionRequestMessage{}
-		mu.Unlock()
-		msg := tgbotapi.NewMessage(update.Message.Chat.ID, "Включена модель *OpenAI GPT 5\\.4*\\.")
-		msg.ParseMode = "MarkdownV2"
+		msg := tgbotapi.NewMessage(update.Message.Chat.ID, "Начата новая беседа. Предыдущие беседы доступны в /chats.")
 		msg.ReplyMarkup = tgbotapi.NewRemoveKeyboard(true)
 		bot.Send(msg)
-	case "o4mini":
-		mu.Lock()
-		userSettingsMap[update.Message.Chat.ID] = User{
-			Model: O4MiniModel,
-		}
-		// Reset the conversation history for the user
-		conversationHistory[update.Message.Chat.ID] = []gpt3.ChatCompletionRequestMessage{}
-		mu.Unlock()
-		msg := tgbotapi.NewMessage(update.Message.Chat.ID, "Включена модель *OpenAI O4 mini*\\.")
-		msg.ParseMode = "MarkdownV2"
-		msg.ReplyMarkup = tgbotapi.NewRemoveKeyboard(true)
+	case "chats":
+		text, keyboard := conversationsKeyboard(update.Message.Chat.ID)
+		msg := tgbotapi.NewMessage(update.Message.Chat.ID, text)
+		msg.ReplyMarkup = keyboard
 		bot.Send(msg)
-	case "gpt35":
-		mu.Lock()
-		userSettingsMap[update.Message.Chat.ID] = User{
-			Model: GPT35TurboModel16k,
+	case "switch":
+		if commandArg == "" {
+			text, keyboard := conversationsKeyboard(update.Message.Chat.ID)
+			msg := tgbotapi.NewMessage(update.Message.Chat.ID, text)
+			msg.ReplyMarkup = keyboard
+			bot.Send(msg)
+			return
 		}
-		// Reset the conversation history for the user
-		conversationHistory[update.Message.Chat.ID] = []gpt3.ChatCompletionRequestMessage{
-			{
-				Role:    "system",
-				Content: userSettingsMap[update.Message.Chat.ID].SystemPrompt,
-			},
+		if err := switchConversation(update.Message.Chat.ID, strings.TrimSpace(commandArg)); err != nil {
+			msg := tgbotapi.NewMessage(update.Message.Chat.ID, "Ошибка: "+err.Error())
+			bot.Send(msg)
+			return
 		}
-		mu.Unlock()
-		msg := tgbotapi.NewMessage(update.Message.Chat.ID, "Включена модель *OpenAI GPT 3\\.5*\\.")
-		msg.ParseMode = "MarkdownV2"
-		msg.ReplyMarkup = tgbotapi.NewRemoveKeyboard(true)
+		msg := tgbotapi.NewMessage(update.Message.Chat.ID, "Беседа переключена.")
 		bot.Send(msg)
-	case "bard":
-		if !contains(config.BardAllowedUsers, update.Message.From.UserName) {
-			msg := tgbotapi.NewMessage(update.Message.Chat.ID, "Вам нельзя пользоваться моделью *Google Bard*\\.")
-			msg.ParseMode = "MarkdownV2"
+	case "rename":
+		title := strings.TrimSpace(commandArg)
+		if title == "" {
+			msg := tgbotapi.NewMessage(update.Message.Chat.ID, "Укажите новое название беседы: /rename <название>")
 			bot.Send(msg)
 			return
 		}
 		mu.Lock()
-		chatbot := BardNewChatbot(config.BardSession)
-		if chatbot == nil {
-			msg := tgbotapi.NewMessage(update.Message.Chat.ID, "Не удалось включить модель *Google Bard*\\.")
-			msg.ParseMode = "MarkdownV2"
+		conversationID := userSettingsMap[update.Message.Chat.ID].ConversationID
+		mu.Unlock()
+		if err := renameConversation(update.Message.Chat.ID, conversationID, title); err != nil {
+			msg := tgbotapi.NewMessage(update.Message.Chat.ID, "Ошибка: "+err.Error())
 			bot.Send(msg)
 			return
 		}
-		userSettingsMap[update.Message.Chat.ID] = User{
-			Model:       BardModel,
-			BardChatbot: chatbot,
-		}
-		// Reset the conversation history for the user
-		conversationHistory[update.Message.Chat.ID] = []gpt3.ChatCompletionRequestMessage{}
-		mu.Unlock()
-		msg := tgbotapi.NewMessage(update.Message.Chat.ID, `Включена модель *Google Bard* \(`+telegramPrepareMarkdownMessageV2(chatbot.sessionBl)+`\)\.`)
-		msg.ParseMode = "MarkdownV2"
-		msg.ReplyMarkup = tgbotapi.NewRemoveKeyboard(true)
-		_, err := bot.Send(msg)
-		_ = err
-	case "dalle":
-		mu.Lock()
-		userSettingsMap[update.Message.Chat.ID] = User{
-			Model: DalleModel,
-		}
-		mu.Unlock()
-		msg := tgbotapi.NewMessage(update.Message.Chat.ID, "Включена модель *OpenAI DALL\\-E 3*\\.")
-		msg.ParseMode = "MarkdownV2"
-		msg.ReplyMarkup = tgbotapi.NewRemoveKeyboard(true)
+		msg := tgbotapi.NewMessage(update.Message.Chat.ID, "Беседа переименована: "+title)
 		bot.Send(msg)
-	case "midjourney":
+	case "delete":
 		mu.Lock()
-		userSettingsMap[update.Message.Chat.ID] = User{
-			Model: MidjourneyModel,
-		}
+		conversationID := userSettingsMap[update.Message.Chat.ID].ConversationID
 		mu.Unlock()
-		msg := tgbotapi.NewMessage(update.Message.Chat.ID, "Включена модель *Midjourney*\\.")
-		msg.ParseMode = "MarkdownV2"
-		msg.ReplyMarkup = tgbotapi.NewRemoveKeyboard(true)
+		if commandArg != "" {
+			conversationID = strings.TrimSpace(commandArg)
+		}
+		if err := deleteConversation(update.Message.Chat.ID, conversationID); err != nil {
+			msg := tgbotapi.NewMessage(update.Message.Chat.ID, "Ошибка: "+err.Error())
+			bot.Send(msg)
+			return
+		}
+		msg := tgbotapi.NewMessage(update.Message.Chat.ID, "Беседа удалена.")
 		bot.Send(msg)
+	case "model":
+		handleModelCommand(bot, update.Message)
+	case "schema":
+		handleSchemaCommand(bot, update.Message)
+	case "tools":
+		handleToolsCommand(bot, update.Message)
+	case "search_locale":
+		handleSearchLocaleCommand(bot, update.Message)
 	case "retry":
-		break
-		// Retry the last message
-		// mu.Lock()
-		// lastMessage := conversationHistory[update.Message.Chat.ID][len(conversationHistory[update.Message.Chat.ID])-2]
-		// conversationHistory[update.Message.Chat.ID] = conversationHistory[update.Message.Chat.ID][:len(conversationHistory[update.Message.Chat.ID])-2]
-		// model := userSettingsMap[update.Message.Chat.ID].Model
-		// if model == "" {
-		// 	model = DefaultModel
-		// }
-		// mu.Unlock()
-		// generatedText, err := generateTextWithGPT(lastMessage.Content, update.Message.Chat.ID, model)
-		// if err != nil {
-		// 	log.Printf("Failed to generate text with GPT: %v", err)
-		// 	return
-		// }
-		// msg := tgbotapi.NewMessage(update.Message.Chat.ID, generatedText)
-		// msg.ReplyToMessageID = update.Message.MessageID
-		// msg.ReplyMarkup = tgbotapi.NewRemoveKeyboard(true)
-		// bot.Send(msg)
+		regenerateLastReply(bot, update.Message.Chat.ID, false)
 	case "stop":
 		mu.Lock()
-		user := userSettingsMap[update.Message.Chat.ID]
-		if user.CurrentContext != nil {
+		busy := generating[update.Message.Chat.ID]
+		mu.Unlock()
+		if busy {
 			CompleteResponse(update.Message.Chat.ID)
 		}
-		mu.Unlock()
 	case "system_prompt":
 		if commandArg == "" {
 			mu.Lock()
-			userSettingsMap[update.Message.Chat.ID] = User{
-				Model:        userSettingsMap[update.Message.Chat.ID].Model,
-				SystemPrompt: userSettingsMap[update.Message.Chat.ID].SystemPrompt,
-				State:        StateWaitingForSystemPrompt,
-			}
+			user := userSettingsMap[update.Message.Chat.ID]
+			user.State = StateWaitingForSystemPrompt
+			userSettingsMap[update.Message.Chat.ID] = user
 			mu.Unlock()
 			msg := tgbotapi.NewMessage(update.Message.Chat.ID, "Напишите системный промпт.")
 			msg.ReplyMarkup = tgbotapi.NewRemoveKeyboard(true)
@@ -1387,10 +1480,10 @@ func handleCommand(bot *tgbotapi.BotAPI, update tgbotapi.Update) {
 			return
 		}
 		mu.Lock()
-		userSettingsMap[update.Message.Chat.ID] = User{
-			Model:        userSettingsMap[update.Message.Chat.ID].Model,
-			SystemPrompt: commandArg,
-		}
+		user := userSettingsMap[update.Message.Chat.ID]
+		user.SystemPrompt = commandArg
+		user.State = StateDefault
+		userSettingsMap[update.Message.Chat.ID] = user
 
 		conversationHistory[update.Message.Chat.ID] = []gpt3.ChatCompletionRequestMessage{
 			{
@@ -1398,6 +1491,7 @@ func handleCommand(bot *tgbotapi.BotAPI, update tgbotapi.Update) {
 				Content: commandArg,
 			},
 		}
+		resetTurnsLocked(update.Message.Chat.ID)
 
 		mu.Unlock()
 		msg := tgbotapi.NewMessage(update.Message.Chat.ID, fmt.Sprintf("Установлен системный промпт: %s", commandArg))
@@ -1408,97 +1502,34 @@ func handleCommand(bot *tgbotapi.BotAPI, update tgbotapi.Update) {
 	}
 }
 
-func generateTextWithGPT(inputText string, chatID int64, model string) (string, error) {
-	// Add the user's message to the conversation history
-	conversationHistory[chatID] = append(conversationHistory[chatID], gpt3.ChatCompletionRequestMessage{
-		Role:    "user",
-		Content: inputText,
-	})
-
-	temp := float32(0.7)
-	maxTokens := 4096
-	if model == GPT4Model || model == GPT4Model0613 {
-		maxTokens = 8192
-	}
-	if model == GPT45PreviewModel {
-		maxTokens = 16000
-	}
-	if model == O4MiniModel || model == GPT54Model {
-		maxTokens = 128000
-	}
-	e, err := tokenizer.NewEncoder()
-	if err != nil {
-		return "", fmt.Errorf("failed to create encoder: %w", err)
-	}
-	totalTokens := 0
-	if model != GPT45PreviewModel && model != O4MiniModel {
-		for _, message := range conversationHistory[chatID] {
-			if message.Content.(string) == "" {
-				continue
-			}
-			q, err := e.Encode(message.Content.(string))
-			if err != nil {
-				return "", fmt.Errorf("failed to encode message: %w", err)
-			}
-			totalTokens += len(q)
-			q, err = e.Encode(message.Role)
-			if err != nil {
-				return "", fmt.Errorf("failed to encode message: %w", err)
-			}
-			totalTokens += len(q)
-		}
-	}
-	maxTokens -= totalTokens
-	request := gpt3.ChatCompletionRequest{
-		Model:       model,
-		Messages:    conversationHistory[chatID],
-		Temperature: &temp,
-		MaxTokens:   maxTokens,
-		TopP:        1,
-	}
-	ctx := context.Background()
-
-	// Call the OpenAI API
-	var response *gpt3.ChatCompletionResponse
-	//if model == GPT4Model || model == GPT4BrowsingModel {
-	//	response, err = openaiClientGPT4.ChatCompletion(ctx, request)
-	//} else {
-	response, err = openaiClient.ChatCompletion(ctx, request)
-	//}
-	if err != nil {
-		return "", fmt.Errorf("failed to call OpenAI API: %w", err)
+// generateTextStream adds the message to the conversation and streams the answer of the model.
+// Function calls requested by the model are executed and their results are sent back to it
+// until the model answers with text.
+func generateTextStream(inputText string, chatID int64, model string) (chan string, error) {
+	spec := modelRegistry.Get(model)
+	if _, err := chatProviderForModel(spec); err != nil {
+		return nil, err
 	}
-
-	// Get the generated text
-	generatedText := response.Choices[0].Message.Content
-	generatedText = strings.TrimSpace(generatedText)
-
-	// Add the AI's response to the conversation history
-	conversationHistory[chatID] = append(conversationHistory[chatID], gpt3.ChatCompletionRequestMessage{
-		Role:    "assistant",
-		Content: generatedText,
-	})
-
-	return generatedText, nil
-}
-
-func generateTextStreamWithGPT(inputText string, chatID int64, model string) (chan string, error) {
 	// Add the user's message to the conversation history
+	mu.Lock()
+	if switching[chatID] {
+		mu.Unlock()
+		return nil, errors.New("дождитесь окончания переключения беседы")
+	}
+	generating[chatID] = true
 	conversationHistory[chatID] = append(conversationHistory[chatID], gpt3.ChatCompletionRequestMessage{
 		Role:    "user",
 		Content: inputText,
 	})
+	user := userSettingsMap[chatID]
+	delete(codeFiles, chatID)
+	mu.Unlock()
 	conversationFunctions := []gpt3.ChatCompletionRequestFunction{}
 
-	e, err := tokenizer.NewEncoder()
-	if err != nil {
-		return nil, fmt.Errorf("failed to create encoder: %w", err)
-	}
-
 	totalTokensForFunctions := 0
-	if model != O4MiniModel {
+	if spec.Tools || spec.modelForConversation(true).Tools {
 		for _, function := range functions {
-			if function.Active == 0 || function.Default == 0 {
+			if !toolEnabled(user, function) {
 				continue
 			}
 			conversationFunction := gpt3.ChatCompletionRequestFunction{}
@@ -1509,114 +1540,49 @@ func generateTextStreamWithGPT(inputText string, chatID int64, model string) (ch
 				Properties: function.Args.Properties,
 				Required:   function.Args.Required,
 			}
-			conversationFunction.FunctionCall = "auto"
 			conversationFunctions = append(conversationFunctions, conversationFunction)
-
-			functionS, _ := json.Marshal(conversationFunction)
-			q, err := e.Encode(string(functionS))
-			if err != nil {
-				return nil, fmt.Errorf("failed to encode message: %w", err)
-			}
-			totalTokensForFunctions += len(q)
 		}
-	}
-	temp := float32(1)
-	request := gpt3.ChatCompletionRequest{
-		Model:       model,
-		Messages:    conversationHistory[chatID],
-		Temperature: &temp,
-		TopP:        1,
-	}
-	if model == O4MiniModel || model == GPT54Model {
-		request.Temperature = nil
-		request.ReasoningEffort = "medium"
-		request.MaxCompletionTokens = 90000
+		totalTokensForFunctions = tokenCounter.CountFunctions(model, conversationFunctions)
 	}
 
 	ctx, cancel := context.WithTimeout(context.Background(), time.Duration(1000*time.Minute))
 	mu.Lock()
-	user := userSettingsMap[chatID]
+	user = userSettingsMap[chatID]
 	user.CurrentContext = &cancel
+	userSettingsMap[chatID] = user
+	schema := user.ResponseSchema
 	mu.Unlock()
 	response := make(chan string)
-	// Call the OpenAI API
 	go func() {
-		var err error
-		/*
-			if model == GPT4Model || model == GPT4BrowsingModel {
-				maxTokens := 8192
-
-				totalTokens := 0
-				for _, message := range conversationHistory[chatID] {
-					q, err := e.Encode(message.Content)
-					if err != nil {
-						return // nil, fmt.Errorf("failed to encode message: %w", err)
-					}
-					totalTokens += len(q)
-					q, err = e.Encode(message.Role)
-					if err != nil {
-						return // nil, fmt.Errorf("failed to encode message: %w", err)
-					}
-					totalTokens += len(q)
-				}
-				maxTokens -= totalTokens + 100
-				request.MaxTokens = maxTokens
-
-				err = openaiClientGPT4.ChatCompletionStream(ctx, request, func(completion *gpt3.ChatCompletionStreamResponse) {
-					log.Printf("Received completion: %v\n", completion)
-					response <- completion.Choices[0].Delta.Content
-					mu.Lock()
-					user := userSettingsMap[chatID]
-					user.CurrentMessageBuffer += completion.Choices[0].Delta.Content
-					userSettingsMap[chatID] = user
-					mu.Unlock()
-					if completion.Choices[0].FinishReason != "" {
-						mu.Lock()
-						user := userSettingsMap[chatID]
-						if user.Model == GPT4BrowsingModel {
-							user.CurrentMessageBuffer = GPT4BrowsingReplaceMetadata(user.CurrentMessageBuffer, true)
-						}
-						userSettingsMap[chatID] = user
-						mu.Unlock()
-						CompleteResponse(chatID)
-						close(response)
-					}
-				})
-			} else {
-		*/
-		functionCallHistory := make(map[string]bool)
+		defer close(response)
+		// The answer is in the history before the chat is free again
+		defer func() {
+			mu.Lock()
+			delete(generating, chatID)
+			mu.Unlock()
+		}()
+		defer CompleteResponse(chatID)
+
+		toolCallHistory := make(map[string]bool)
 		for {
-			maxTokens := 4096
-			if model == GPT4Model || model == GPT4Model0613 {
-				maxTokens = 8192
-			} else if model == GPT35TurboModel16k {
-				maxTokens = 16000
-			} else if model == GPT45PreviewModel {
-				maxTokens = 16000
-			} else if model == O4MiniModel {
-				maxTokens = 24000
-			} else if model == GPT54Model {
-				maxTokens = 128000
+			compacted, compactErr := compactHistoryIfNeeded(ctx, chatID, model, spec.ContextWindow, totalTokensForFunctions)
+			if compactErr != nil {
+				log.Printf("Failed to compact history: %v", compactErr)
+			} else if compacted {
+				response <- "ℹ️ Старая часть беседы заменена кратким содержанием.\n\n"
 			}
-			totalTokens := 0
+			mu.Lock()
+			history := append([]gpt3.ChatCompletionRequestMessage{}, conversationHistory[chatID]...)
+			mu.Unlock()
+			totalTokens := tokenCounter.CountMessages(model, history)
 			images := []gpt3.ChatCompletionRequestContentEntryImage{}
 			imageFound := false
 			messages := []gpt3.ChatCompletionRequestMessage{}
 
-			for _, message := range conversationHistory[chatID] {
+			// Photos are stored as separate messages, attach them to the user message that follows
+			for _, message := range upgradeFunctionCalls(history) {
 				switch message.Content.(type) {
 				case string:
-					q, err := e.Encode(message.Content.(string))
-					if err != nil {
-						return // nil, fmt.Errorf("failed to encode message: %w", err)
-					}
-					totalTokens += len(q)
-					q, err = e.Encode(message.Role)
-					if err != nil {
-						return // nil, fmt.Errorf("failed to encode message: %w", err)
-					}
-					totalTokens += len(q)
-
 					if len(images) > 0 {
 						messages = append(messages, gpt3.ChatCompletionRequestMessage{
 							Role: message.Role,
@@ -1636,176 +1602,144 @@ func generateTextStreamWithGPT(inputText string, chatID int64, model string) (ch
 					}
 				default:
 					imageFound = true
-					images = append(images, message.Content.([]interface{})[0].(gpt3.ChatCompletionRequestContentEntryImage))
-				}
-			}
-			maxTokens -= totalTokens + totalTokensForFunctions + 100
-
-			if model == GPT45PreviewModel || model == GPT54Model {
-				if imageFound {
-					request.Model = GPT54Model
-					//request.Functions = nil
-					maxTokens = 16384
-					//request.MaxTokens = 16384
-					if model == GPT54Model {
-						request.Functions = conversationFunctions
-						request.MaxCompletionTokens = maxTokens
-					} else {
-						request.Functions = conversationFunctions
-						request.MaxTokens = maxTokens
-					}
-				} else {
-					if model == GPT54Model {
-						request.Functions = conversationFunctions
-						request.MaxCompletionTokens = maxTokens
+					content := message.Content.([]interface{})
+					if image, ok := content[0].(gpt3.ChatCompletionRequestContentEntryImage); ok && len(content) == 1 {
+						images = append(images, image)
 					} else {
-						request.Functions = conversationFunctions
-						request.MaxTokens = maxTokens
+						// Images of tools come with their own text
+						messages = append(messages, message)
 					}
 				}
-			} else {
-				if maxTokens < 10 {
-					response <- "Ошибка: закончился размер контекста, использовано " + fmt.Sprint(totalTokens+totalTokensForFunctions) + " токенов.\n\n"
-					break
+			}
+			if schema != nil {
+				instruction := schema.instruction()
+				messages = append([]gpt3.ChatCompletionRequestMessage{instruction}, messages...)
+				totalTokens += tokenCounter.CountMessage(model, instruction)
+			}
+			requestSpec := spec.modelForConversation(imageFound)
+			provider, err := chatProviderForModel(requestSpec)
+			if err != nil {
+				response <- "Ошибка: " + err.Error() + "\n\n"
+				return
+			}
+			maxTokens := requestSpec.ContextWindow - (totalTokens + totalTokensForFunctions + 100)
+			if maxTokens < 10 {
+				response <- "Ошибка: закончился размер контекста, использовано " + fmt.Sprint(totalTokens+totalTokensForFunctions) + " токенов.\n\n"
+				return
+			}
+			if requestSpec.MaxOutputTokens > 0 && requestSpec.MaxOutputTokens < maxTokens {
+				maxTokens = requestSpec.MaxOutputTokens
+			}
+			request := ChatRequest{
+				Spec:      requestSpec,
+				Messages:  messages,
+				MaxTokens: maxTokens,
+			}
+			if requestSpec.Tools {
+				request.Functions = conversationFunctions
+			}
+			if schema != nil {
+				request.ResponseFormat = schema.responseFormat()
+			}
+			if requestSpec.API == APIResponses {
+				mu.Lock()
+				chain := activeConversationLocked(chatID).ResponseChain
+				mu.Unlock()
+				if previous := chain.continues(requestSpec.Name, messages); previous > 0 {
+					request.PreviousResponseID = chain.ID
+					request.PreviousMessages = previous
 				}
 			}
-			request.Messages = messages
-			functionCallName := ""
-			functionCallArgs := ""
-			j, _ := json.Marshal(request)
-			fmt.Println(string(j))
-			finishReason := ""
-			if model == O4MiniModel {
-				completion, err2 := openaiClient.ChatCompletion(ctx, request)
-				_ = err2
-				js, _ := json.Marshal(completion)
-				if err2 == nil && len(completion.Choices) > 0 {
-					log.Printf("Received completion: %v\n", string(js))
-					// if completion.Choices[0].Delta.Content == "" &&
-					// 	completion.Choices[0].FinishReason == "" {
-					// 	time.Sleep(5000 * time.Millisecond)
-					// 	return
-					// }
-
-					if completion.Choices[0].Message.Content != "" {
-						response <- completion.Choices[0].Message.Content
-					}
-					mu.Lock()
-					user := userSettingsMap[chatID]
-					user.CurrentMessageBuffer += completion.Choices[0].Message.Content
-					userSettingsMap[chatID] = user
-					mu.Unlock()
-					finishReason = completion.Choices[0].FinishReason
-					if completion.Choices[0].FinishReason != "" /* || completion.Choices[0].Delta.Content == ""*/ {
-						mu.Lock()
-						user := userSettingsMap[chatID]
-						userSettingsMap[chatID] = user
-						mu.Unlock()
-						CompleteResponse(chatID)
-						close(response)
+
+			// Reasoning is shown before the answer text but is not stored in the history
+			reasoning := false
+			result, err := provider.StreamChat(ctx, request, func(delta ChatDelta) {
+				if delta.Reasoning != "" {
+					if !reasoning {
+						reasoning = true
+						response <- "💭 "
 					}
+					response <- delta.Reasoning
 				}
-			} else {
-				err = openaiClient.ChatCompletionStream(ctx, request, func(completion *gpt3.ChatCompletionStreamResponse) {
-					js, _ := json.Marshal(completion)
-					if len(completion.Choices) > 0 {
-						log.Printf("Received completion: %v\n", string(js))
-						// if completion.Choices[0].Delta.Content == "" &&
-						// 	completion.Choices[0].FinishReason == "" {
-						// 	time.Sleep(5000 * time.Millisecond)
-						// 	return
-						// }
-						if completion.Choices[0].Delta.FunctionCall.Name != "" ||
-							completion.Choices[0].Delta.FunctionCall.Arguments != "" {
-							functionCallName += completion.Choices[0].Delta.FunctionCall.Name
-							functionCallArgs += completion.Choices[0].Delta.FunctionCall.Arguments
-						} else {
-							if completion.Choices[0].Delta.Content != "" {
-								response <- completion.Choices[0].Delta.Content
-							}
-						}
-						mu.Lock()
-						user := userSettingsMap[chatID]
-						user.CurrentMessageBuffer += completion.Choices[0].Delta.Content
-						userSettingsMap[chatID] = user
-						mu.Unlock()
-						finishReason = completion.Choices[0].FinishReason
-						if completion.Choices[0].FinishReason != "" /* || completion.Choices[0].Delta.Content == ""*/ {
-							if functionCallName != "" {
-								conversationHistory[chatID] = append(conversationHistory[chatID], gpt3.ChatCompletionRequestMessage{
-									Role:    "assistant",
-									Content: "",
-									FunctionCall: gpt3.ChatCompletionResponseFunctionCall{
-										Name:      functionCallName,
-										Arguments: functionCallArgs,
-									},
-								})
-								response <- functionCallName + "(" + functionCallArgs + ")\n\n"
-							} else {
-								mu.Lock()
-								user := userSettingsMap[chatID]
-								userSettingsMap[chatID] = user
-								mu.Unlock()
-								CompleteResponse(chatID)
-								close(response)
-							}
-						}
-					}
-				})
-			}
-			if finishReason == "" {
+				if delta.Text == "" {
+					return
+				}
+				if reasoning {
+					reasoning = false
+					response <- "\n\n"
+				}
+				response <- delta.Text
 				mu.Lock()
 				user := userSettingsMap[chatID]
+				user.CurrentMessageBuffer += delta.Text
 				userSettingsMap[chatID] = user
 				mu.Unlock()
-				CompleteResponse(chatID)
-				close(response)
-			}
+			})
 			if err != nil && strings.Contains(err.Error(), "429:tokens") {
 				delay := 10 * time.Second
 				log.Printf("Rate limit reached, waiting %v\n", delay)
 				time.Sleep(delay)
 				continue
 			}
-			if functionCallName != "" {
-				if functionCallHistory[functionCallName+functionCallArgs] {
-					output := "Ошибка вызова функции: повторный вызов функции с одними и теми же аргументами"
-					functionCallHistory[functionCallName+functionCallArgs] = true
-					response <- output + "\n\n"
-					conversationHistory[chatID] = append(conversationHistory[chatID], gpt3.ChatCompletionRequestMessage{
-						Role:    "function",
-						Content: output,
-						Name:    functionCallName,
-					})
-					functionCallName = ""
-					functionCallArgs = ""
-					continue
+			if err != nil && request.PreviousResponseID != "" && result.Text == "" && ctx.Err() == nil {
+				// The stored answer could have expired, send the whole history instead
+				log.Printf("Failed to continue response %s, sending the whole history: %v", request.PreviousResponseID, err)
+				mu.Lock()
+				activeConversationLocked(chatID).ResponseChain = nil
+				mu.Unlock()
+				continue
+			}
+			if err != nil {
+				if ctx.Err() == nil {
+					log.Printf("Failed to generate answer with %s: %v", requestSpec.Name, err)
+					response <- "failed to call API: " + err.Error()
 				}
-				output, err := CallFunction(functionCallName, functionCallArgs)
-				functionCallHistory[functionCallName+functionCallArgs] = true
-				if err != nil {
-					response <- "Ошибка вызова функции: " + err.Error() + "\n\n"
-				} else {
-					//response <- output + "\n\n"
-					conversationHistory[chatID] = append(conversationHistory[chatID], gpt3.ChatCompletionRequestMessage{
-						Role:    "function",
-						Content: output,
-						Name:    functionCallName,
-					})
-					functionCallName = ""
-					functionCallArgs = ""
+				return
+			}
+			log.Printf("Usage of %s in chat %d: %d prompt, %d completion tokens", requestSpec.Name, chatID,
+				result.Usage.PromptTokens, result.Usage.CompletionTokens)
+			if result.ResponseID != "" {
+				mu.Lock()
+				activeConversationLocked(chatID).ResponseChain = &ResponseChain{
+					ID:     result.ResponseID,
+					Model:  requestSpec.Name,
+					Length: len(messages),
+					Hash:   hashMessages(messages),
 				}
-			} else {
-				break
+				mu.Unlock()
 			}
-		}
-		if err != nil {
-			// if response open, close it
-			if _, ok := <-response; ok {
-				response <- "failed to call OpenAI API: " + err.Error()
-				close(response)
+			if len(result.ToolCalls) == 0 {
+				return
+			}
+
+			// The text of the answer so far belongs to the message with the tool calls
+			mu.Lock()
+			conversationHistory[chatID] = append(conversationHistory[chatID], gpt3.ChatCompletionRequestMessage{
+				Role:      "assistant",
+				Content:   strings.TrimSpace(result.Text),
+				ToolCalls: result.ToolCalls,
+			})
+			user := userSettingsMap[chatID]
+			user.CurrentMessageBuffer = ""
+			userSettingsMap[chatID] = user
+			mu.Unlock()
+			for _, toolCall := range result.ToolCalls {
+				response <- formatToolCall(toolCall) + "\n\n"
+			}
+
+			mu.Lock()
+			filesBefore := len(codeFiles[chatID])
+			mu.Unlock()
+			results := executeToolCalls(FunctionContext{ChatID: chatID, Model: requestSpec}, result.ToolCalls, toolCallHistory)
+			if failures := toolCallErrors(results); failures != "" {
+				response <- failures + "\n\n"
+			}
+			mu.Lock()
+			conversationHistory[chatID] = append(conversationHistory[chatID], results...)
+			if message, ok := codeImagesMessage(codeFiles[chatID][filesBefore:]); ok && spec.acceptsImages() {
+				conversationHistory[chatID] = append(conversationHistory[chatID], message)
 			}
-			// return nil, fmt.Errorf("failed to call OpenAI API: %w", err)
+			mu.Unlock()
 		}
 	}()
 
@@ -1817,6 +1751,10 @@ func CompleteResponse(chatID int64) {
 	user := userSettingsMap[chatID]
 	generatedText := user.CurrentMessageBuffer
 	user.CurrentMessageBuffer = ""
+	if user.CurrentContext != nil {
+		(*user.CurrentContext)()
+		user.CurrentContext = nil
+	}
 	userSettingsMap[chatID] = user
 
 	// Get the generated text
@@ -1829,12 +1767,6 @@ func CompleteResponse(chatID int64) {
 			Content: generatedText,
 		})
 	}
-
-	if user.CurrentContext == nil {
-		mu.Unlock()
-		return
-	}
-	(*user.CurrentContext)()
-	user.CurrentContext = nil
 	mu.Unlock()
+	saveChat(chatID)
 }
@@ -0,0 +1,63 @@
+package mcp
+
+import (
+	"net/http"
+	"time"
+)
+
+// ClientOption are options that can be passed when creating a new client
+type ClientOption func(*client) error
+
+// WithClientInfo is a client option that allows you to override the name and version the client
+// introduces itself with
+func WithClientInfo(name string, version string) ClientOption {
+	return func(c *client) error {
+		c.clientInfo = Implementation{Name: name, Version: version}
+		return nil
+	}
+}
+
+// WithEnv is a client option that adds environment variables ("KEY=value") to the server process.
+// The process inherits the environment of the bot.
+func WithEnv(env []string) ClientOption {
+	return func(c *client) error {
+		c.env = append([]string{}, env...)
+		return nil
+	}
+}
+
+// WithDir is a client option that sets the working directory of the server process
+func WithDir(dir string) ClientOption {
+	return func(c *client) error {
+		c.dir = dir
+		return nil
+	}
+}
+
+// WithHeaders is a client option that adds headers to every HTTP request, e.g. Authorization
+func WithHeaders(headers map[string]string) ClientOption {
+	return func(c *client) error {
+		c.headers = make(map[string]string, len(headers))
+		for key, value := range headers {
+			c.headers[key] = value
+		}
+		return nil
+	}
+}
+
+// WithHTTPClient allows you to override the internal http.Client used
+func WithHTTPClient(httpClient *http.Client) ClientOption {
+	return func(c *client) error {
+		c.httpClient = httpClient
+		return nil
+	}
+}
+
+// WithTimeout is a client option that allows you to override the default timeout of HTTP requests.
+// If you are overriding the http client as well, just include the timeout there.
+func WithTimeout(timeout time.Duration) ClientOption {
+	return func(c *client) error {
+		c.httpClient.Timeout = timeout
+		return nil
+	}
+}
@@ -0,0 +1,140 @@
+package mcp
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"strings"
+	"sync"
+)
+
+// httpTransport posts every message to the streamable HTTP endpoint of the server, the response
+// comes as JSON or as a stream of server-sent events
+type httpTransport struct {
+	url        string
+	headers    map[string]string
+	httpClient *http.Client
+
+	mu              sync.Mutex
+	sessionID       string
+	protocolVersion string
+}
+
+func (t *httpTransport) setProtocolVersion(version string) {
+	t.mu.Lock()
+	t.protocolVersion = version
+	t.mu.Unlock()
+}
+
+func (t *httpTransport) newRequest(ctx context.Context, method string, body io.Reader) (*http.Request, error) {
+	req, err := http.NewRequestWithContext(ctx, method, t.url, body)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Accept", "application/json, text/event-stream")
+	t.mu.Lock()
+	if t.sessionID != "" {
+		req.Header.Set("Mcp-Session-Id", t.sessionID)
+	}
+	if t.protocolVersion != "" {
+		req.Header.Set("MCP-Protocol-Version", t.protocolVersion)
+	}
+	t.mu.Unlock()
+	for key, value := range t.headers {
+		req.Header.Set(key, value)
+	}
+	return req, nil
+}
+
+func (t *httpTransport) send(ctx context.Context, request *Request) (*message, error) {
+	data, err := json.Marshal(request)
+	if err != nil {
+		return nil, err
+	}
+	req, err := t.newRequest(ctx, http.MethodPost, bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	resp, err := t.httpClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if sessionID := resp.Header.Get("Mcp-Session-Id"); sessionID != "" {
+		t.mu.Lock()
+		t.sessionID = sessionID
+		t.mu.Unlock()
+	}
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		body, _ := io.ReadAll(io.LimitReader(resp.Body, 4096))
+		if resp.StatusCode == http.StatusNotFound && req.Header.Get("Mcp-Session-Id") != "" {
+			// The server forgot the session, it has to be initialized again
+			return nil, fmt.Errorf("%w: session expired", ErrClosed)
+		}
+		return nil, fmt.Errorf("mcp: HTTP %d: %s", resp.StatusCode, strings.TrimSpace(string(body)))
+	}
+	if request.ID == nil {
+		return nil, nil
+	}
+
+	id := fmt.Sprint(*request.ID)
+	mediaType, _, _ := mime.ParseMediaType(resp.Header.Get("Content-Type"))
+	if mediaType != "text/event-stream" {
+		msg := new(message)
+		if err := json.NewDecoder(resp.Body).Decode(msg); err != nil {
+			return nil, fmt.Errorf("invalid json response: %w", err)
+		}
+		return msg, nil
+	}
+
+	// The response is one of the events, the others are notifications and requests of the server
+	reader := bufio.NewReader(resp.Body)
+	event := bytes.Buffer{}
+	for {
+		line, err := reader.ReadBytes('\n')
+		trimmed := bytes.TrimRight(line, "\r\n")
+		if bytes.HasPrefix(trimmed, []byte("data:")) {
+			event.Write(bytes.TrimPrefix(bytes.TrimPrefix(trimmed, []byte("data:")), []byte(" ")))
+			event.WriteByte('\n')
+		}
+		if (len(trimmed) == 0 || err == io.EOF) && event.Len() > 0 {
+			msg := new(message)
+			if json.Unmarshal(event.Bytes(), msg) == nil && msg.Method == "" && string(msg.ID) == id {
+				return msg, nil
+			}
+			event.Reset()
+		}
+		if err == io.EOF {
+			return nil, fmt.Errorf("%w: no response in the event stream", ErrClosed)
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+}
+
+// close ends the session on the server
+func (t *httpTransport) close() error {
+	t.mu.Lock()
+	sessionID := t.sessionID
+	t.mu.Unlock()
+	if sessionID == "" {
+		return nil
+	}
+	req, err := t.newRequest(context.Background(), http.MethodDelete, nil)
+	if err != nil {
+		return err
+	}
+	resp, err := t.httpClient.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	return nil
+}
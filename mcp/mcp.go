@@ -0,0 +1,164 @@
+// Package mcp is a client of Model Context Protocol servers (modelcontextprotocol.io) that run as
+// local processes (stdio) or behind a URL (streamable HTTP)
+package mcp
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"sync/atomic"
+	"time"
+)
+
+const defaultTimeout = 5 * time.Minute
+
+// ErrClosed is returned when the connection to the server is closed, e.g. the process exited
+var ErrClosed = errors.New("mcp: connection closed")
+
+// A Client is a connection to an MCP server
+type Client interface {
+	// Initialize negotiates the protocol version, it must be called before the other methods
+	Initialize(ctx context.Context) (*InitializeResult, error)
+
+	// ListTools returns all tools of the server
+	ListTools(ctx context.Context) ([]Tool, error)
+
+	// CallTool calls the tool with the arguments given as a JSON object
+	CallTool(ctx context.Context, name string, arguments json.RawMessage) (*CallToolResult, error)
+
+	// Close ends the session and stops the server process
+	Close() error
+}
+
+// transport delivers the JSON-RPC messages to the server
+type transport interface {
+	// send sends the request and waits for its response, notifications have no response
+	send(ctx context.Context, request *Request) (*message, error)
+	close() error
+}
+
+type client struct {
+	transport  transport
+	nextID     int64
+	clientInfo Implementation
+
+	// Options of the transports
+	env        []string
+	dir        string
+	headers    map[string]string
+	httpClient *http.Client
+}
+
+func newClient(options []ClientOption) (*client, error) {
+	c := &client{
+		clientInfo: Implementation{Name: "chat_bot", Version: "1.0"},
+		httpClient: &http.Client{
+			Timeout: defaultTimeout,
+		},
+	}
+	for _, o := range options {
+		if err := o(c); err != nil {
+			return nil, err
+		}
+	}
+	return c, nil
+}
+
+// NewStdioClient starts the server process, the messages are exchanged through its stdin and stdout
+func NewStdioClient(command string, args []string, options ...ClientOption) (Client, error) {
+	c, err := newClient(options)
+	if err != nil {
+		return nil, err
+	}
+	c.transport, err = newStdioTransport(command, args, c.env, c.dir)
+	if err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// NewHTTPClient returns a client of the server at the URL of its streamable HTTP endpoint
+func NewHTTPClient(url string, options ...ClientOption) (Client, error) {
+	c, err := newClient(options)
+	if err != nil {
+		return nil, err
+	}
+	c.transport = &httpTransport{
+		url:        url,
+		headers:    c.headers,
+		httpClient: c.httpClient,
+	}
+	return c, nil
+}
+
+func (c *client) call(ctx context.Context, method string, params interface{}, result interface{}) error {
+	id := atomic.AddInt64(&c.nextID, 1)
+	response, err := c.transport.send(ctx, &Request{JSONRPC: "2.0", ID: &id, Method: method, Params: params})
+	if err != nil {
+		return err
+	}
+	if response.Error != nil {
+		return response.Error
+	}
+	if result == nil {
+		return nil
+	}
+	if err := json.Unmarshal(response.Result, result); err != nil {
+		return fmt.Errorf("invalid %s result: %w", method, err)
+	}
+	return nil
+}
+
+func (c *client) notify(ctx context.Context, method string, params interface{}) error {
+	_, err := c.transport.send(ctx, &Request{JSONRPC: "2.0", Method: method, Params: params})
+	return err
+}
+
+func (c *client) Initialize(ctx context.Context) (*InitializeResult, error) {
+	result := new(InitializeResult)
+	err := c.call(ctx, "initialize", InitializeParams{
+		ProtocolVersion: ProtocolVersion,
+		Capabilities:    map[string]interface{}{},
+		ClientInfo:      c.clientInfo,
+	}, result)
+	if err != nil {
+		return nil, err
+	}
+	if t, ok := c.transport.(*httpTransport); ok {
+		t.setProtocolVersion(result.ProtocolVersion)
+	}
+	if err := c.notify(ctx, "notifications/initialized", nil); err != nil {
+		return nil, err
+	}
+	return result, nil
+}
+
+func (c *client) ListTools(ctx context.Context) ([]Tool, error) {
+	tools := []Tool{}
+	cursor := ""
+	for {
+		result := new(ListToolsResult)
+		if err := c.call(ctx, "tools/list", ListToolsParams{Cursor: cursor}, result); err != nil {
+			return nil, err
+		}
+		tools = append(tools, result.Tools...)
+		if result.NextCursor == "" || result.NextCursor == cursor {
+			return tools, nil
+		}
+		cursor = result.NextCursor
+	}
+}
+
+func (c *client) CallTool(ctx context.Context, name string, arguments json.RawMessage) (*CallToolResult, error) {
+	result := new(CallToolResult)
+	if err := c.call(ctx, "tools/call", CallToolParams{Name: name, Arguments: arguments}, result); err != nil {
+		return nil, err
+	}
+	return result, nil
+}
+
+func (c *client) Close() error {
+	return c.transport.close()
+}
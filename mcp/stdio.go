@@ -0,0 +1,168 @@
+package mcp
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"os/exec"
+	"sync"
+	"time"
+)
+
+// The server gets this long to exit after its stdin is closed
+const stdioCloseTimeout = 5 * time.Second
+
+// stdioTransport exchanges newline-delimited JSON-RPC messages with the server process
+type stdioTransport struct {
+	cmd     *exec.Cmd
+	stdin   io.WriteCloser
+	writeMu sync.Mutex
+
+	mu      sync.Mutex
+	pending map[string]chan *message
+	// done is closed when the server stops responding, err tells why
+	done chan struct{}
+	err  error
+	// exited is closed when the process has exited
+	exited chan struct{}
+}
+
+func newStdioTransport(command string, args []string, env []string, dir string) (*stdioTransport, error) {
+	cmd := exec.Command(command, args...)
+	cmd.Env = append(os.Environ(), env...)
+	cmd.Dir = dir
+	// Servers write their logs to stderr
+	cmd.Stderr = os.Stderr
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		return nil, err
+	}
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return nil, err
+	}
+	if err := cmd.Start(); err != nil {
+		return nil, fmt.Errorf("failed to start %s: %w", command, err)
+	}
+	t := &stdioTransport{
+		cmd:     cmd,
+		stdin:   stdin,
+		pending: make(map[string]chan *message),
+		done:    make(chan struct{}),
+		exited:  make(chan struct{}),
+	}
+	go t.read(stdout)
+	return t, nil
+}
+
+func (t *stdioTransport) read(stdout io.Reader) {
+	reader := bufio.NewReader(stdout)
+	for {
+		line, err := reader.ReadBytes('\n')
+		if len(bytes.TrimSpace(line)) > 0 {
+			t.handle(line)
+		}
+		if err != nil {
+			t.mu.Lock()
+			t.err = fmt.Errorf("%w: %v", ErrClosed, err)
+			close(t.done)
+			t.mu.Unlock()
+			// Wait closes stdout, it can only be called when everything was read
+			t.cmd.Wait()
+			close(t.exited)
+			return
+		}
+	}
+}
+
+func (t *stdioTransport) handle(line []byte) {
+	msg := new(message)
+	if err := json.Unmarshal(line, msg); err != nil {
+		log.Printf("mcp: invalid message from the server: %v", err)
+		return
+	}
+	if msg.Method != "" {
+		// Requests of the server: only pings are supported, notifications are ignored
+		if len(msg.ID) == 0 {
+			return
+		}
+		reply := response{JSONRPC: "2.0", ID: msg.ID, Result: struct{}{}}
+		if msg.Method != "ping" {
+			reply = response{JSONRPC: "2.0", ID: msg.ID, Error: &Error{Code: -32601, Message: "method not found"}}
+		}
+		if err := t.write(reply); err != nil {
+			log.Printf("mcp: failed to answer %s: %v", msg.Method, err)
+		}
+		return
+	}
+	t.mu.Lock()
+	ch, ok := t.pending[string(msg.ID)]
+	delete(t.pending, string(msg.ID))
+	t.mu.Unlock()
+	if ok {
+		ch <- msg
+	}
+}
+
+func (t *stdioTransport) write(v interface{}) error {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	t.writeMu.Lock()
+	defer t.writeMu.Unlock()
+	// Writes fail when the process has exited, e.g. with EPIPE, possibly before the reader sees the
+	// end of stdout
+	if _, err := t.stdin.Write(append(data, '\n')); err != nil {
+		return fmt.Errorf("%w: %v", ErrClosed, err)
+	}
+	return nil
+}
+
+func (t *stdioTransport) send(ctx context.Context, request *Request) (*message, error) {
+	select {
+	case <-t.done:
+		return nil, t.err
+	default:
+	}
+	if request.ID == nil {
+		return nil, t.write(request)
+	}
+	id := fmt.Sprint(*request.ID)
+	ch := make(chan *message, 1)
+	t.mu.Lock()
+	t.pending[id] = ch
+	t.mu.Unlock()
+	defer func() {
+		t.mu.Lock()
+		delete(t.pending, id)
+		t.mu.Unlock()
+	}()
+	if err := t.write(request); err != nil {
+		return nil, err
+	}
+	select {
+	case msg := <-ch:
+		return msg, nil
+	case <-t.done:
+		return nil, t.err
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+func (t *stdioTransport) close() error {
+	err := t.stdin.Close()
+	select {
+	case <-t.exited:
+	case <-time.After(stdioCloseTimeout):
+		t.cmd.Process.Kill()
+		<-t.exited
+	}
+	return err
+}
@@ -0,0 +1,30 @@
+package mcp
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestStdioTransportWriteAfterStdinClosed(t *testing.T) {
+	// The server stops reading but keeps stdout open, so only the write can tell the connection is gone
+	transport, err := newStdioTransport("sh", []string{"-c", "exec 0<&-; sleep 1"}, nil, "")
+	if err != nil {
+		t.Skip(err)
+	}
+	defer transport.close()
+	id := int64(1)
+	var sendErr error
+	// Writes succeed until the shell has closed stdin
+	for i := 0; i < 50 && sendErr == nil; i++ {
+		time.Sleep(10 * time.Millisecond)
+		_, sendErr = transport.send(context.Background(), &Request{JSONRPC: "2.0", Method: "notifications/initialized"})
+	}
+	if !errors.Is(sendErr, ErrClosed) {
+		t.Errorf("notification err = %v", sendErr)
+	}
+	if _, err := transport.send(context.Background(), &Request{JSONRPC: "2.0", ID: &id, Method: "ping"}); !errors.Is(err, ErrClosed) {
+		t.Errorf("request err = %v", err)
+	}
+}
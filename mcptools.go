@@ -0,0 +1,229 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	"chat_bot/mcp"
+)
+
+const (
+	// Connecting includes starting the server process, e.g. npx downloading the package
+	mcpConnectTimeout     = time.Minute
+	mcpDefaultCallTimeout = 2 * time.Minute
+)
+
+// Characters of MCP tool names that the model APIs don't accept in function names
+var mcpNameReplacer = regexp.MustCompile(`[^a-zA-Z0-9_-]`)
+
+// MCPServerConfig is a Model Context Protocol server whose tools are given to the model. The server
+// is started with Command or reached at URL (streamable HTTP).
+type MCPServerConfig struct {
+	Name    string            `yaml:"name"`
+	Command string            `yaml:"command"`
+	Args    []string          `yaml:"args"`
+	Env     map[string]string `yaml:"env"`
+	URL     string            `yaml:"url"`
+	Headers map[string]string `yaml:"headers"`
+	// Timeout of a tool call in seconds
+	Timeout int `yaml:"timeout"`
+}
+
+// mcpServer is a connected server, the connection is restored when the process exits or the
+// session expires
+type mcpServer struct {
+	config MCPServerConfig
+	mu     sync.Mutex
+	client mcp.Client
+}
+
+// mcpTool is a tool of a server registered in functions under its own name
+type mcpTool struct {
+	server *mcpServer
+	name   string
+}
+
+// MCP tools by function name
+var mcpTools = make(map[string]mcpTool)
+
+func (s *mcpServer) connect(ctx context.Context) (mcp.Client, error) {
+	var client mcp.Client
+	var err error
+	if s.config.URL != "" {
+		client, err = mcp.NewHTTPClient(s.config.URL, mcp.WithHeaders(s.config.Headers))
+	} else {
+		env := []string{}
+		for key, value := range s.config.Env {
+			env = append(env, key+"="+value)
+		}
+		client, err = mcp.NewStdioClient(s.config.Command, s.config.Args, mcp.WithEnv(env))
+	}
+	if err != nil {
+		return nil, err
+	}
+	if _, err := client.Initialize(ctx); err != nil {
+		client.Close()
+		return nil, err
+	}
+	return client, nil
+}
+
+// callTool calls the tool, reconnecting once if the connection was lost
+func (s *mcpServer) callTool(ctx context.Context, name string, arguments json.RawMessage) (*mcp.CallToolResult, error) {
+	for attempt := 0; ; attempt++ {
+		s.mu.Lock()
+		client := s.client
+		if client == nil {
+			var err error
+			client, err = s.connect(ctx)
+			if err != nil {
+				s.mu.Unlock()
+				return nil, err
+			}
+			s.client = client
+		}
+		s.mu.Unlock()
+
+		result, err := client.CallTool(ctx, name, arguments)
+		if errors.Is(err, mcp.ErrClosed) && attempt == 0 {
+			log.Printf("Connection to MCP server %s was lost, reconnecting: %v", s.config.Name, err)
+			s.mu.Lock()
+			if s.client == client {
+				s.client = nil
+			}
+			s.mu.Unlock()
+			client.Close()
+			continue
+		}
+		return result, err
+	}
+}
+
+// connectMCPServers connects to the servers of the config and adds their tools to functions.
+// Servers that can't be reached are skipped so that the bot works without them.
+func connectMCPServers(servers []MCPServerConfig) error {
+	names := make(map[string]bool)
+	for _, serverConfig := range servers {
+		if !apiNameRegexp.MatchString(serverConfig.Name) {
+			return fmt.Errorf("invalid MCP server name %q", serverConfig.Name)
+		}
+		if names[serverConfig.Name] {
+			return fmt.Errorf("MCP server %s is defined twice", serverConfig.Name)
+		}
+		names[serverConfig.Name] = true
+		if (serverConfig.Command == "") == (serverConfig.URL == "") {
+			return fmt.Errorf("MCP server %s must have either a command or a url", serverConfig.Name)
+		}
+
+		server := &mcpServer{config: serverConfig}
+		ctx, cancel := context.WithTimeout(context.Background(), mcpConnectTimeout)
+		tools, err := server.listTools(ctx)
+		cancel()
+		if err != nil {
+			log.Printf("Failed to connect to MCP server %s: %v", serverConfig.Name, err)
+			continue
+		}
+		for _, tool := range tools {
+			if err := registerMCPTool(server, tool); err != nil {
+				log.Printf("Skipping tool %s of MCP server %s: %v", tool.Name, serverConfig.Name, err)
+			}
+		}
+		log.Printf("Connected to MCP server %s, %d tools", serverConfig.Name, len(tools))
+	}
+	return nil
+}
+
+func (s *mcpServer) listTools(ctx context.Context) ([]mcp.Tool, error) {
+	client, err := s.connect(ctx)
+	if err != nil {
+		return nil, err
+	}
+	tools, err := client.ListTools(ctx)
+	if err != nil {
+		client.Close()
+		return nil, err
+	}
+	s.mu.Lock()
+	s.client = client
+	s.mu.Unlock()
+	return tools, nil
+}
+
+// registerMCPTool adds the tool to functions as <server>_<tool>
+func registerMCPTool(server *mcpServer, tool mcp.Tool) error {
+	name := mcpNameReplacer.ReplaceAllString(server.config.Name+"_"+tool.Name, "_")
+	if len(name) > 64 {
+		name = name[:64]
+	}
+	for _, function := range functions {
+		if function.Name == name {
+			return fmt.Errorf("function %s already exists", name)
+		}
+	}
+	args := FunctionArgs{Properties: map[string]interface{}{}}
+	if len(tool.InputSchema) > 0 {
+		schema := map[string]interface{}{}
+		if err := json.Unmarshal(tool.InputSchema, &schema); err != nil {
+			return fmt.Errorf("invalid input schema: %w", err)
+		}
+		var err error
+		if args, err = functionArgsFromSchema(schema); err != nil {
+			return err
+		}
+	}
+	description := tool.Description
+	if description == "" {
+		description = tool.Title
+	}
+	functions = append(functions, Function{
+		Id:          len(functions) + 1,
+		Name:        name,
+		Description: description,
+		Args:        args,
+		Default:     1,
+		Active:      1,
+	})
+	mcpTools[name] = mcpTool{server: server, name: tool.Name}
+	return nil
+}
+
+// callMCPTool calls the tool on its server and returns the text of the result
+func callMCPTool(tool mcpTool, args string) (string, error) {
+	arguments := json.RawMessage(strings.TrimSpace(args))
+	if len(arguments) == 0 {
+		arguments = json.RawMessage("{}")
+	}
+	if !json.Valid(arguments) {
+		return "", errors.New("Ошибка парсинга аргументов: некорректный JSON")
+	}
+	timeout := mcpDefaultCallTimeout
+	if tool.server.config.Timeout > 0 {
+		timeout = time.Duration(tool.server.config.Timeout) * time.Second
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	result, err := tool.server.callTool(ctx, tool.name, arguments)
+	if err != nil {
+		return "", err
+	}
+	text := result.Text()
+	if text == "" && len(result.StructuredContent) > 0 {
+		text = string(result.StructuredContent)
+	}
+	for _, content := range result.Content {
+		if content.Type == mcp.ContentTypeImage || content.Type == mcp.ContentTypeAudio {
+			text += "\n[" + content.Type + " " + content.MimeType + "]"
+		}
+	}
+	if result.IsError {
+		return "", errors.New(strings.TrimSpace(text))
+	}
+	return text, nil
+}
@@ -0,0 +1,161 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"strconv"
+	"strings"
+
+	gpt3 "chat_bot/gpt3"
+
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api/v5"
+)
+
+const modelCallbackPrefix = "model:"
+
+// modelAllowed reports whether the user may switch to the model. Models of an API without a
+// configured key are hidden.
+func modelAllowed(spec ModelSpec, userName string) bool {
+	if len(spec.AllowedUsers) > 0 && !contains(spec.AllowedUsers, userName) {
+		return false
+	}
+	if spec.Provider != "" {
+		return true
+	}
+	switch spec.API {
+	case APIAnthropic:
+		return config.AnthropicKey != ""
+	case APIGemini:
+		return config.GeminiKey != ""
+	}
+	return true
+}
+
+func modelsKeyboard(chatID int64, userName string) (string, tgbotapi.InlineKeyboardMarkup) {
+	mu.Lock()
+	active := userSettingsMap[chatID].Model
+	mu.Unlock()
+	if active == "" {
+		active = defaultModel()
+	}
+
+	rows := [][]tgbotapi.InlineKeyboardButton{}
+	for i, spec := range modelRegistry.All() {
+		if !modelAllowed(spec, userName) {
+			continue
+		}
+		title := spec.Title
+		if spec.Name == active {
+			title = "✅ " + title
+		}
+		rows = append(rows, tgbotapi.NewInlineKeyboardRow(
+			// Names of models can be longer than the 64 bytes of callback data
+			tgbotapi.NewInlineKeyboardButtonData(title, modelCallbackPrefix+strconv.Itoa(i)),
+		))
+	}
+	return "Выберите модель:", tgbotapi.NewInlineKeyboardMarkup(rows...)
+}
+
+// historyCompatible reports whether the history of the conversation can be continued by the
+// model after switching to it
+func historyCompatible(from ModelSpec, to ModelSpec, history []gpt3.ChatCompletionRequestMessage) bool {
+	if from.Kind != ModelKindChat || to.Kind != ModelKindChat {
+		return false
+	}
+	if to.acceptsImages() {
+		return true
+	}
+	for _, message := range history {
+		if _, ok := message.Content.(string); !ok && message.Content != nil {
+			return false
+		}
+	}
+	return true
+}
+
+// switchModel makes the model active for the chat keeping the system prompt. The history is kept
+// when model_switch_keep_history is set and the new model can continue it, otherwise the
+// conversation starts over with the system prompt. Returns the description of the switch.
+func switchModel(chatID int64, userName string, model string) (string, error) {
+	if !modelRegistry.Has(model) {
+		return "", fmt.Errorf("неизвестная модель %s", model)
+	}
+	spec := modelRegistry.Get(model)
+	if !modelAllowed(spec, userName) {
+		return "", fmt.Errorf("вам нельзя пользоваться моделью %s", spec.Title)
+	}
+	mu.Lock()
+	user := userSettingsMap[chatID]
+	if generating[chatID] || switching[chatID] {
+		mu.Unlock()
+		return "", fmt.Errorf("дождитесь окончания текущего ответа")
+	}
+	previous := modelRegistry.Get(user.Model)
+	user.Model = spec.Name
+	user.State = ""
+	userSettingsMap[chatID] = user
+
+	keepHistory := config.ModelSwitchKeepHistory && historyCompatible(previous, spec, conversationHistory[chatID])
+	if !keepHistory {
+		// Reset the conversation history for the user
+		conversationHistory[chatID] = []gpt3.ChatCompletionRequestMessage{}
+		if user.SystemPrompt != "" {
+			conversationHistory[chatID] = append(conversationHistory[chatID], gpt3.ChatCompletionRequestMessage{
+				Role:    "system",
+				Content: user.SystemPrompt,
+			})
+		}
+		resetTurnsLocked(chatID)
+	}
+	mu.Unlock()
+	saveChat(chatID)
+
+	text := "Включена модель " + spec.Title
+	if keepHistory {
+		text += ", беседа продолжается."
+	} else {
+		text += "."
+	}
+	return text, nil
+}
+
+// handleModelCommand switches to the model given as the argument or shows the model picker
+func handleModelCommand(bot *tgbotapi.BotAPI, message *tgbotapi.Message) {
+	model := strings.TrimSpace(message.CommandArguments())
+	if model == "" {
+		text, keyboard := modelsKeyboard(message.Chat.ID, message.From.UserName)
+		msg := tgbotapi.NewMessage(message.Chat.ID, text)
+		msg.ReplyMarkup = keyboard
+		bot.Send(msg)
+		return
+	}
+	text, err := switchModel(message.Chat.ID, message.From.UserName, model)
+	if err != nil {
+		text = "Ошибка: " + err.Error()
+	}
+	msg := tgbotapi.NewMessage(message.Chat.ID, text)
+	msg.ReplyMarkup = tgbotapi.NewRemoveKeyboard(true)
+	bot.Send(msg)
+}
+
+func handleModelCallback(bot *tgbotapi.BotAPI, query *tgbotapi.CallbackQuery) {
+	chatID := query.Message.Chat.ID
+	model := ""
+	specs := modelRegistry.All()
+	if i, err := strconv.Atoi(strings.TrimPrefix(query.Data, modelCallbackPrefix)); err == nil && i >= 0 && i < len(specs) {
+		model = specs[i].Name
+	}
+	answer, err := switchModel(chatID, query.From.UserName, model)
+	if err != nil {
+		answer = "Ошибка: " + err.Error()
+	}
+	callback := tgbotapi.NewCallback(query.ID, answer)
+	if _, err := bot.Request(callback); err != nil {
+		log.Printf("Failed to answer callback: %v", err)
+	}
+	text, keyboard := modelsKeyboard(chatID, query.From.UserName)
+	msg := tgbotapi.NewEditMessageTextAndMarkup(chatID, query.Message.MessageID, text, keyboard)
+	if _, err := bot.Send(msg); err != nil {
+		log.Printf("Failed to edit message: %v", err)
+	}
+}
@@ -0,0 +1,188 @@
+package main
+
+import (
+	"log"
+
+	gpt3 "chat_bot/gpt3"
+)
+
+const (
+	ModelKindChat       = "chat"
+	ModelKindImage      = "image"
+	ModelKindMidjourney = "midjourney"
+)
+
+// ModelSpec describes how the bot talks to a model. The built-in specs below can be replaced or
+// extended with the `models` section of config.yml.
+type ModelSpec struct {
+	Name  string `yaml:"name"`
+	Title string `yaml:"title"`
+	// Kind is one of "chat" (default), "image" or "midjourney"
+	Kind string `yaml:"kind"`
+	// API of a chat model is "openai" (default), "responses", "anthropic" or "gemini"
+	API           string `yaml:"api"`
+	ContextWindow int    `yaml:"context_window"`
+	// MaxOutputTokens limits the answer, 0 means whatever is left of the context window
+	MaxOutputTokens int  `yaml:"max_output_tokens"`
+	Stream          bool `yaml:"stream"`
+	Vision          bool `yaml:"vision"`
+	Tools           bool `yaml:"tools"`
+	// Reasoning models get reasoning_effort and max_completion_tokens instead of temperature and max_tokens
+	Reasoning       bool     `yaml:"reasoning"`
+	ReasoningEffort string   `yaml:"reasoning_effort"`
+	Temperature     *float32 `yaml:"temperature"`
+	// WebSearch gives the model the web_search tool of the Responses API
+	WebSearch bool `yaml:"web_search"`
+	// VisionFallback is used instead of the model when the conversation contains images
+	VisionFallback string `yaml:"vision_fallback"`
+	// Encoding is the tokenizer encoding, by default it is guessed from the model name
+	Encoding string `yaml:"encoding"`
+	// Provider is the name of the OpenAI-compatible endpoint serving the model, empty for api.openai.com
+	Provider string `yaml:"provider"`
+	// AllowedUsers limits the model to these Telegram usernames, empty means everyone
+	AllowedUsers []string `yaml:"allowed_users"`
+}
+
+var defaultModelSpecs = []ModelSpec{
+	{
+		Name:            GPT54Model,
+		Title:           "OpenAI GPT 5.4",
+		API:             APIResponses,
+		ContextWindow:   128000,
+		Stream:          true,
+		Vision:          true,
+		Tools:           true,
+		Reasoning:       true,
+		ReasoningEffort: "medium",
+	},
+	{
+		Name:            O4MiniModel,
+		Title:           "OpenAI O4 mini",
+		ContextWindow:   200000,
+		MaxOutputTokens: 90000,
+		Reasoning:       true,
+		ReasoningEffort: "medium",
+	},
+	{
+		Name:           GPT45PreviewModel,
+		Title:          "OpenAI GPT 4.5",
+		ContextWindow:  16000,
+		Stream:         true,
+		Tools:          true,
+		Temperature:    gpt3.Float32Ptr(1),
+		VisionFallback: GPT54Model,
+	},
+	{
+		Name:          GPT35TurboModel16k,
+		Title:         "OpenAI GPT 3.5",
+		ContextWindow: 16000,
+		Stream:        true,
+		Temperature:   gpt3.Float32Ptr(1),
+	},
+	{
+		Name:            GeminiModel,
+		Title:           "Google Gemini 2.5 Flash",
+		API:             APIGemini,
+		ContextWindow:   1048576,
+		MaxOutputTokens: 65536,
+		Stream:          true,
+		Vision:          true,
+		Tools:           true,
+		Temperature:     gpt3.Float32Ptr(1),
+	},
+	{
+		Name:  DalleModel,
+		Title: "OpenAI DALL-E 3",
+		Kind:  ModelKindImage,
+	},
+	{
+		Name:  MidjourneyModel,
+		Title: "Midjourney",
+		Kind:  ModelKindMidjourney,
+	},
+}
+
+// modelRegistry holds the specs in the order they are shown to users
+var modelRegistry = newModelRegistry(defaultModelSpecs, nil)
+
+type ModelRegistry struct {
+	specs []ModelSpec
+	index map[string]int
+}
+
+// newModelRegistry merges the built-in specs with the ones from the config, a config spec
+// replaces the built-in one with the same name
+func newModelRegistry(defaults []ModelSpec, overrides []ModelSpec) *ModelRegistry {
+	r := &ModelRegistry{index: make(map[string]int)}
+	for _, spec := range append(append([]ModelSpec{}, defaults...), overrides...) {
+		if spec.Name == "" {
+			log.Printf("Skipping model without a name: %+v", spec)
+			continue
+		}
+		if spec.Kind == "" {
+			spec.Kind = ModelKindChat
+		}
+		if spec.Title == "" {
+			spec.Title = spec.Name
+		}
+		if spec.Kind == ModelKindChat && spec.ContextWindow == 0 {
+			spec.ContextWindow = 4096
+		}
+		if i, ok := r.index[spec.Name]; ok {
+			r.specs[i] = spec
+			continue
+		}
+		r.index[spec.Name] = len(r.specs)
+		r.specs = append(r.specs, spec)
+	}
+	return r
+}
+
+// Get returns the spec of the model, unknown models are treated as streaming chat models
+func (r *ModelRegistry) Get(name string) ModelSpec {
+	if name == "" {
+		name = defaultModel()
+	}
+	if i, ok := r.index[name]; ok {
+		return r.specs[i]
+	}
+	return ModelSpec{
+		Name:          name,
+		Title:         name,
+		Kind:          ModelKindChat,
+		ContextWindow: 4096,
+		Stream:        true,
+		Temperature:   gpt3.Float32Ptr(1),
+	}
+}
+
+func (r *ModelRegistry) Has(name string) bool {
+	_, ok := r.index[name]
+	return ok
+}
+
+func (r *ModelRegistry) All() []ModelSpec {
+	return append([]ModelSpec{}, r.specs...)
+}
+
+// defaultModel returns the model of users who did not choose one
+func defaultModel() string {
+	if config.DefaultModel != "" {
+		return config.DefaultModel
+	}
+	return DefaultModel
+}
+
+// modelForConversation returns the spec to use for the request, switching to the vision
+// fallback when the model cannot see the images of the conversation
+func (spec ModelSpec) modelForConversation(hasImages bool) ModelSpec {
+	if hasImages && !spec.Vision && spec.VisionFallback != "" {
+		return modelRegistry.Get(spec.VisionFallback)
+	}
+	return spec
+}
+
+// acceptsImages reports whether photos sent by the user can be added to the conversation
+func (spec ModelSpec) acceptsImages() bool {
+	return spec.Kind == ModelKindChat && (spec.Vision || spec.VisionFallback != "")
+}
@@ -0,0 +1,109 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"time"
+
+	"chat_bot/anthropic"
+	"chat_bot/gemini"
+	gpt3 "chat_bot/gpt3"
+)
+
+// ProviderConfig describes an endpoint that models can be routed to with the `provider` field of
+// their spec: an OpenAI-compatible server (Ollama, vLLM, llama.cpp, LocalAI...) or a server of
+// another API, e.g. an Anthropic proxy
+type ProviderConfig struct {
+	Name    string            `yaml:"name"`
+	BaseURL string            `yaml:"base_url"`
+	APIKey  string            `yaml:"api_key"`
+	Headers map[string]string `yaml:"headers"`
+	// Timeout of a request in seconds, local models can take a while to answer
+	Timeout int `yaml:"timeout"`
+}
+
+// Clients of the configured providers by name, models without a provider use openaiClient
+var providerClients = make(map[string]gpt3.Client)
+
+// Configured providers by name, for the APIs that are not OpenAI-compatible
+var providerConfigs = make(map[string]ProviderConfig)
+
+func newProviderClients(providers []ProviderConfig) (map[string]gpt3.Client, error) {
+	clients := make(map[string]gpt3.Client)
+	for _, provider := range providers {
+		if provider.Name == "" || provider.BaseURL == "" {
+			return nil, fmt.Errorf("provider must have a name and a base_url: %+v", provider)
+		}
+		if _, ok := clients[provider.Name]; ok {
+			return nil, fmt.Errorf("provider %s is defined twice", provider.Name)
+		}
+		options := []gpt3.ClientOption{
+			gpt3.WithBaseURL(provider.BaseURL),
+			gpt3.WithHeaders(provider.Headers),
+		}
+		if provider.Timeout > 0 {
+			options = append(options, gpt3.WithTimeout(time.Duration(provider.Timeout)*time.Second))
+		}
+		clients[provider.Name] = gpt3.NewClient(provider.APIKey, options...)
+		providerConfigs[provider.Name] = provider
+	}
+	return clients, nil
+}
+
+// validateModelProviders checks that every model refers to a configured provider
+func validateModelProviders(registry *ModelRegistry, clients map[string]gpt3.Client) error {
+	for _, spec := range registry.All() {
+		if _, ok := clients[spec.Provider]; spec.Provider != "" && !ok {
+			return fmt.Errorf("model %s refers to unknown provider %s", spec.Name, spec.Provider)
+		}
+	}
+	return nil
+}
+
+// clientForModel returns the client of the endpoint that serves the model
+func clientForModel(model string) gpt3.Client {
+	provider := modelRegistry.Get(model).Provider
+	if provider == "" {
+		return openaiClient
+	}
+	client, ok := providerClients[provider]
+	if !ok {
+		log.Printf("Unknown provider %s of model %s, using OpenAI", provider, model)
+		return openaiClient
+	}
+	return client
+}
+
+// anthropicClientForModel returns the Anthropic client of the model, models without a provider
+// use api.anthropic.com with anthropic_key
+func anthropicClientForModel(spec ModelSpec) anthropic.Client {
+	provider, ok := providerConfigs[spec.Provider]
+	if !ok {
+		return anthropic.NewClient(config.AnthropicKey)
+	}
+	options := []anthropic.ClientOption{
+		anthropic.WithBaseURL(provider.BaseURL),
+		anthropic.WithHeaders(provider.Headers),
+	}
+	if provider.Timeout > 0 {
+		options = append(options, anthropic.WithTimeout(time.Duration(provider.Timeout)*time.Second))
+	}
+	return anthropic.NewClient(provider.APIKey, options...)
+}
+
+// geminiClientForModel returns the Gemini client of the model, models without a provider use
+// generativelanguage.googleapis.com with gemini_key
+func geminiClientForModel(spec ModelSpec) gemini.Client {
+	provider, ok := providerConfigs[spec.Provider]
+	if !ok {
+		return gemini.NewClient(config.GeminiKey)
+	}
+	options := []gemini.ClientOption{
+		gemini.WithBaseURL(provider.BaseURL),
+		gemini.WithHeaders(provider.Headers),
+	}
+	if provider.Timeout > 0 {
+		options = append(options, gemini.WithTimeout(time.Duration(provider.Timeout)*time.Second))
+	}
+	return gemini.NewClient(provider.APIKey, options...)
+}
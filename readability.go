@@ -0,0 +1,308 @@
+package main
+
+import (
+	"math"
+	"net/url"
+	"regexp"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/PuerkitoBio/goquery"
+	"github.com/andybalholm/cascadia"
+	"github.com/jaytaylor/html2text"
+	"golang.org/x/net/html"
+)
+
+const (
+	// Paragraphs shorter than this don't count for the content score
+	readabilityMinParagraph = 25
+	// With less text the main content was probably not found and the whole page is used
+	readabilityMinText = 250
+	articleMaxLinks    = 50
+)
+
+// The names of the classes and ids of the blocks, the heuristics of Mozilla Readability
+var (
+	unlikelyCandidateNames = regexp.MustCompile(`(?i)-ad-|ai2html|banner|breadcrumbs|combx|comment|community|consent|cookie|cover-wrap|disqus|extra|footer|gdpr|header|legends|menu|modal|newsletter|pager|pagination|popup|promo|related|remark|replies|rss|share|shoutbox|sidebar|skyscraper|social|sponsor|subscribe|supplemental|yom-remote`)
+	maybeCandidateNames    = regexp.MustCompile(`(?i)and|article|body|column|content|main|shadow`)
+	positiveNames          = regexp.MustCompile(`(?i)article|body|content|entry|hentry|h-entry|main|page|post|text|blog|story`)
+	negativeNames          = regexp.MustCompile(`(?i)-ad-|hidden|^hid$| hid$| hid |^hid |banner|combx|comment|com-|contact|cookie|foot|footer|footnote|gdpr|masthead|media|meta|outbrain|promo|related|scroll|share|shoutbox|sidebar|skyscraper|sponsor|shopping|tags|tool|widget`)
+	bylineNames            = regexp.MustCompile(`(?i)byline|author|dateline|writtenby|p-author`)
+)
+
+// Elements that are never a part of the content
+const readabilityRemovedElements = "script, style, noscript, template, iframe, object, embed, svg, canvas, form, button, input, select, textarea, dialog, " +
+	"nav, aside, footer, [hidden], [aria-hidden=true], [role=navigation], [role=banner], [role=contentinfo], [role=complementary], [role=dialog], [role=alert]"
+
+// article is the readable content of a page
+type article struct {
+	Title  string
+	Byline string
+	Text   string
+	Links  []articleLink
+}
+
+type articleLink struct {
+	Text string
+	URL  string
+}
+
+// extractArticle finds the main content of the HTML page. With a CSS selector the content is the
+// elements it selects instead. base resolves the relative links.
+func extractArticle(page string, base *url.URL, selector string) (article, error) {
+	doc, err := goquery.NewDocumentFromReader(strings.NewReader(page))
+	if err != nil {
+		return article{}, &httpGetError{Type: httpGetErrorParse, Message: err.Error()}
+	}
+	result := article{
+		Title:  articleTitle(doc),
+		Byline: articleByline(doc),
+	}
+
+	var content *goquery.Selection
+	if selector != "" {
+		doc.Find("script, style, noscript, template").Remove()
+		content, err = findSelector(doc, selector)
+		if err != nil {
+			return article{}, err
+		}
+	} else {
+		doc.Find(readabilityRemovedElements).Remove()
+		// Headers of the page are removed, headers of the article are kept
+		doc.Find("header").Each(func(_ int, header *goquery.Selection) {
+			if header.ParentsFiltered("article, main").Length() == 0 {
+				header.Remove()
+			}
+		})
+		removeUnlikelyCandidates(doc)
+		content = mainContent(doc)
+		if utf8.RuneCountInString(strings.TrimSpace(content.Text())) < readabilityMinText {
+			content = doc.Find("body")
+		}
+	}
+
+	texts := []string{}
+	content.Each(func(_ int, element *goquery.Selection) {
+		outer, err := goquery.OuterHtml(element)
+		if err != nil {
+			return
+		}
+		text, err := html2text.FromString(outer, html2text.Options{OmitLinks: true, TextOnly: true})
+		if err == nil && strings.TrimSpace(text) != "" {
+			texts = append(texts, strings.TrimSpace(text))
+		}
+	})
+	result.Text = strings.Join(texts, "\n\n")
+	result.Links = articleLinks(content, base)
+	return result, nil
+}
+
+// findSelector returns the elements selected by the CSS selector of the model
+func findSelector(doc *goquery.Document, selector string) (*goquery.Selection, error) {
+	// goquery selects nothing with an invalid selector, the model should know it made a mistake
+	if _, err := cascadia.ParseGroup(selector); err != nil {
+		return nil, &httpGetError{Type: httpGetErrorSelector, Message: "некорректный CSS-селектор " + selector + ": " + err.Error()}
+	}
+	selection := doc.Find(selector)
+	if selection.Length() == 0 {
+		return nil, &httpGetError{Type: httpGetErrorSelector, Message: "на странице нет элементов " + selector}
+	}
+	return selection, nil
+}
+
+func articleTitle(doc *goquery.Document) string {
+	for _, selector := range []string{`meta[property="og:title"]`, `meta[name="twitter:title"]`} {
+		if title, ok := doc.Find(selector).Attr("content"); ok && strings.TrimSpace(title) != "" {
+			return strings.TrimSpace(title)
+		}
+	}
+	if title := strings.TrimSpace(doc.Find("title").First().Text()); title != "" {
+		return title
+	}
+	return strings.TrimSpace(doc.Find("h1").First().Text())
+}
+
+func articleByline(doc *goquery.Document) string {
+	for _, selector := range []string{`meta[name="author"]`, `meta[property="article:author"]`, `meta[name="byl"]`} {
+		byline, ok := doc.Find(selector).Attr("content")
+		// article:author is often the URL of the profile
+		if ok && strings.TrimSpace(byline) != "" && !strings.HasPrefix(byline, "http") {
+			return strings.TrimSpace(byline)
+		}
+	}
+	byline := ""
+	doc.Find(`[rel="author"], [itemprop="author"], [class], [id]`).EachWithBreak(func(_ int, element *goquery.Selection) bool {
+		_, isAuthor := element.Attr("rel")
+		if _, ok := element.Attr("itemprop"); ok {
+			isAuthor = true
+		}
+		if !isAuthor && !bylineNames.MatchString(elementNames(element)) {
+			return true
+		}
+		text := strings.Join(strings.Fields(element.Text()), " ")
+		if text != "" && utf8.RuneCountInString(text) < 100 {
+			byline = text
+			return false
+		}
+		return true
+	})
+	return byline
+}
+
+// elementNames returns the class and id of the element, the heuristics look at both
+func elementNames(element *goquery.Selection) string {
+	class, _ := element.Attr("class")
+	id, _ := element.Attr("id")
+	return class + " " + id
+}
+
+// removeUnlikelyCandidates removes the blocks that look like menus, banners and comments
+func removeUnlikelyCandidates(doc *goquery.Document) {
+	doc.Find("body *").Each(func(_ int, element *goquery.Selection) {
+		switch goquery.NodeName(element) {
+		case "article", "main", "a", "body", "table", "tbody", "tr", "td", "code", "pre":
+			return
+		}
+		names := elementNames(element)
+		if unlikelyCandidateNames.MatchString(names) && !maybeCandidateNames.MatchString(names) &&
+			element.ParentsFiltered("table, code, pre").Length() == 0 {
+			element.Remove()
+		}
+	})
+}
+
+// classWeight is the bonus of the blocks whose names look like content and the penalty of the others
+func classWeight(element *goquery.Selection) float64 {
+	weight := 0.0
+	for _, attribute := range []string{"class", "id"} {
+		value, ok := element.Attr(attribute)
+		if !ok || value == "" {
+			continue
+		}
+		if negativeNames.MatchString(value) {
+			weight -= 25
+		}
+		if positiveNames.MatchString(value) {
+			weight += 25
+		}
+	}
+	return weight
+}
+
+func tagWeight(element *goquery.Selection) float64 {
+	switch goquery.NodeName(element) {
+	case "article", "main":
+		return 10
+	case "div":
+		return 5
+	case "pre", "td", "blockquote":
+		return 3
+	case "address", "ol", "ul", "dl", "dd", "dt", "li", "form":
+		return -3
+	case "h1", "h2", "h3", "h4", "h5", "h6", "th":
+		return -5
+	}
+	return 0
+}
+
+// linkDensity is the share of the text of the element that is the text of links
+func linkDensity(element *goquery.Selection) float64 {
+	length := utf8.RuneCountInString(strings.TrimSpace(element.Text()))
+	if length == 0 {
+		return 0
+	}
+	links := 0
+	element.Find("a").Each(func(_ int, link *goquery.Selection) {
+		links += utf8.RuneCountInString(strings.TrimSpace(link.Text()))
+	})
+	return float64(links) / float64(length)
+}
+
+// mainContent scores the blocks by the paragraphs they contain and returns the best one together
+// with its siblings that also look like content
+func mainContent(doc *goquery.Document) *goquery.Selection {
+	scores := make(map[*html.Node]float64)
+	candidates := []*goquery.Selection{}
+	addScore := func(element *goquery.Selection, score float64) {
+		if element.Length() == 0 || goquery.NodeName(element) == "body" || goquery.NodeName(element) == "html" {
+			return
+		}
+		node := element.Get(0)
+		if _, ok := scores[node]; !ok {
+			scores[node] = tagWeight(element) + classWeight(element)
+			candidates = append(candidates, element)
+		}
+		scores[node] += score
+	}
+	doc.Find("p, pre, td, blockquote").Each(func(_ int, paragraph *goquery.Selection) {
+		text := strings.TrimSpace(paragraph.Text())
+		length := utf8.RuneCountInString(text)
+		if length < readabilityMinParagraph {
+			return
+		}
+		score := 1 + float64(strings.Count(text, ",")) + math.Min(float64(length/100), 3)
+		addScore(paragraph.Parent(), score)
+		addScore(paragraph.Parent().Parent(), score/2)
+	})
+
+	var best *goquery.Selection
+	bestScore := 0.0
+	for _, candidate := range candidates {
+		node := candidate.Get(0)
+		scores[node] *= 1 - linkDensity(candidate)
+		if best == nil || scores[node] > bestScore {
+			best, bestScore = candidate, scores[node]
+		}
+	}
+	if best == nil {
+		return doc.Find("body")
+	}
+
+	// Articles are often split into several blocks, e.g. by an image or a quote
+	threshold := math.Max(10, bestScore*0.2)
+	nodes := []*html.Node{}
+	best.Parent().Children().Each(func(_ int, sibling *goquery.Selection) {
+		node := sibling.Get(0)
+		if node == best.Get(0) {
+			nodes = append(nodes, node)
+			return
+		}
+		if score, ok := scores[node]; ok && score >= threshold {
+			nodes = append(nodes, node)
+			return
+		}
+		text := strings.TrimSpace(sibling.Text())
+		if goquery.NodeName(sibling) == "p" && utf8.RuneCountInString(text) > 80 && linkDensity(sibling) < 0.25 {
+			nodes = append(nodes, node)
+		}
+	})
+	return doc.FindNodes(nodes...)
+}
+
+// articleLinks returns the distinct links of the content with absolute URLs
+func articleLinks(content *goquery.Selection, base *url.URL) []articleLink {
+	links := []articleLink{}
+	seen := make(map[string]bool)
+	content.Find("a[href]").EachWithBreak(func(_ int, link *goquery.Selection) bool {
+		href, _ := link.Attr("href")
+		target, err := url.Parse(strings.TrimSpace(href))
+		if err != nil {
+			return true
+		}
+		if base != nil {
+			target = base.ResolveReference(target)
+		}
+		target.Fragment = ""
+		if (target.Scheme != "http" && target.Scheme != "https") || seen[target.String()] {
+			return true
+		}
+		text := strings.Join(strings.Fields(link.Text()), " ")
+		if text == "" {
+			return true
+		}
+		seen[target.String()] = true
+		links = append(links, articleLink{Text: text, URL: target.String()})
+		return len(links) < articleMaxLinks
+	})
+	return links
+}
@@ -0,0 +1,113 @@
+package main
+
+import (
+	"log"
+
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api/v5"
+)
+
+const regenerateCallbackData = "regen"
+
+func removeRegenerateButton(bot *tgbotapi.BotAPI, chatID int64, replyMessageIDs []int) {
+	if len(replyMessageIDs) == 0 {
+		return
+	}
+	msg := tgbotapi.NewEditMessageReplyMarkup(chatID, replyMessageIDs[len(replyMessageIDs)-1], tgbotapi.InlineKeyboardMarkup{
+		InlineKeyboard: [][]tgbotapi.InlineKeyboardButton{},
+	})
+	if _, err := bot.Send(msg); err != nil {
+		log.Printf("Failed to remove regenerate button: %v", err)
+	}
+}
+
+// isChatModel reports whether the answers of the model are generated by generateTextStream
+func isChatModel(model string) bool {
+	return modelRegistry.Get(model).Kind == ModelKindChat
+}
+
+// rerunTurn drops the turn together with everything after it and generates the answer to
+// messageText again. The answer is written into editMessageIDs when they are given.
+func rerunTurn(bot *tgbotapi.BotAPI, chatID int64, turnPos int, messageText string, editMessageIDs []int) {
+	mu.Lock()
+	model := userSettingsMap[chatID].Model
+	if model == "" {
+		model = defaultModel()
+	}
+	turn := activeConversationLocked(chatID).Turns[turnPos]
+	dropped := truncateToTurnLocked(chatID, turnPos)
+	mu.Unlock()
+
+	// Later answers are not part of the conversation anymore
+	for _, droppedTurn := range dropped[1:] {
+		removeRegenerateButton(bot, chatID, droppedTurn.ReplyMessageIDs)
+	}
+
+	messageIDs := replyWithGPT(bot, chatID, turn.UserMessageID, messageText, model, editMessageIDs)
+	recordTurn(bot, chatID, turn.Index, turn.UserMessageID, messageIDs)
+	CompleteResponse(chatID)
+}
+
+// regenerateLastReply runs the last user message through the model again. If inPlace is set,
+// the messages of the previous answer are edited, otherwise a new answer is sent.
+func regenerateLastReply(bot *tgbotapi.BotAPI, chatID int64, inPlace bool) {
+	mu.Lock()
+	user := userSettingsMap[chatID]
+	model := user.Model
+	busy := generating[chatID] || switching[chatID]
+	turn, found := lastTurnLocked(chatID)
+	turnPos := -1
+	messageText := ""
+	if found {
+		turnPos = findTurnLocked(chatID, turn.UserMessageID, false)
+		messageText = conversationHistory[chatID][turn.Index].Content.(string)
+	}
+	mu.Unlock()
+
+	if busy {
+		msg := tgbotapi.NewMessage(chatID, "Дождитесь окончания текущего ответа.")
+		bot.Send(msg)
+		return
+	}
+	if !isChatModel(model) {
+		msg := tgbotapi.NewMessage(chatID, "Перегенерация недоступна для этой модели.")
+		bot.Send(msg)
+		return
+	}
+	if turnPos < 0 {
+		msg := tgbotapi.NewMessage(chatID, "Нет сообщения для перегенерации.")
+		bot.Send(msg)
+		return
+	}
+
+	editMessageIDs := []int{}
+	if inPlace {
+		editMessageIDs = turn.ReplyMessageIDs
+	} else {
+		removeRegenerateButton(bot, chatID, turn.ReplyMessageIDs)
+	}
+	rerunTurn(bot, chatID, turnPos, messageText, editMessageIDs)
+}
+
+func handleRegenerateCallback(bot *tgbotapi.BotAPI, query *tgbotapi.CallbackQuery) {
+	chatID := query.Message.Chat.ID
+	mu.Lock()
+	turn, found := lastTurnLocked(chatID)
+	mu.Unlock()
+
+	isLast := false
+	for _, id := range turn.ReplyMessageIDs {
+		if found && id == query.Message.MessageID {
+			isLast = true
+		}
+	}
+	if !isLast {
+		callback := tgbotapi.NewCallback(query.ID, "Можно перегенерировать только последний ответ")
+		bot.Request(callback)
+		return
+	}
+	callback := tgbotapi.NewCallback(query.ID, "Перегенерирую ответ...")
+	if _, err := bot.Request(callback); err != nil {
+		log.Printf("Failed to answer callback: %v", err)
+	}
+	regenerateLastReply(bot, chatID, true)
+}
@@ -0,0 +1,126 @@
+package main
+
+import (
+	"regexp"
+	"strings"
+
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api/v5"
+)
+
+// The model may ask for more results, the APIs return at most 20 per page
+const searchMaxLimit = 20
+
+// Country and language codes of the search, ISO 3166-1 and ISO 639-1
+var searchCodeRegexp = regexp.MustCompile(`^[a-z]{2}$`)
+
+// Countries of the searches of the users whose Telegram language has no region, e.g. ru
+var languageCountries = map[string]string{
+	"ar": "sa", "be": "by", "bg": "bg", "cs": "cz", "da": "dk", "de": "de", "el": "gr", "en": "us",
+	"es": "es", "et": "ee", "fa": "ir", "fi": "fi", "fr": "fr", "he": "il", "hi": "in", "hr": "hr",
+	"hu": "hu", "hy": "am", "id": "id", "it": "it", "ja": "jp", "ka": "ge", "kk": "kz", "ko": "kr",
+	"lt": "lt", "lv": "lv", "nb": "no", "nl": "nl", "pl": "pl", "pt": "br", "ro": "ro", "ru": "ru",
+	"sk": "sk", "sl": "si", "sr": "rs", "sv": "se", "th": "th", "tr": "tr", "uk": "ua", "uz": "uz",
+	"vi": "vn", "zh": "cn",
+}
+
+// parseLanguageCode returns the language and the country of an IETF language tag of Telegram,
+// e.g. pt-br, the country is guessed for tags without a region
+func parseLanguageCode(code string) (string, string) {
+	parts := strings.FieldsFunc(strings.ToLower(code), func(r rune) bool {
+		return r == '-' || r == '_'
+	})
+	if len(parts) == 0 || !searchCodeRegexp.MatchString(parts[0]) {
+		return "", ""
+	}
+	language := parts[0]
+	if len(parts) > 1 && searchCodeRegexp.MatchString(parts[1]) {
+		return language, parts[1]
+	}
+	return language, languageCountries[language]
+}
+
+// setLanguageCodeLocked remembers the language of the Telegram client of the chat, it is saved with
+// the chat. mu must be held.
+func setLanguageCodeLocked(chatID int64, languageCode string) {
+	user := userSettingsMap[chatID]
+	if languageCode != "" && user.LanguageCode != languageCode {
+		user.LanguageCode = languageCode
+		userSettingsMap[chatID] = user
+	}
+}
+
+// searchOptionsForUser returns the country and language of the searches of the user: the ones set
+// with /search_locale or those of the Telegram language
+func searchOptionsForUser(user User) SearchOptions {
+	language, country := parseLanguageCode(user.LanguageCode)
+	if user.SearchCountry != "" {
+		country = user.SearchCountry
+	}
+	if user.SearchLanguage != "" {
+		language = user.SearchLanguage
+	}
+	return SearchOptions{Country: country, Language: language}
+}
+
+// searchLocaleStatus describes the region of the searches of the chat
+func searchLocaleStatus(chatID int64) string {
+	mu.Lock()
+	user := userSettingsMap[chatID]
+	mu.Unlock()
+	options := searchOptionsForUser(user)
+	text := "Поиск без учета региона."
+	if options.Country != "" || options.Language != "" {
+		text = "Регион поиска: " + options.Country + ", язык: " + options.Language + "."
+	}
+	if user.SearchCountry == "" && user.SearchLanguage == "" {
+		text += " Определен по языку Telegram."
+	}
+	return text + "\n\n/search_locale <страна> [язык] — задать, например /search_locale de en\n" +
+		"/search_locale auto — по языку Telegram"
+}
+
+// setSearchLocale handles the arguments of /search_locale and returns the answer to the user
+func setSearchLocale(chatID int64, arg string) string {
+	fields := strings.Fields(strings.ToLower(arg))
+	mu.Lock()
+	defer mu.Unlock()
+	user := userSettingsMap[chatID]
+	if len(fields) == 1 && fields[0] == "auto" {
+		user.SearchCountry = ""
+		user.SearchLanguage = ""
+		userSettingsMap[chatID] = user
+		return "Регион поиска определяется по языку Telegram."
+	}
+	if len(fields) > 2 {
+		return "Ошибка: укажите двухбуквенный код страны и, если нужно, языка: /search_locale de en"
+	}
+	for _, code := range fields {
+		if !searchCodeRegexp.MatchString(code) {
+			return "Ошибка: " + code + " не является двухбуквенным кодом страны или языка"
+		}
+	}
+	user.SearchCountry = fields[0]
+	user.SearchLanguage = ""
+	if len(fields) == 2 {
+		user.SearchLanguage = fields[1]
+	}
+	userSettingsMap[chatID] = user
+	options := searchOptionsForUser(user)
+	return "Регион поиска: " + options.Country + ", язык: " + options.Language + "."
+}
+
+func handleSearchLocaleCommand(bot *tgbotapi.BotAPI, message *tgbotapi.Message) {
+	if message.From != nil {
+		mu.Lock()
+		setLanguageCodeLocked(message.Chat.ID, message.From.LanguageCode)
+		mu.Unlock()
+	}
+	arg := strings.TrimSpace(message.CommandArguments())
+	text := ""
+	if arg == "" {
+		text = searchLocaleStatus(message.Chat.ID)
+	} else {
+		text = setSearchLocale(message.Chat.ID, arg)
+	}
+	bot.Send(tgbotapi.NewMessage(message.Chat.ID, text))
+}
@@ -0,0 +1,189 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"html"
+	"io"
+	"log"
+	"net/http"
+	"regexp"
+	"strings"
+	"time"
+)
+
+const (
+	SearchProviderGoogle  = "google"
+	SearchProviderSearXNG = "searxng"
+	SearchProviderBrave   = "brave"
+	SearchProviderBing    = "bing"
+
+	searchDefaultTimeout = 20 * time.Second
+	searchDefaultLimit   = 10
+	// Larger responses are cut, they are invalid JSON then
+	searchMaxResponseSize = 2 << 20
+)
+
+// SearchProvider is a web search backend
+type SearchProvider interface {
+	// Name identifies the provider in the results and the logs
+	Name() string
+	Search(ctx context.Context, query string, options SearchOptions) ([]SearchResult, error)
+}
+
+// SearchOptions narrow the search, providers ignore the options they don't support
+type SearchOptions struct {
+	// Country is an ISO 3166-1 alpha-2 code, e.g. de
+	Country string
+	// Language is an ISO 639-1 code, e.g. en
+	Language string
+	Limit    int
+	// Page of the results, starting from 1
+	Page int
+}
+
+type SearchResult struct {
+	Title       string `json:"title"`
+	URL         string `json:"url"`
+	Description string `json:"description,omitempty"`
+}
+
+// SearchProviderConfig is a search backend of the config, they are tried in the order of the config
+type SearchProviderConfig struct {
+	// Type is google, searxng, brave or bing
+	Type string `yaml:"type"`
+	// BaseURL replaces the address of the API, e.g. of a SearXNG instance or a test server
+	BaseURL string `yaml:"base_url"`
+	APIKey  string `yaml:"api_key"`
+	// Timeout of a request in seconds
+	Timeout int `yaml:"timeout"`
+}
+
+// Search providers in the order they are tried
+var searchProviders = []SearchProvider{&GoogleSearchProvider{}}
+
+// newSearchProviders returns the providers of the config, the Google scraper without a config
+func newSearchProviders(configs []SearchProviderConfig) ([]SearchProvider, error) {
+	if len(configs) == 0 {
+		return []SearchProvider{&GoogleSearchProvider{}}, nil
+	}
+	providers := []SearchProvider{}
+	for _, providerConfig := range configs {
+		client := &http.Client{Timeout: searchDefaultTimeout}
+		if providerConfig.Timeout > 0 {
+			client.Timeout = time.Duration(providerConfig.Timeout) * time.Second
+		}
+		baseURL := strings.TrimSuffix(providerConfig.BaseURL, "/")
+		switch providerConfig.Type {
+		case SearchProviderGoogle:
+			providers = append(providers, &GoogleSearchProvider{baseURL: baseURL})
+		case SearchProviderSearXNG:
+			if baseURL == "" {
+				return nil, errors.New("searxng search provider must have a base_url")
+			}
+			providers = append(providers, &SearXNGSearchProvider{client: client, baseURL: baseURL, apiKey: providerConfig.APIKey})
+		case SearchProviderBrave:
+			if providerConfig.APIKey == "" {
+				return nil, errors.New("brave search provider must have an api_key")
+			}
+			if baseURL == "" {
+				baseURL = braveDefaultBaseURL
+			}
+			providers = append(providers, &BraveSearchProvider{client: client, baseURL: baseURL, apiKey: providerConfig.APIKey})
+		case SearchProviderBing:
+			if providerConfig.APIKey == "" {
+				return nil, errors.New("bing search provider must have an api_key")
+			}
+			if baseURL == "" {
+				baseURL = bingDefaultBaseURL
+			}
+			providers = append(providers, &BingSearchProvider{client: client, baseURL: baseURL, apiKey: providerConfig.APIKey})
+		default:
+			return nil, fmt.Errorf("unknown search provider type %q", providerConfig.Type)
+		}
+	}
+	return providers, nil
+}
+
+// searchWithFallback asks the providers in order until one finds something. A provider without
+// results is skipped too, as a broken scraper returns nothing instead of an error.
+func searchWithFallback(ctx context.Context, providers []SearchProvider, query string, options SearchOptions) (string, []SearchResult, error) {
+	if options.Limit <= 0 {
+		options.Limit = searchDefaultLimit
+	}
+	if options.Page <= 0 {
+		options.Page = 1
+	}
+	failures := []string{}
+	for _, provider := range providers {
+		results, err := provider.Search(ctx, query, options)
+		if err != nil {
+			log.Printf("Search provider %s failed: %v", provider.Name(), err)
+			failures = append(failures, provider.Name()+": "+err.Error())
+			continue
+		}
+		if len(results) > options.Limit {
+			results = results[:options.Limit]
+		}
+		if len(results) > 0 {
+			return provider.Name(), results, nil
+		}
+		log.Printf("Search provider %s found nothing for %q", provider.Name(), query)
+	}
+	if len(failures) == len(providers) {
+		return "", nil, errors.New("поиск не удался: " + strings.Join(failures, "; "))
+	}
+	return "", []SearchResult{}, nil
+}
+
+// searchGetJSON sends the GET request of a search API and decodes the JSON response
+func searchGetJSON(ctx context.Context, client *http.Client, endpoint string, headers map[string]string, target interface{}) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, endpoint, nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Accept", "application/json")
+	for key, value := range headers {
+		req.Header.Set(key, value)
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	data, err := io.ReadAll(io.LimitReader(resp.Body, searchMaxResponseSize))
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		text := string(data)
+		if len(text) > 500 {
+			text = text[:500]
+		}
+		return fmt.Errorf("HTTP %d: %s", resp.StatusCode, text)
+	}
+	if err := json.Unmarshal(data, target); err != nil {
+		return fmt.Errorf("invalid response: %w", err)
+	}
+	return nil
+}
+
+var htmlTagRegexp = regexp.MustCompile(`<[^>]*>`)
+
+// stripTags removes the highlighting of the query from the snippets of the APIs
+func stripTags(text string) string {
+	return strings.TrimSpace(html.UnescapeString(htmlTagRegexp.ReplaceAllString(text, "")))
+}
+
+// searchLocale returns the locale of the options, e.g. en-US, or just the language
+func searchLocale(options SearchOptions) string {
+	if options.Language == "" {
+		return ""
+	}
+	if options.Country == "" {
+		return strings.ToLower(options.Language)
+	}
+	return strings.ToLower(options.Language) + "-" + strings.ToUpper(options.Country)
+}
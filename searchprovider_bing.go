@@ -0,0 +1,65 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+const (
+	bingDefaultBaseURL = "https://api.bing.microsoft.com/v7.0"
+	bingMaxCount       = 50
+)
+
+// BingSearchProvider uses the Bing Web Search API
+type BingSearchProvider struct {
+	client  *http.Client
+	baseURL string
+	apiKey  string
+}
+
+type bingResponse struct {
+	WebPages struct {
+		Value []struct {
+			Name    string `json:"name"`
+			URL     string `json:"url"`
+			Snippet string `json:"snippet"`
+		} `json:"value"`
+	} `json:"webPages"`
+}
+
+func (p *BingSearchProvider) Name() string {
+	return SearchProviderBing
+}
+
+func (p *BingSearchProvider) Search(ctx context.Context, query string, options SearchOptions) ([]SearchResult, error) {
+	count := options.Limit
+	if count > bingMaxCount {
+		count = bingMaxCount
+	}
+	params := url.Values{}
+	params.Set("q", query)
+	params.Set("count", strconv.Itoa(count))
+	params.Set("offset", strconv.Itoa((options.Page-1)*count))
+	// The market needs both the language and the country, e.g. en-US
+	if options.Language != "" && options.Country != "" {
+		params.Set("mkt", searchLocale(options))
+	} else if options.Country != "" {
+		params.Set("cc", strings.ToUpper(options.Country))
+	}
+	if options.Language != "" {
+		params.Set("setLang", strings.ToLower(options.Language))
+	}
+	headers := map[string]string{"Ocp-Apim-Subscription-Key": p.apiKey}
+	response := bingResponse{}
+	if err := searchGetJSON(ctx, p.client, p.baseURL+"/search?"+params.Encode(), headers, &response); err != nil {
+		return nil, err
+	}
+	results := []SearchResult{}
+	for _, result := range response.WebPages.Value {
+		results = append(results, SearchResult{Title: result.Name, URL: result.URL, Description: result.Snippet})
+	}
+	return results, nil
+}
@@ -0,0 +1,69 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+const (
+	braveDefaultBaseURL = "https://api.search.brave.com/res/v1"
+	// Limits of the count and offset parameters of the API
+	braveMaxCount  = 20
+	braveMaxOffset = 9
+)
+
+// BraveSearchProvider uses the Brave Search API
+type BraveSearchProvider struct {
+	client  *http.Client
+	baseURL string
+	apiKey  string
+}
+
+type braveResponse struct {
+	Web struct {
+		Results []struct {
+			Title       string `json:"title"`
+			URL         string `json:"url"`
+			Description string `json:"description"`
+		} `json:"results"`
+	} `json:"web"`
+}
+
+func (p *BraveSearchProvider) Name() string {
+	return SearchProviderBrave
+}
+
+func (p *BraveSearchProvider) Search(ctx context.Context, query string, options SearchOptions) ([]SearchResult, error) {
+	count := options.Limit
+	if count > braveMaxCount {
+		count = braveMaxCount
+	}
+	// The offset is in pages of count results
+	offset := options.Page - 1
+	if offset > braveMaxOffset {
+		return []SearchResult{}, nil
+	}
+	params := url.Values{}
+	params.Set("q", query)
+	params.Set("count", strconv.Itoa(count))
+	params.Set("offset", strconv.Itoa(offset))
+	if options.Country != "" {
+		params.Set("country", strings.ToLower(options.Country))
+	}
+	if options.Language != "" {
+		params.Set("search_lang", strings.ToLower(options.Language))
+	}
+	headers := map[string]string{"X-Subscription-Token": p.apiKey}
+	response := braveResponse{}
+	if err := searchGetJSON(ctx, p.client, p.baseURL+"/web/search?"+params.Encode(), headers, &response); err != nil {
+		return nil, err
+	}
+	results := []SearchResult{}
+	for _, result := range response.Web.Results {
+		results = append(results, SearchResult{Title: stripTags(result.Title), URL: result.URL, Description: stripTags(result.Description)})
+	}
+	return results, nil
+}
@@ -0,0 +1,35 @@
+package main
+
+import (
+	"context"
+
+	googlesearch "chat_bot/googlesearch"
+)
+
+// GoogleSearchProvider scrapes the result pages of Google. It needs no key but breaks when the
+// markup changes, and Google blocks it under load.
+type GoogleSearchProvider struct {
+	baseURL string
+}
+
+func (p *GoogleSearchProvider) Name() string {
+	return SearchProviderGoogle
+}
+
+func (p *GoogleSearchProvider) Search(ctx context.Context, query string, options SearchOptions) ([]SearchResult, error) {
+	found, err := googlesearch.Search(ctx, query, googlesearch.SearchOptions{
+		CountryCode:  options.Country,
+		LanguageCode: options.Language,
+		Limit:        options.Limit,
+		Start:        (options.Page - 1) * options.Limit,
+		BaseURL:      p.baseURL,
+	})
+	if err != nil {
+		return nil, err
+	}
+	results := []SearchResult{}
+	for _, result := range found {
+		results = append(results, SearchResult{Title: result.Title, URL: result.URL, Description: result.Description})
+	}
+	return results, nil
+}
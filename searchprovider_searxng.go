@@ -0,0 +1,52 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/url"
+	"strconv"
+)
+
+// SearXNGSearchProvider uses the JSON API of a SearXNG instance, json must be enabled in the
+// search.formats of its settings
+type SearXNGSearchProvider struct {
+	client  *http.Client
+	baseURL string
+	// apiKey is sent as a bearer token for instances behind an authenticating proxy
+	apiKey string
+}
+
+type searxngResponse struct {
+	Results []struct {
+		URL     string `json:"url"`
+		Title   string `json:"title"`
+		Content string `json:"content"`
+	} `json:"results"`
+}
+
+func (p *SearXNGSearchProvider) Name() string {
+	return SearchProviderSearXNG
+}
+
+func (p *SearXNGSearchProvider) Search(ctx context.Context, query string, options SearchOptions) ([]SearchResult, error) {
+	params := url.Values{}
+	params.Set("q", query)
+	params.Set("format", "json")
+	params.Set("pageno", strconv.Itoa(options.Page))
+	if locale := searchLocale(options); locale != "" {
+		params.Set("language", locale)
+	}
+	headers := map[string]string{}
+	if p.apiKey != "" {
+		headers["Authorization"] = "Bearer " + p.apiKey
+	}
+	response := searxngResponse{}
+	if err := searchGetJSON(ctx, p.client, p.baseURL+"/search?"+params.Encode(), headers, &response); err != nil {
+		return nil, err
+	}
+	results := []SearchResult{}
+	for _, result := range response.Results {
+		results = append(results, SearchResult{Title: result.Title, URL: result.URL, Description: stripTags(result.Content)})
+	}
+	return results, nil
+}
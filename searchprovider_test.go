@@ -0,0 +1,196 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// newSearchTestProvider returns the provider of the config with the base URL of a server that
+// checks the path, the headers and the query and answers with body
+func newSearchTestProvider(t *testing.T, providerConfig SearchProviderConfig, path string, headers map[string]string, query url.Values, body string) SearchProvider {
+	t.Helper()
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != path {
+			t.Errorf("path = %s, want %s", r.URL.Path, path)
+		}
+		for key, value := range headers {
+			if r.Header.Get(key) != value {
+				t.Errorf("header %s = %q, want %q", key, r.Header.Get(key), value)
+			}
+		}
+		if !reflect.DeepEqual(r.URL.Query(), query) {
+			t.Errorf("query = %v, want %v", r.URL.Query(), query)
+		}
+		w.Header().Set("Content-Type", "application/json")
+		io.WriteString(w, body)
+	}))
+	t.Cleanup(server.Close)
+	providerConfig.BaseURL = server.URL + "/"
+	providers, err := newSearchProviders([]SearchProviderConfig{providerConfig})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return providers[0]
+}
+
+func TestSearXNGSearchProvider(t *testing.T) {
+	provider := newSearchTestProvider(t,
+		SearchProviderConfig{Type: SearchProviderSearXNG, APIKey: "secret"},
+		"/search",
+		map[string]string{"Authorization": "Bearer secret", "Accept": "application/json"},
+		url.Values{"q": {"go generics"}, "format": {"json"}, "pageno": {"2"}, "language": {"de-DE"}},
+		`{"results":[{"url":"https://go.dev/doc","title":"Go docs","content":"<b>Generics</b> &amp; more"}]}`)
+	results, err := provider.Search(context.Background(), "go generics", SearchOptions{Country: "de", Language: "DE", Limit: 10, Page: 2})
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []SearchResult{{Title: "Go docs", URL: "https://go.dev/doc", Description: "Generics & more"}}
+	if !reflect.DeepEqual(results, expected) {
+		t.Errorf("results = %+v", results)
+	}
+}
+
+func TestBraveSearchProvider(t *testing.T) {
+	provider := newSearchTestProvider(t,
+		SearchProviderConfig{Type: SearchProviderBrave, APIKey: "BSA-key"},
+		"/web/search",
+		map[string]string{"X-Subscription-Token": "BSA-key"},
+		url.Values{"q": {"погода"}, "count": {"20"}, "offset": {"2"}, "country": {"ru"}, "search_lang": {"ru"}},
+		`{"web":{"results":[{"title":"<strong>Погода</strong> в Москве","url":"https://example.ru","description":"Прогноз"}]}}`)
+	results, err := provider.Search(context.Background(), "погода", SearchOptions{Country: "RU", Language: "ru", Limit: 50, Page: 3})
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []SearchResult{{Title: "Погода в Москве", URL: "https://example.ru", Description: "Прогноз"}}
+	if !reflect.DeepEqual(results, expected) {
+		t.Errorf("results = %+v", results)
+	}
+
+	// Pages past the last offset of the API are empty without a request
+	results, err = provider.Search(context.Background(), "погода", SearchOptions{Limit: 10, Page: braveMaxOffset + 2})
+	if err != nil || len(results) != 0 {
+		t.Errorf("results = %+v, err = %v", results, err)
+	}
+}
+
+func TestBingSearchProvider(t *testing.T) {
+	body := `{"webPages":{"value":[{"name":"Go","url":"https://go.dev","snippet":"The Go language"}]}}`
+	tests := []struct {
+		name    string
+		options SearchOptions
+		query   url.Values
+	}{
+		{"market", SearchOptions{Country: "us", Language: "en", Limit: 5, Page: 3},
+			url.Values{"q": {"golang"}, "count": {"5"}, "offset": {"10"}, "mkt": {"en-US"}, "setLang": {"en"}}},
+		{"country", SearchOptions{Country: "de", Limit: 10, Page: 1},
+			url.Values{"q": {"golang"}, "count": {"10"}, "offset": {"0"}, "cc": {"DE"}}},
+		{"language", SearchOptions{Language: "FR", Limit: 100, Page: 2},
+			url.Values{"q": {"golang"}, "count": {"50"}, "offset": {"50"}, "setLang": {"fr"}}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			provider := newSearchTestProvider(t,
+				SearchProviderConfig{Type: SearchProviderBing, APIKey: "bing-key"},
+				"/search",
+				map[string]string{"Ocp-Apim-Subscription-Key": "bing-key"},
+				test.query, body)
+			results, err := provider.Search(context.Background(), "golang", test.options)
+			if err != nil {
+				t.Fatal(err)
+			}
+			expected := []SearchResult{{Title: "Go", URL: "https://go.dev", Description: "The Go language"}}
+			if !reflect.DeepEqual(results, expected) {
+				t.Errorf("results = %+v", results)
+			}
+		})
+	}
+}
+
+func TestSearchProviderHTTPError(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusTooManyRequests)
+		io.WriteString(w, `{"error":"rate limited"}`)
+	}))
+	defer server.Close()
+	providers, err := newSearchProviders([]SearchProviderConfig{{Type: SearchProviderBrave, APIKey: "key", BaseURL: server.URL}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = providers[0].Search(context.Background(), "q", SearchOptions{Limit: 10, Page: 1})
+	if err == nil || !strings.Contains(err.Error(), "HTTP 429") || !strings.Contains(err.Error(), "rate limited") {
+		t.Errorf("err = %v", err)
+	}
+}
+
+func TestNewSearchProvidersErrors(t *testing.T) {
+	for _, providerConfig := range []SearchProviderConfig{
+		{Type: SearchProviderSearXNG},
+		{Type: SearchProviderBrave},
+		{Type: SearchProviderBing},
+		{Type: "yandex"},
+	} {
+		if _, err := newSearchProviders([]SearchProviderConfig{providerConfig}); err == nil {
+			t.Errorf("%s: no error", providerConfig.Type)
+		}
+	}
+}
+
+// fakeSearchProvider returns the results or the error and records the calls
+type fakeSearchProvider struct {
+	name    string
+	results []SearchResult
+	err     error
+	calls   []SearchOptions
+}
+
+func (p *fakeSearchProvider) Name() string {
+	return p.name
+}
+
+func (p *fakeSearchProvider) Search(ctx context.Context, query string, options SearchOptions) ([]SearchResult, error) {
+	p.calls = append(p.calls, options)
+	return p.results, p.err
+}
+
+func TestSearchWithFallback(t *testing.T) {
+	found := []SearchResult{{Title: "1", URL: "https://1"}, {Title: "2", URL: "https://2"}, {Title: "3", URL: "https://3"}}
+
+	failing := &fakeSearchProvider{name: "failing", err: errors.New("timeout")}
+	empty := &fakeSearchProvider{name: "empty", results: []SearchResult{}}
+	working := &fakeSearchProvider{name: "working", results: found}
+	unused := &fakeSearchProvider{name: "unused", results: found}
+	name, results, err := searchWithFallback(context.Background(), []SearchProvider{failing, empty, working, unused}, "q", SearchOptions{Limit: 2})
+	if err != nil || name != "working" || !reflect.DeepEqual(results, found[:2]) {
+		t.Errorf("name = %s, results = %+v, err = %v", name, results, err)
+	}
+	if len(failing.calls) != 1 || len(empty.calls) != 1 || len(working.calls) != 1 || len(unused.calls) != 0 {
+		t.Errorf("calls = %d %d %d %d", len(failing.calls), len(empty.calls), len(working.calls), len(unused.calls))
+	}
+	// The defaults are applied before the providers are called
+	if failing.calls[0].Limit != 2 || failing.calls[0].Page != 1 {
+		t.Errorf("options = %+v", failing.calls[0])
+	}
+
+	// Nothing found is not an error when a provider answered
+	failing = &fakeSearchProvider{name: "failing", err: errors.New("timeout")}
+	name, results, err = searchWithFallback(context.Background(), []SearchProvider{failing, empty}, "q", SearchOptions{})
+	if err != nil || name != "" || results == nil || len(results) != 0 {
+		t.Errorf("name = %s, results = %+v, err = %v", name, results, err)
+	}
+	if failing.calls[0].Limit != searchDefaultLimit {
+		t.Errorf("limit = %d", failing.calls[0].Limit)
+	}
+
+	other := &fakeSearchProvider{name: "other", err: errors.New("HTTP 403")}
+	_, _, err = searchWithFallback(context.Background(), []SearchProvider{failing, other}, "q", SearchOptions{})
+	if err == nil || !strings.Contains(err.Error(), "failing: timeout") || !strings.Contains(err.Error(), "other: HTTP 403") {
+		t.Errorf("err = %v", err)
+	}
+}
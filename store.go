@@ -0,0 +1,300 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+
+	gpt3 "chat_bot/gpt3"
+)
+
+const (
+	StorageTypeMemory = "memory"
+	StorageTypeFile   = "file"
+
+	DefaultStorageDir = "data"
+)
+
+// Store persists conversation histories and user settings between bot restarts
+type Store interface {
+	LoadHistory(chatID int64, conversationID string) ([]gpt3.ChatCompletionRequestMessage, error)
+	SaveHistory(chatID int64, conversationID string, history []gpt3.ChatCompletionRequestMessage) error
+	DeleteHistory(chatID int64, conversationID string) error
+	LoadConversations(chatID int64) ([]Conversation, error)
+	SaveConversations(chatID int64, conversations []Conversation) error
+	// LoadUser returns false if no settings were saved for the chat yet
+	LoadUser(chatID int64) (User, bool, error)
+	SaveUser(chatID int64, user User) error
+}
+
+var store Store = NewMemoryStore()
+
+// Chats whose history and settings were already loaded from the store
+var loadedChats = make(map[int64]bool)
+
+func NewStore(config Config) (Store, error) {
+	switch config.StorageType {
+	case StorageTypeMemory:
+		return NewMemoryStore(), nil
+	case "", StorageTypeFile:
+		dir := config.StorageDir
+		if dir == "" {
+			dir = DefaultStorageDir
+		}
+		return NewFileStore(dir)
+	default:
+		return nil, fmt.Errorf("unknown storage type: %s", config.StorageType)
+	}
+}
+
+// MemoryStore keeps everything in process memory, it is lost on restart
+type MemoryStore struct {
+	histories     map[int64]map[string][]gpt3.ChatCompletionRequestMessage
+	conversations map[int64][]Conversation
+	users         map[int64]User
+	mu            sync.Mutex
+}
+
+func NewMemoryStore() *MemoryStore {
+	return &MemoryStore{
+		histories:     make(map[int64]map[string][]gpt3.ChatCompletionRequestMessage),
+		conversations: make(map[int64][]Conversation),
+		users:         make(map[int64]User),
+	}
+}
+
+func (s *MemoryStore) LoadHistory(chatID int64, conversationID string) ([]gpt3.ChatCompletionRequestMessage, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	history, ok := s.histories[chatID][conversationID]
+	if !ok {
+		return nil, nil
+	}
+	return append([]gpt3.ChatCompletionRequestMessage{}, history...), nil
+}
+
+func (s *MemoryStore) SaveHistory(chatID int64, conversationID string, history []gpt3.ChatCompletionRequestMessage) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.histories[chatID] == nil {
+		s.histories[chatID] = make(map[string][]gpt3.ChatCompletionRequestMessage)
+	}
+	s.histories[chatID][conversationID] = append([]gpt3.ChatCompletionRequestMessage{}, history...)
+	return nil
+}
+
+func (s *MemoryStore) DeleteHistory(chatID int64, conversationID string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.histories[chatID], conversationID)
+	return nil
+}
+
+func (s *MemoryStore) LoadConversations(chatID int64) ([]Conversation, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]Conversation{}, s.conversations[chatID]...), nil
+}
+
+func (s *MemoryStore) SaveConversations(chatID int64, conversations []Conversation) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.conversations[chatID] = append([]Conversation{}, conversations...)
+	return nil
+}
+
+func (s *MemoryStore) LoadUser(chatID int64) (User, bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	user, ok := s.users[chatID]
+	return user, ok, nil
+}
+
+func (s *MemoryStore) SaveUser(chatID int64, user User) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.users[chatID] = user
+	return nil
+}
+
+// FileStore keeps one directory per chat with JSON files for the settings, the list of
+// conversations and the history of each conversation
+type FileStore struct {
+	dir string
+	mu  sync.Mutex
+}
+
+func NewFileStore(dir string) (*FileStore, error) {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, fmt.Errorf("failed to create storage dir: %w", err)
+	}
+	return &FileStore{dir: dir}, nil
+}
+
+func (s *FileStore) chatPath(chatID int64, name string) string {
+	return filepath.Join(s.dir, strconv.FormatInt(chatID, 10), name)
+}
+
+func (s *FileStore) historyPath(chatID int64, conversationID string) string {
+	return s.chatPath(chatID, "history-"+conversationID+".json")
+}
+
+func (s *FileStore) LoadHistory(chatID int64, conversationID string) ([]gpt3.ChatCompletionRequestMessage, error) {
+	history := []gpt3.ChatCompletionRequestMessage{}
+	found, err := s.readJSON(s.historyPath(chatID, conversationID), &history)
+	if err != nil || !found {
+		return nil, err
+	}
+	return history, nil
+}
+
+func (s *FileStore) SaveHistory(chatID int64, conversationID string, history []gpt3.ChatCompletionRequestMessage) error {
+	return s.writeJSON(s.historyPath(chatID, conversationID), history)
+}
+
+func (s *FileStore) DeleteHistory(chatID int64, conversationID string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	err := os.Remove(s.historyPath(chatID, conversationID))
+	if os.IsNotExist(err) {
+		return nil
+	}
+	return err
+}
+
+func (s *FileStore) LoadConversations(chatID int64) ([]Conversation, error) {
+	conversations := []Conversation{}
+	_, err := s.readJSON(s.chatPath(chatID, "conversations.json"), &conversations)
+	return conversations, err
+}
+
+func (s *FileStore) SaveConversations(chatID int64, conversations []Conversation) error {
+	return s.writeJSON(s.chatPath(chatID, "conversations.json"), conversations)
+}
+
+func (s *FileStore) LoadUser(chatID int64) (User, bool, error) {
+	user := User{}
+	found, err := s.readJSON(s.chatPath(chatID, "user.json"), &user)
+	return user, found, err
+}
+
+func (s *FileStore) SaveUser(chatID int64, user User) error {
+	return s.writeJSON(s.chatPath(chatID, "user.json"), user)
+}
+
+func (s *FileStore) readJSON(path string, v interface{}) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	if err := json.Unmarshal(data, v); err != nil {
+		return false, fmt.Errorf("failed to decode %s: %w", path, err)
+	}
+	return true, nil
+}
+
+// writeJSON replaces the file atomically so that a crash never leaves a half-written history
+func (s *FileStore) writeJSON(path string, v interface{}) error {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return err
+	}
+	tmp, err := ioutil.TempFile(filepath.Dir(path), filepath.Base(path)+".*.tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
+// loadChat lazily fills userSettingsMap, chatConversations and conversationHistory of the
+// active conversation from the store on first access
+func loadChat(chatID int64) {
+	mu.Lock()
+	defer mu.Unlock()
+	if loadedChats[chatID] {
+		return
+	}
+	loadedChats[chatID] = true
+	if _, ok := userSettingsMap[chatID]; !ok {
+		user, found, err := store.LoadUser(chatID)
+		if err != nil {
+			log.Printf("Failed to load settings for chat %d: %v", chatID, err)
+		} else if found {
+			// The model could have been removed from the config
+			if user.Model != "" && !modelRegistry.Has(user.Model) {
+				log.Printf("Model %s of chat %d is not available anymore, using the default one", user.Model, chatID)
+				user.Model = ""
+			}
+			userSettingsMap[chatID] = user
+		}
+	}
+	conversations, err := store.LoadConversations(chatID)
+	if err != nil {
+		log.Printf("Failed to load conversations for chat %d: %v", chatID, err)
+	}
+	chatConversations[chatID] = conversations
+	conversationID := ensureConversationLocked(chatID)
+	if _, ok := conversationHistory[chatID]; !ok {
+		history, err := store.LoadHistory(chatID, conversationID)
+		if err != nil {
+			log.Printf("Failed to load history for chat %d: %v", chatID, err)
+		} else if history != nil {
+			conversationHistory[chatID] = history
+		}
+	}
+}
+
+// Saves of a chat are written one at a time, otherwise an older copy could be written last
+var chatSaveLocks = make(map[int64]*sync.Mutex)
+
+// saveChat writes the settings, the list of conversations and the active history of the chat to the store
+func saveChat(chatID int64) {
+	mu.Lock()
+	saveLock, ok := chatSaveLocks[chatID]
+	if !ok {
+		saveLock = &sync.Mutex{}
+		chatSaveLocks[chatID] = saveLock
+	}
+	mu.Unlock()
+	saveLock.Lock()
+	defer saveLock.Unlock()
+
+	mu.Lock()
+	conversationID := ensureConversationLocked(chatID)
+	history := append([]gpt3.ChatCompletionRequestMessage{}, conversationHistory[chatID]...)
+	conversations := append([]Conversation{}, chatConversations[chatID]...)
+	user := userSettingsMap[chatID]
+	mu.Unlock()
+	if err := store.SaveHistory(chatID, conversationID, history); err != nil {
+		log.Printf("Failed to save history for chat %d: %v", chatID, err)
+	}
+	if err := store.SaveConversations(chatID, conversations); err != nil {
+		log.Printf("Failed to save conversations for chat %d: %v", chatID, err)
+	}
+	if err := store.SaveUser(chatID, user); err != nil {
+		log.Printf("Failed to save settings for chat %d: %v", chatID, err)
+	}
+}
@@ -0,0 +1,300 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"log"
+	"regexp"
+	"sort"
+	"strings"
+
+	gpt3 "chat_bot/gpt3"
+
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api/v5"
+)
+
+// Answers longer than this are sent as a .json document instead of a message
+const jsonDocumentThreshold = 3500
+
+// Names of the schemas and functions are sent to the APIs, which only accept these characters
+var apiNameRegexp = regexp.MustCompile(`^[a-zA-Z0-9_-]{1,64}$`)
+
+// SchemaTemplate is a JSON schema from config.yml that users attach with /schema <name>
+type SchemaTemplate struct {
+	Name        string `yaml:"name"`
+	Description string `yaml:"description"`
+	// Schema is the JSON schema as JSON text
+	Schema string `yaml:"schema"`
+}
+
+// ResponseSchema is the format the answers of the chat follow while it is attached
+type ResponseSchema struct {
+	Name string `json:"name"`
+	// Schema is a JSON schema, empty for any JSON object
+	Schema string `json:"schema,omitempty"`
+}
+
+// validateSchemaTemplates checks the templates of the config
+func validateSchemaTemplates(templates []SchemaTemplate) error {
+	names := make(map[string]bool)
+	for _, template := range templates {
+		if !apiNameRegexp.MatchString(template.Name) {
+			return fmt.Errorf("invalid schema template name %q", template.Name)
+		}
+		if names[template.Name] {
+			return fmt.Errorf("duplicate schema template %s", template.Name)
+		}
+		names[template.Name] = true
+		if _, _, err := parseJSONSchema(template.Schema); err != nil {
+			return fmt.Errorf("schema template %s: %w", template.Name, err)
+		}
+	}
+	return nil
+}
+
+// findSchemaTemplateLocked returns the schema saved by the user or from the config. mu must be held.
+func findSchemaTemplateLocked(chatID int64, name string) (string, bool) {
+	if schema, ok := userSettingsMap[chatID].SchemaTemplates[name]; ok {
+		return schema, true
+	}
+	for _, template := range config.SchemaTemplates {
+		if template.Name == name {
+			return template.Schema, true
+		}
+	}
+	return "", false
+}
+
+// responseFormat returns the response_format of the requests
+func (schema *ResponseSchema) responseFormat() *gpt3.ChatCompletionResponseFormat {
+	if schema.Schema == "" {
+		return &gpt3.ChatCompletionResponseFormat{Type: gpt3.ResponseFormatJSONObject}
+	}
+	compacted, _, err := parseJSONSchema(schema.Schema)
+	if err != nil {
+		return &gpt3.ChatCompletionResponseFormat{Type: gpt3.ResponseFormatJSONObject}
+	}
+	return &gpt3.ChatCompletionResponseFormat{
+		Type: gpt3.ResponseFormatJSONSchema,
+		JSONSchema: &gpt3.ChatCompletionJSONSchema{
+			Name:   schema.Name,
+			Schema: compacted,
+		},
+	}
+}
+
+// instruction is added to the request as a system message. The json_object format requires the
+// messages to mention JSON, and APIs without response formats only have the instruction.
+func (schema *ResponseSchema) instruction() gpt3.ChatCompletionRequestMessage {
+	text := "Отвечай только JSON-объектом, без пояснений и разметки Markdown."
+	if schema.Schema != "" {
+		text += " Объект должен соответствовать JSON-схеме:\n" + schema.Schema
+	}
+	return gpt3.ChatCompletionRequestMessage{Role: "system", Content: text}
+}
+
+// parseJSONAnswer extracts the JSON of the answer, indents it and checks it against the schema.
+// The answer is returned as is when it is not JSON.
+func parseJSONAnswer(schema *ResponseSchema, answer string) ([]byte, error) {
+	answer = strings.TrimSpace(answer)
+	// Models sometimes wrap the JSON in a code block despite the instruction
+	if strings.HasPrefix(answer, "```") {
+		answer = strings.TrimPrefix(answer, "```")
+		if newline := strings.Index(answer, "\n"); newline >= 0 {
+			answer = answer[newline+1:]
+		}
+		answer = strings.TrimSpace(strings.TrimSuffix(answer, "```"))
+	}
+	var value interface{}
+	if err := json.Unmarshal([]byte(answer), &value); err != nil {
+		return []byte(answer), fmt.Errorf("ответ не является корректным JSON: %w", err)
+	}
+	indented := bytes.Buffer{}
+	if err := json.Indent(&indented, []byte(answer), "", "  "); err != nil {
+		return []byte(answer), err
+	}
+	if schema.Schema == "" {
+		return indented.Bytes(), nil
+	}
+	_, schemaObject, err := parseJSONSchema(schema.Schema)
+	if err != nil {
+		return indented.Bytes(), err
+	}
+	if err := validateJSONSchema(value, schemaObject, ""); err != nil {
+		return indented.Bytes(), fmt.Errorf("JSON не соответствует схеме: %w", err)
+	}
+	return indented.Bytes(), nil
+}
+
+// replyWithJSON waits for the whole answer instead of streaming it, validates it and sends it
+// as a code block or, when it is large, as a .json document
+func replyWithJSON(bot *tgbotapi.BotAPI, chatID int64, replyToMessageID int, schema *ResponseSchema, generatedTextStream chan string, editMessageIDs []int) []int {
+	bot.Request(tgbotapi.NewChatAction(chatID, tgbotapi.ChatTyping))
+	progress := strings.Builder{}
+	for text := range generatedTextStream {
+		progress.WriteString(text)
+	}
+	deleteUnusedMessages(bot, chatID, nil, editMessageIDs)
+
+	mu.Lock()
+	history := conversationHistory[chatID]
+	answer := ""
+	if len(history) > 0 && history[len(history)-1].Role == "assistant" {
+		answer, _ = history[len(history)-1].Content.(string)
+	}
+	mu.Unlock()
+	if answer == "" {
+		// The generation failed, the stream has the error
+		text := strings.TrimSpace(progress.String())
+		if text == "" {
+			text = "Ошибка: пустой ответ"
+		}
+		msg := tgbotapi.NewMessage(chatID, text)
+		msg.ReplyToMessageID = replyToMessageID
+		sent, err := bot.Send(msg)
+		if err != nil {
+			log.Printf("Failed to send message: %v", err)
+			return nil
+		}
+		return []int{sent.MessageID}
+	}
+
+	data, err := parseJSONAnswer(schema, answer)
+	status := "✅ JSON"
+	if schema.Schema != "" {
+		status = "✅ JSON соответствует схеме " + schema.Name
+	}
+	if err != nil {
+		status = "⚠️ " + err.Error()
+	}
+	keyboard := regenerateKeyboard()
+
+	if len(data) > jsonDocumentThreshold {
+		document := tgbotapi.NewDocument(chatID, tgbotapi.FileBytes{Name: schema.Name + ".json", Bytes: data})
+		document.Caption = status
+		document.ReplyToMessageID = replyToMessageID
+		document.ReplyMarkup = keyboard
+		sent, err := bot.Send(document)
+		if err != nil {
+			log.Printf("Failed to send document: %v", err)
+			return nil
+		}
+		return []int{sent.MessageID}
+	}
+	msg := tgbotapi.NewMessage(chatID, "```json\n"+string(data)+"\n```\n"+status)
+	msg.ParseMode = "Markdown"
+	msg.ReplyToMessageID = replyToMessageID
+	msg.ReplyMarkup = keyboard
+	sent, err := bot.Send(msg)
+	if err != nil {
+		log.Printf("Failed to send message as markdown: %v", err)
+		msg.Text = string(data) + "\n\n" + status
+		msg.ParseMode = ""
+		sent, err = bot.Send(msg)
+		if err != nil {
+			log.Printf("Failed to send message as plaintext: %v", err)
+			return nil
+		}
+	}
+	return []int{sent.MessageID}
+}
+
+// schemaStatus describes the attached schema and the available templates
+func schemaStatus(chatID int64) string {
+	mu.Lock()
+	user := userSettingsMap[chatID]
+	mu.Unlock()
+	text := "Схема ответа не задана, ответы приходят обычным текстом."
+	if user.ResponseSchema != nil && user.ResponseSchema.Schema == "" {
+		text = "Ответы приходят JSON-объектом без схемы."
+	} else if user.ResponseSchema != nil {
+		text = "Ответы приходят JSON по схеме " + user.ResponseSchema.Name + ":\n" + user.ResponseSchema.Schema
+	}
+	templates := []string{}
+	for _, template := range config.SchemaTemplates {
+		line := "- " + template.Name
+		if template.Description != "" {
+			line += " — " + template.Description
+		}
+		templates = append(templates, line)
+	}
+	names := []string{}
+	for name := range user.SchemaTemplates {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		templates = append(templates, "- "+name+" (сохранена вами)")
+	}
+	if len(templates) > 0 {
+		text += "\n\nШаблоны:\n" + strings.Join(templates, "\n")
+	}
+	text += "\n\n/schema <JSON-схема> — отвечать JSON по схеме\n" +
+		"/schema <шаблон> — использовать шаблон\n" +
+		"/schema json — отвечать любым JSON-объектом\n" +
+		"/schema save <имя> — сохранить текущую схему как шаблон\n" +
+		"/schema off — отвечать текстом"
+	return text
+}
+
+// setSchema handles the arguments of /schema and returns the answer to the user
+func setSchema(chatID int64, arg string) (string, error) {
+	mu.Lock()
+	defer mu.Unlock()
+	user := userSettingsMap[chatID]
+	fields := strings.Fields(arg)
+	switch {
+	case arg == "off":
+		user.ResponseSchema = nil
+		userSettingsMap[chatID] = user
+		return "Схема ответа отключена.", nil
+	case arg == "json":
+		user.ResponseSchema = &ResponseSchema{Name: "response"}
+		userSettingsMap[chatID] = user
+		return "Ответы будут приходить JSON-объектом.", nil
+	case len(fields) > 0 && fields[0] == "save":
+		if len(fields) != 2 || !apiNameRegexp.MatchString(fields[1]) {
+			return "", fmt.Errorf("укажите имя шаблона из латинских букв, цифр, _ и -: /schema save <имя>")
+		}
+		if user.ResponseSchema == nil || user.ResponseSchema.Schema == "" {
+			return "", fmt.Errorf("сначала задайте схему")
+		}
+		if user.SchemaTemplates == nil {
+			user.SchemaTemplates = make(map[string]string)
+		}
+		user.SchemaTemplates[fields[1]] = user.ResponseSchema.Schema
+		userSettingsMap[chatID] = user
+		return "Схема сохранена как шаблон " + fields[1] + ".", nil
+	case strings.HasPrefix(arg, "{"):
+		if _, _, err := parseJSONSchema(arg); err != nil {
+			return "", err
+		}
+		user.ResponseSchema = &ResponseSchema{Name: "response", Schema: arg}
+		userSettingsMap[chatID] = user
+		return "Ответы будут приходить JSON по заданной схеме.", nil
+	}
+	schema, ok := findSchemaTemplateLocked(chatID, arg)
+	if !ok {
+		return "", fmt.Errorf("шаблон %s не найден", arg)
+	}
+	user.ResponseSchema = &ResponseSchema{Name: arg, Schema: schema}
+	userSettingsMap[chatID] = user
+	return "Ответы будут приходить JSON по схеме " + arg + ".", nil
+}
+
+// handleSchemaCommand attaches a JSON schema to the answers of the chat or shows the current one
+func handleSchemaCommand(bot *tgbotapi.BotAPI, message *tgbotapi.Message) {
+	arg := strings.TrimSpace(message.CommandArguments())
+	if arg == "" {
+		msg := tgbotapi.NewMessage(message.Chat.ID, schemaStatus(message.Chat.ID))
+		bot.Send(msg)
+		return
+	}
+	text, err := setSchema(message.Chat.ID, arg)
+	if err != nil {
+		text = "Ошибка: " + err.Error()
+	}
+	msg := tgbotapi.NewMessage(message.Chat.ID, text)
+	bot.Send(msg)
+}
@@ -0,0 +1,200 @@
+package main
+
+import (
+	"crypto/sha1"
+	"encoding/hex"
+	"encoding/json"
+	"log"
+	"strings"
+	"sync"
+
+	gpt3 "chat_bot/gpt3"
+
+	"github.com/pkoukk/tiktoken-go"
+	tiktoken_loader "github.com/pkoukk/tiktoken-go-loader"
+)
+
+const (
+	EncodingCl100k = "cl100k_base"
+	EncodingO200k  = "o200k_base"
+
+	// Every message is wrapped into <|start|>{role}\n{content}<|end|>\n
+	tokensPerMessage = 3
+	tokensPerName    = 1
+	// Every reply is primed with <|start|>assistant<|message|>
+	tokensPerReply = 3
+
+	// Images are billed by 512px tiles, a Telegram photo of up to 1280px is scaled to 768x768: 4 tiles
+	imageLowDetailTokens  = 85
+	imageTileTokens       = 170
+	imageHighDetailTiles  = 4
+	tokenCacheMaxMessages = 100000
+)
+
+// TokenCounter counts tokens of conversation messages with the encoding of the model and
+// caches the count of every message, so a long history is not tokenized again on every request
+type TokenCounter struct {
+	mu        sync.Mutex
+	encodings map[string]*tiktoken.Tiktoken
+	cache     map[string]int
+}
+
+var tokenCounter = NewTokenCounter()
+
+func NewTokenCounter() *TokenCounter {
+	tiktoken.SetBpeLoader(tiktoken_loader.NewOfflineLoader())
+	return &TokenCounter{
+		encodings: make(map[string]*tiktoken.Tiktoken),
+		cache:     make(map[string]int),
+	}
+}
+
+// encodingForModel returns the tokenizer encoding of the model. Unless the model spec sets it,
+// older GPT-4 and GPT-3.5 models use cl100k and everything newer uses o200k
+func encodingForModel(model string) string {
+	if encoding := modelRegistry.Get(model).Encoding; encoding != "" {
+		return encoding
+	}
+	for _, prefix := range []string{"gpt-4-", "gpt-3.5-"} {
+		if strings.HasPrefix(model, prefix) {
+			return EncodingCl100k
+		}
+	}
+	if model == GPT4Model {
+		return EncodingCl100k
+	}
+	return EncodingO200k
+}
+
+func (c *TokenCounter) encoding(name string) *tiktoken.Tiktoken {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if encoding, ok := c.encodings[name]; ok {
+		return encoding
+	}
+	encoding, err := tiktoken.GetEncoding(name)
+	if err != nil {
+		log.Printf("Failed to load %s encoding: %v", name, err)
+		return nil
+	}
+	c.encodings[name] = encoding
+	return encoding
+}
+
+// CountText returns the number of tokens in the text, falls back to 4 characters per token
+// if the encoding cannot be loaded
+func (c *TokenCounter) CountText(model string, text string) int {
+	encoding := c.encoding(encodingForModel(model))
+	if encoding == nil {
+		return len(text)/4 + 1
+	}
+	return len(encoding.EncodeOrdinary(text))
+}
+
+// TokenOffsets returns the byte offset of the end of every token of the text, falls back to 4
+// bytes per token if the encoding cannot be loaded
+func (c *TokenCounter) TokenOffsets(model string, text string) []int {
+	offsets := []int{}
+	encoding := c.encoding(encodingForModel(model))
+	if encoding == nil {
+		for end := 4; end < len(text); end += 4 {
+			offsets = append(offsets, end)
+		}
+		if len(text) > 0 {
+			offsets = append(offsets, len(text))
+		}
+		return offsets
+	}
+	// The bytes of the tokens make up the text, a token may end inside a character
+	end := 0
+	for _, token := range encoding.EncodeOrdinary(text) {
+		end += len(encoding.Decode([]int{token}))
+		offsets = append(offsets, end)
+	}
+	return offsets
+}
+
+func (c *TokenCounter) cached(key string, count func() int) int {
+	c.mu.Lock()
+	tokens, ok := c.cache[key]
+	c.mu.Unlock()
+	if ok {
+		return tokens
+	}
+	tokens = count()
+	c.mu.Lock()
+	if len(c.cache) >= tokenCacheMaxMessages {
+		c.cache = make(map[string]int)
+	}
+	c.cache[key] = tokens
+	c.mu.Unlock()
+	return tokens
+}
+
+func cacheKey(encoding string, v interface{}) string {
+	data, _ := json.Marshal(v)
+	hash := sha1.Sum(data)
+	return encoding + ":" + hex.EncodeToString(hash[:])
+}
+
+func imageTokens(image gpt3.ChatCompletionRequestContentEntryImage) int {
+	if image.ImageUrl.Detail == "low" {
+		return imageLowDetailTokens
+	}
+	return imageLowDetailTokens + imageTileTokens*imageHighDetailTiles
+}
+
+// CountMessage returns the number of tokens the message takes in the prompt
+func (c *TokenCounter) CountMessage(model string, message gpt3.ChatCompletionRequestMessage) int {
+	encoding := encodingForModel(model)
+	return c.cached(cacheKey(encoding, message), func() int {
+		tokens := tokensPerMessage + c.CountText(model, message.Role)
+		if message.Name != "" {
+			tokens += tokensPerName + c.CountText(model, message.Name)
+		}
+		switch content := message.Content.(type) {
+		case string:
+			tokens += c.CountText(model, content)
+		case []interface{}:
+			for _, entry := range content {
+				switch entry := entry.(type) {
+				case gpt3.ChatCompletionRequestContentEntryText:
+					tokens += c.CountText(model, entry.Text)
+				case gpt3.ChatCompletionRequestContentEntryImage:
+					tokens += imageTokens(entry)
+				}
+			}
+		}
+		if message.FunctionCall != nil {
+			functionCall, _ := json.Marshal(message.FunctionCall)
+			tokens += c.CountText(model, string(functionCall))
+		}
+		for _, toolCall := range message.ToolCalls {
+			tokens += c.CountText(model, toolCall.ID+toolCall.Function.Name+toolCall.Function.Arguments)
+		}
+		return tokens
+	})
+}
+
+// CountMessages returns the number of prompt tokens of the conversation
+func (c *TokenCounter) CountMessages(model string, messages []gpt3.ChatCompletionRequestMessage) int {
+	tokens := tokensPerReply
+	for _, message := range messages {
+		tokens += c.CountMessage(model, message)
+	}
+	return tokens
+}
+
+// CountFunctions returns the number of prompt tokens taken by the function schemas
+func (c *TokenCounter) CountFunctions(model string, functions []gpt3.ChatCompletionRequestFunction) int {
+	tokens := 0
+	encoding := encodingForModel(model)
+	for _, function := range functions {
+		function := function
+		tokens += c.cached(cacheKey(encoding, function), func() int {
+			schema, _ := json.Marshal(function)
+			return c.CountText(model, string(schema))
+		})
+	}
+	return tokens
+}
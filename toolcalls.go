@@ -0,0 +1,104 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+
+	gpt3 "chat_bot/gpt3"
+)
+
+// upgradeFunctionCalls converts the legacy function_call and "function" messages of histories saved
+// before tool calls into tool_calls and "tool" messages, so that providers only deal with tools
+func upgradeFunctionCalls(messages []gpt3.ChatCompletionRequestMessage) []gpt3.ChatCompletionRequestMessage {
+	upgraded := make([]gpt3.ChatCompletionRequestMessage, 0, len(messages))
+	callID := ""
+	for i, message := range messages {
+		if functionCall, ok := message.FunctionCall.(gpt3.ChatCompletionResponseFunctionCall); ok {
+			message.FunctionCall = nil
+			if functionCall.Name != "" {
+				callID = fmt.Sprintf("call_%d", i)
+				message.ToolCalls = []gpt3.ChatCompletionToolCall{{
+					ID:       callID,
+					Type:     "function",
+					Function: functionCall,
+				}}
+			}
+		} else if message.Role == "function" {
+			text, _ := message.Content.(string)
+			if callID == "" {
+				// The call was lost, e.g. summarized by compaction
+				message = gpt3.ChatCompletionRequestMessage{
+					Role:    "user",
+					Content: message.Name + ": " + text,
+				}
+			} else {
+				message = gpt3.ChatCompletionRequestMessage{
+					Role:       "tool",
+					Content:    text,
+					ToolCallID: callID,
+				}
+				callID = ""
+			}
+		}
+		upgraded = append(upgraded, message)
+	}
+	return upgraded
+}
+
+// toolCallNames returns the names of the called tools by call ID, for APIs that match results by name
+func toolCallNames(messages []gpt3.ChatCompletionRequestMessage) map[string]string {
+	names := make(map[string]string)
+	for _, message := range messages {
+		for _, toolCall := range message.ToolCalls {
+			names[toolCall.ID] = toolCall.Function.Name
+		}
+	}
+	return names
+}
+
+// formatToolCall returns the call as it is shown in the answer
+func formatToolCall(toolCall gpt3.ChatCompletionToolCall) string {
+	return toolCall.Function.Name + "(" + toolCall.Function.Arguments + ")"
+}
+
+// executeToolCalls runs the calls concurrently and returns the "tool" result messages in the order
+// of the calls. Calls already made in this answer (callHistory) are not repeated.
+func executeToolCalls(call FunctionContext, toolCalls []gpt3.ChatCompletionToolCall, callHistory map[string]bool) []gpt3.ChatCompletionRequestMessage {
+	results := make([]gpt3.ChatCompletionRequestMessage, len(toolCalls))
+	wg := sync.WaitGroup{}
+	for i, toolCall := range toolCalls {
+		results[i] = gpt3.ChatCompletionRequestMessage{
+			Role:       "tool",
+			ToolCallID: toolCall.ID,
+		}
+		key := toolCall.Function.Name + toolCall.Function.Arguments
+		if callHistory[key] {
+			results[i].Content = "Ошибка вызова функции: повторный вызов функции с одними и теми же аргументами"
+			continue
+		}
+		callHistory[key] = true
+		wg.Add(1)
+		go func(i int, toolCall gpt3.ChatCompletionToolCall) {
+			defer wg.Done()
+			output, err := CallFunction(call, toolCall.Function.Name, toolCall.Function.Arguments)
+			if err != nil {
+				output = "Ошибка вызова функции: " + err.Error()
+			}
+			results[i].Content = output
+		}(i, toolCall)
+	}
+	wg.Wait()
+	return results
+}
+
+// toolCallErrors returns the errors of the results to show them in the answer
+func toolCallErrors(results []gpt3.ChatCompletionRequestMessage) string {
+	failures := []string{}
+	for _, result := range results {
+		if text, ok := result.Content.(string); ok && strings.HasPrefix(text, "Ошибка вызова функции") {
+			failures = append(failures, text)
+		}
+	}
+	return strings.Join(failures, "\n")
+}
@@ -0,0 +1,138 @@
+package main
+
+import (
+	"hash/fnv"
+	"log"
+	"strconv"
+	"strings"
+
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api/v5"
+)
+
+const (
+	toolsCallbackPrefix = "tools:"
+	// Descriptions of MCP tools can be pages long, the list must fit in a Telegram message
+	toolDescriptionMaxLength = 100
+	toolsMessageMaxLength    = 4000
+)
+
+// toolEnabled reports whether the model may call the function in the chat of the user. Inactive
+// functions are never offered, the others follow the choice of the user or are on by Default.
+func toolEnabled(user User, function Function) bool {
+	if function.Active == 0 {
+		return false
+	}
+	if enabled, ok := user.Tools[function.Name]; ok {
+		return enabled
+	}
+	return function.Default != 0
+}
+
+func toolsKeyboard(chatID int64) (string, tgbotapi.InlineKeyboardMarkup) {
+	mu.Lock()
+	user := userSettingsMap[chatID]
+	mu.Unlock()
+
+	text := "Инструменты, которые может вызывать модель:\n"
+	omitted := 0
+	rows := [][]tgbotapi.InlineKeyboardButton{}
+	for _, function := range functions {
+		if function.Active == 0 {
+			continue
+		}
+		title := "⬜ " + function.Name
+		if toolEnabled(user, function) {
+			title = "✅ " + function.Name
+		}
+		line := "\n" + function.Name + " — " + shortToolDescription(function.Description)
+		// The buttons still list the tools that don't fit in the text
+		if omitted > 0 || len([]rune(text+line)) > toolsMessageMaxLength {
+			omitted++
+		} else {
+			text += line
+		}
+		rows = append(rows, tgbotapi.NewInlineKeyboardRow(
+			tgbotapi.NewInlineKeyboardButtonData(title, toolsCallbackPrefix+toolCallbackKey(function.Name)),
+		))
+	}
+	if len(rows) == 0 {
+		return "Нет доступных инструментов.", tgbotapi.NewInlineKeyboardMarkup()
+	}
+	if omitted > 0 {
+		text += "\n\nИ ещё " + strconv.Itoa(omitted) + " — см. кнопки ниже."
+	}
+	return text, tgbotapi.NewInlineKeyboardMarkup(rows...)
+}
+
+// shortToolDescription returns the first line of the description cut to toolDescriptionMaxLength runes
+func shortToolDescription(description string) string {
+	description = strings.TrimSpace(description)
+	if i := strings.IndexByte(description, '\n'); i >= 0 {
+		description = strings.TrimSpace(description[:i])
+	}
+	runes := []rune(description)
+	if len(runes) <= toolDescriptionMaxLength {
+		return description
+	}
+	return strings.TrimSpace(string(runes[:toolDescriptionMaxLength-1])) + "…"
+}
+
+// toolCallbackKey identifies the tool in the callback data. Names of MCP tools can be longer than
+// the 64 bytes of callback data, and Ids depend on which MCP servers were started, so buttons of
+// old messages are keyed by a hash of the name.
+func toolCallbackKey(name string) string {
+	hash := fnv.New32a()
+	hash.Write([]byte(name))
+	return strconv.FormatUint(uint64(hash.Sum32()), 36)
+}
+
+// toggleTool switches the tool for the chat and returns the answer to the user
+func toggleTool(chatID int64, key string) string {
+	mu.Lock()
+	defer mu.Unlock()
+	for _, function := range functions {
+		if toolCallbackKey(function.Name) != key || function.Active == 0 {
+			continue
+		}
+		name := function.Name
+		user := userSettingsMap[chatID]
+		enabled := !toolEnabled(user, function)
+		// The map is copied as the old one may be shared with a copy of the settings
+		tools := make(map[string]bool, len(user.Tools)+1)
+		for key, value := range user.Tools {
+			tools[key] = value
+		}
+		tools[name] = enabled
+		user.Tools = tools
+		userSettingsMap[chatID] = user
+		if enabled {
+			return "Инструмент " + name + " включен"
+		}
+		return "Инструмент " + name + " выключен"
+	}
+	return "Инструмент недоступен"
+}
+
+func handleToolsCommand(bot *tgbotapi.BotAPI, message *tgbotapi.Message) {
+	text, keyboard := toolsKeyboard(message.Chat.ID)
+	msg := tgbotapi.NewMessage(message.Chat.ID, text)
+	if len(keyboard.InlineKeyboard) > 0 {
+		msg.ReplyMarkup = keyboard
+	}
+	bot.Send(msg)
+}
+
+func handleToolsCallback(bot *tgbotapi.BotAPI, query *tgbotapi.CallbackQuery) {
+	chatID := query.Message.Chat.ID
+	answer := toggleTool(chatID, strings.TrimPrefix(query.Data, toolsCallbackPrefix))
+	saveChat(chatID)
+	callback := tgbotapi.NewCallback(query.ID, answer)
+	if _, err := bot.Request(callback); err != nil {
+		log.Printf("Failed to answer callback: %v", err)
+	}
+	text, keyboard := toolsKeyboard(chatID)
+	msg := tgbotapi.NewEditMessageTextAndMarkup(chatID, query.Message.MessageID, text, keyboard)
+	if _, err := bot.Send(msg); err != nil {
+		log.Printf("Failed to edit message: %v", err)
+	}
+}
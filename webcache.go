@@ -0,0 +1,330 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	webCacheDefaultSearchTTL  = time.Hour
+	webCacheDefaultHTTPGetTTL = 5 * time.Minute
+	// Pages are not reused for longer whatever their headers say
+	webCacheMaxHTTPGetTTL = 24 * time.Hour
+	// Size of the values of a cache, the oldest entries are dropped beyond it
+	webCacheDefaultMaxSize = 64 << 20
+	// Expired entries that are not asked for again are removed this often
+	webCacheSweepInterval = time.Minute
+)
+
+// WebCacheConfig configures the caches of google_search and http_get, shared by all chats
+type WebCacheConfig struct {
+	// Dir keeps the caches in files that survive restarts, they are in memory only without it
+	Dir string `yaml:"dir"`
+	// SearchTTL in seconds, an hour by default, negative disables the cache
+	SearchTTL int `yaml:"search_ttl"`
+	// HTTPGetTTL in seconds is for the responses whose headers don't limit it, 5 minutes by default,
+	// negative disables the cache
+	HTTPGetTTL int `yaml:"http_get_ttl"`
+	// MaxSize in megabytes of each cache, in memory and in the files
+	MaxSize int `yaml:"max_size"`
+}
+
+// ttlCache keeps JSON values until they expire, in memory and optionally in files of dir. The
+// files are the same entries as the memory, they are read when the cache is created.
+// A nil cache is disabled.
+type ttlCache struct {
+	name    string
+	dir     string
+	maxSize int
+	mu      sync.Mutex
+	entries map[string]*cacheEntry
+	size    int
+	swept   time.Time
+	hits    int64
+	misses  int64
+}
+
+type cacheEntry struct {
+	Key     string          `json:"key"`
+	Value   json.RawMessage `json:"value"`
+	Expires time.Time       `json:"expires"`
+	Created time.Time       `json:"created"`
+}
+
+var (
+	searchCache  *ttlCache
+	httpGetCache *ttlCache
+	// TTL of the responses of http_get without cache headers
+	httpGetDefaultTTL = webCacheDefaultHTTPGetTTL
+)
+
+// newWebCaches creates the caches of the config
+func newWebCaches(cacheConfig WebCacheConfig) error {
+	maxSize := webCacheDefaultMaxSize
+	if cacheConfig.MaxSize > 0 {
+		maxSize = cacheConfig.MaxSize << 20
+	}
+	var err error
+	if cacheConfig.SearchTTL >= 0 {
+		if searchCache, err = newTTLCache("search", cacheConfig.Dir, maxSize); err != nil {
+			return err
+		}
+	}
+	if cacheConfig.HTTPGetTTL >= 0 {
+		if httpGetCache, err = newTTLCache("http_get", cacheConfig.Dir, maxSize); err != nil {
+			return err
+		}
+	}
+	if cacheConfig.HTTPGetTTL > 0 {
+		httpGetDefaultTTL = time.Duration(cacheConfig.HTTPGetTTL) * time.Second
+	}
+	return nil
+}
+
+// searchCacheTTL returns the TTL of the search results of the config
+func searchCacheTTL() time.Duration {
+	if config.WebCache.SearchTTL > 0 {
+		return time.Duration(config.WebCache.SearchTTL) * time.Second
+	}
+	return webCacheDefaultSearchTTL
+}
+
+func newTTLCache(name string, dir string, maxSize int) (*ttlCache, error) {
+	cache := &ttlCache{name: name, maxSize: maxSize, entries: make(map[string]*cacheEntry), swept: time.Now()}
+	if dir == "" {
+		return cache, nil
+	}
+	cache.dir = filepath.Join(dir, name)
+	// The pages may be private to the chats that asked for them
+	if err := os.MkdirAll(cache.dir, 0700); err != nil {
+		return nil, err
+	}
+	files, err := os.ReadDir(cache.dir)
+	if err != nil {
+		return nil, err
+	}
+	loaded := []*cacheEntry{}
+	for _, file := range files {
+		path := filepath.Join(cache.dir, file.Name())
+		entry, ok := readCacheFile(path)
+		if !ok || time.Now().After(entry.Expires) || path != cache.path(entry.Key) {
+			os.Remove(path)
+			continue
+		}
+		loaded = append(loaded, entry)
+	}
+	// The newest entries are kept when the files don't fit anymore, e.g. after max_size was lowered
+	sort.Slice(loaded, func(i, j int) bool {
+		return loaded[i].Created.Before(loaded[j].Created)
+	})
+	cache.mu.Lock()
+	for _, entry := range loaded {
+		cache.addLocked(entry)
+	}
+	cache.mu.Unlock()
+	return cache, nil
+}
+
+func readCacheFile(path string) (*cacheEntry, bool) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, false
+	}
+	entry := &cacheEntry{}
+	if err := json.Unmarshal(data, entry); err != nil {
+		return nil, false
+	}
+	return entry, true
+}
+
+func (c *ttlCache) path(key string) string {
+	hash := sha256.Sum256([]byte(key))
+	return filepath.Join(c.dir, hex.EncodeToString(hash[:])+".json")
+}
+
+// get decodes the cached value of the key into value and reports whether it was found
+func (c *ttlCache) get(key string, value interface{}) bool {
+	if c == nil {
+		return false
+	}
+	c.mu.Lock()
+	entry, ok := c.entries[key]
+	if ok && time.Now().After(entry.Expires) {
+		c.removeLocked(key)
+		ok = false
+	}
+	if ok && json.Unmarshal(entry.Value, value) != nil {
+		ok = false
+	}
+	if ok {
+		c.hits++
+		log.Printf("Cache %s hit, %d hits and %d misses", c.name, c.hits, c.misses)
+	} else {
+		c.misses++
+	}
+	c.mu.Unlock()
+	return ok
+}
+
+// set caches the value for ttl
+func (c *ttlCache) set(key string, value interface{}, ttl time.Duration) {
+	if c == nil || ttl <= 0 {
+		return
+	}
+	data, err := json.Marshal(value)
+	if err != nil || len(data) > c.maxSize {
+		return
+	}
+	now := time.Now()
+	entry := &cacheEntry{Key: key, Value: data, Expires: now.Add(ttl), Created: now}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if now.Sub(c.swept) > webCacheSweepInterval {
+		c.removeExpiredLocked()
+	}
+	c.removeLocked(key)
+	c.addLocked(entry)
+	if c.dir == "" {
+		return
+	}
+	file, err := json.Marshal(entry)
+	if err != nil {
+		return
+	}
+	// The file is replaced at once so that a crash doesn't leave half of it
+	path := c.path(key)
+	if err := os.WriteFile(path+".tmp", file, 0600); err != nil {
+		log.Printf("Failed to write cache %s: %v", c.name, err)
+		return
+	}
+	if err := os.Rename(path+".tmp", path); err != nil {
+		log.Printf("Failed to write cache %s: %v", c.name, err)
+	}
+}
+
+// addLocked adds the entry to memory, dropping the expired and then the oldest entries when the
+// cache is full. c.mu must be held.
+func (c *ttlCache) addLocked(entry *cacheEntry) {
+	c.entries[entry.Key] = entry
+	c.size += len(entry.Value)
+	if c.size <= c.maxSize {
+		return
+	}
+	c.removeExpiredLocked()
+	for c.size > c.maxSize {
+		oldest := ""
+		for key, cached := range c.entries {
+			if key != entry.Key && (oldest == "" || cached.Created.Before(c.entries[oldest].Created)) {
+				oldest = key
+			}
+		}
+		if oldest == "" {
+			return
+		}
+		c.removeLocked(oldest)
+	}
+}
+
+// removeExpiredLocked removes the expired entries and their files. c.mu must be held.
+func (c *ttlCache) removeExpiredLocked() {
+	now := time.Now()
+	for key, cached := range c.entries {
+		if now.After(cached.Expires) {
+			c.removeLocked(key)
+		}
+	}
+	c.swept = now
+}
+
+// removeLocked removes the entry from memory and its file. c.mu must be held.
+func (c *ttlCache) removeLocked(key string) {
+	entry, ok := c.entries[key]
+	if !ok {
+		return
+	}
+	c.size -= len(entry.Value)
+	delete(c.entries, key)
+	if c.dir != "" {
+		os.Remove(c.path(key))
+	}
+}
+
+// normalizeSearchQuery makes the queries that differ only in case, spacing and final punctuation
+// share the cached results
+func normalizeSearchQuery(query string) string {
+	query = strings.ToLower(strings.Join(strings.Fields(query), " "))
+	return strings.TrimRight(query, "?!.")
+}
+
+// searchCacheKey is the key of the results of the query with the options
+func searchCacheKey(query string, options SearchOptions) string {
+	return strings.Join([]string{
+		normalizeSearchQuery(query),
+		strings.ToLower(options.Country),
+		strings.ToLower(options.Language),
+		strconv.Itoa(options.Limit),
+		strconv.Itoa(options.Page),
+	}, "\n")
+}
+
+// httpCacheTTL returns how long the response may be reused according to its Cache-Control,
+// Expires and Age headers, defaultTTL when they don't limit it. The cache is shared by all chats,
+// so private responses are not cached.
+func httpCacheTTL(header http.Header, defaultTTL time.Duration) time.Duration {
+	maxAge := -1
+	sharedMaxAge := -1
+	for _, directive := range strings.Split(strings.ToLower(header.Get("Cache-Control")), ",") {
+		name, value, _ := strings.Cut(strings.TrimSpace(directive), "=")
+		seconds, err := strconv.Atoi(strings.Trim(value, `"`))
+		switch name {
+		case "no-store", "no-cache", "private":
+			return 0
+		case "max-age":
+			if err == nil {
+				maxAge = seconds
+			}
+		case "s-maxage":
+			if err == nil {
+				sharedMaxAge = seconds
+			}
+		}
+	}
+	if sharedMaxAge >= 0 {
+		maxAge = sharedMaxAge
+	}
+
+	ttl := defaultTTL
+	if maxAge >= 0 {
+		ttl = time.Duration(maxAge) * time.Second
+		if age, err := strconv.Atoi(header.Get("Age")); err == nil {
+			ttl -= time.Duration(age) * time.Second
+		}
+	} else if expires := header.Get("Expires"); expires != "" {
+		// Invalid dates, e.g. 0, mean that the response is already expired
+		expiresTime, err := http.ParseTime(expires)
+		if err != nil {
+			return 0
+		}
+		date, err := http.ParseTime(header.Get("Date"))
+		if err != nil {
+			date = time.Now()
+		}
+		ttl = expiresTime.Sub(date)
+	} else if strings.Contains(strings.ToLower(header.Get("Pragma")), "no-cache") {
+		return 0
+	}
+	if ttl > webCacheMaxHTTPGetTTL {
+		ttl = webCacheMaxHTTPGetTTL
+	}
+	return ttl
+}
@@ -0,0 +1,231 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strings"
+	"time"
+)
+
+const (
+	webhookDefaultTimeout = 30 * time.Second
+	// Larger responses are cut, the model can't read more anyway
+	webhookMaxResponseSize = 1 << 20
+)
+
+// WebhookTool is a tool declared in config.yml, the arguments of the model are forwarded to the URL
+// and the response is returned to the model
+type WebhookTool struct {
+	Name        string `yaml:"name"`
+	Description string `yaml:"description"`
+	// Parameters is the JSON schema of the arguments as JSON text, an object schema
+	Parameters string `yaml:"parameters"`
+	// URL may contain {argument} placeholders, they are replaced by the arguments escaped for the
+	// path or the query string. Requests without an argument of the URL fail.
+	URL string `yaml:"url"`
+	// Method is GET (default) or DELETE with the other arguments in the query string, or POST, PUT
+	// or PATCH with the other arguments as a JSON body
+	Method  string            `yaml:"method"`
+	Headers map[string]string `yaml:"headers"`
+	// ResponsePath is a JSONPath selecting the part of the JSON response returned to the model,
+	// e.g. $.data.items[*].title. The whole response is returned without it.
+	ResponsePath string `yaml:"response_path"`
+	// Timeout of a request in seconds
+	Timeout int `yaml:"timeout"`
+}
+
+// Webhook tools by name, they are also added to functions
+var webhookTools = make(map[string]WebhookTool)
+
+// webhookPlaceholderRegexp matches the {argument} placeholders of a URL
+var webhookPlaceholderRegexp = regexp.MustCompile(`\{[^{}/?&=#]+\}`)
+
+// registerWebhookTools checks the tools of the config and adds them to functions
+func registerWebhookTools(tools []WebhookTool) error {
+	for _, tool := range tools {
+		if !apiNameRegexp.MatchString(tool.Name) {
+			return fmt.Errorf("invalid tool name %q", tool.Name)
+		}
+		for _, function := range functions {
+			if function.Name == tool.Name {
+				return fmt.Errorf("tool %s is defined twice", tool.Name)
+			}
+		}
+		if _, err := url.Parse(tool.URL); err != nil || tool.URL == "" {
+			return fmt.Errorf("tool %s has invalid url %q", tool.Name, tool.URL)
+		}
+		tool.Method = strings.ToUpper(tool.Method)
+		switch tool.Method {
+		case "":
+			tool.Method = http.MethodGet
+		case http.MethodGet, http.MethodPost, http.MethodPut, http.MethodPatch, http.MethodDelete:
+		default:
+			return fmt.Errorf("tool %s has unsupported method %s", tool.Name, tool.Method)
+		}
+		if _, err := parseJSONPath(tool.ResponsePath); err != nil {
+			return fmt.Errorf("tool %s: %w", tool.Name, err)
+		}
+
+		args := FunctionArgs{Properties: map[string]interface{}{}}
+		if strings.TrimSpace(tool.Parameters) != "" {
+			_, schema, err := parseJSONSchema(tool.Parameters)
+			if err != nil {
+				return fmt.Errorf("tool %s: %w", tool.Name, err)
+			}
+			if args, err = functionArgsFromSchema(schema); err != nil {
+				return fmt.Errorf("tool %s: %w", tool.Name, err)
+			}
+		}
+		functions = append(functions, Function{
+			Id:          len(functions) + 1,
+			Name:        tool.Name,
+			Description: tool.Description,
+			Args:        args,
+			Default:     1,
+			Active:      1,
+		})
+		webhookTools[tool.Name] = tool
+	}
+	return nil
+}
+
+// webhookQueryValue formats an argument for the query string, numbers and booleans as in JSON
+func webhookQueryValue(value interface{}) string {
+	if text, ok := value.(string); ok {
+		return text
+	}
+	data, _ := json.Marshal(value)
+	return string(data)
+}
+
+// callWebhookTool forwards the arguments of the model to the endpoint of the tool. Responses longer
+// than the share of the context of a tool result are cut.
+func callWebhookTool(call FunctionContext, tool WebhookTool, args string) (string, error) {
+	output, err := requestWebhookTool(tool, args)
+	if err != nil {
+		return "", err
+	}
+	if pages := paginateText(output, call.Model.Name, call.resultTokens()); len(pages) > 1 {
+		output = pages[0] + "\n[ответ обрезан]"
+	}
+	return output, nil
+}
+
+// requestWebhookTool sends the request of the tool and returns the response or its response_path
+func requestWebhookTool(tool WebhookTool, args string) (string, error) {
+	arguments := map[string]interface{}{}
+	if strings.TrimSpace(args) != "" {
+		if err := json.Unmarshal([]byte(args), &arguments); err != nil {
+			return "", errors.New("Ошибка парсинга аргументов: " + err.Error())
+		}
+	}
+
+	// Arguments in the query string are escaped as query values, so that they can't add parameters
+	path, query, hasQuery := strings.Cut(tool.URL, "?")
+	rest := map[string]interface{}{}
+	for name, value := range arguments {
+		placeholder := "{" + name + "}"
+		if !strings.Contains(path, placeholder) && !strings.Contains(query, placeholder) {
+			rest[name] = value
+			continue
+		}
+		text := webhookQueryValue(value)
+		path = strings.ReplaceAll(path, placeholder, url.PathEscape(text))
+		query = strings.ReplaceAll(query, placeholder, url.QueryEscape(text))
+	}
+	endpoint := path
+	if hasQuery {
+		endpoint += "?" + query
+	}
+	if placeholder := webhookPlaceholderRegexp.FindString(endpoint); placeholder != "" {
+		return "", fmt.Errorf("missing argument %s of the url", strings.Trim(placeholder, "{}"))
+	}
+
+	var body io.Reader
+	switch tool.Method {
+	case http.MethodGet, http.MethodDelete:
+		u, err := url.Parse(endpoint)
+		if err != nil {
+			return "", err
+		}
+		query := u.Query()
+		for name, value := range rest {
+			if values, ok := value.([]interface{}); ok {
+				for _, value := range values {
+					query.Add(name, webhookQueryValue(value))
+				}
+				continue
+			}
+			query.Set(name, webhookQueryValue(value))
+		}
+		u.RawQuery = query.Encode()
+		endpoint = u.String()
+	default:
+		data, err := json.Marshal(rest)
+		if err != nil {
+			return "", err
+		}
+		body = bytes.NewReader(data)
+	}
+
+	timeout := webhookDefaultTimeout
+	if tool.Timeout > 0 {
+		timeout = time.Duration(tool.Timeout) * time.Second
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, tool.Method, endpoint, body)
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Accept", "application/json")
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	for key, value := range tool.Headers {
+		req.Header.Set(key, value)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	data, err := io.ReadAll(io.LimitReader(resp.Body, webhookMaxResponseSize))
+	if err != nil {
+		return "", err
+	}
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		text := string(data)
+		if len(text) > 1000 {
+			text = text[:1000]
+		}
+		return "", fmt.Errorf("HTTP %d: %s", resp.StatusCode, text)
+	}
+	if tool.ResponsePath == "" {
+		return string(data), nil
+	}
+
+	var value interface{}
+	if err := json.Unmarshal(data, &value); err != nil {
+		return "", fmt.Errorf("ответ не является JSON: %w", err)
+	}
+	selected, err := evalJSONPath(value, tool.ResponsePath)
+	if err != nil {
+		return "", err
+	}
+	if text, ok := selected.(string); ok {
+		return text, nil
+	}
+	output, err := json.Marshal(selected)
+	if err != nil {
+		return "", err
+	}
+	return string(output), nil
+}
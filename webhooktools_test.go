@@ -0,0 +1,44 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestRequestWebhookToolPlaceholders(t *testing.T) {
+	requests := []*http.Request{}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests = append(requests, r)
+		w.Write([]byte("ok"))
+	}))
+	defer server.Close()
+
+	tool := WebhookTool{Name: "search", URL: server.URL + "/items/{id}?q={query}&key=secret", Method: http.MethodGet}
+	_, err := requestWebhookTool(tool, `{"id":"a/b?c","query":"x&key=stolen","limit":5}`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(requests) != 1 {
+		t.Fatalf("requests = %d", len(requests))
+	}
+	if path := requests[0].URL.EscapedPath(); path != "/items/a%2Fb%3Fc" {
+		t.Errorf("path = %s", path)
+	}
+	// The argument can't add or override parameters of the query string
+	expected := url.Values{"q": {"x&key=stolen"}, "key": {"secret"}, "limit": {"5"}}
+	if query := requests[0].URL.Query(); !reflect.DeepEqual(query, expected) {
+		t.Errorf("query = %v", query)
+	}
+
+	_, err = requestWebhookTool(tool, `{"id":"1"}`)
+	if err == nil || !strings.Contains(err.Error(), "query") {
+		t.Errorf("err = %v", err)
+	}
+	if len(requests) != 1 {
+		t.Errorf("a request with a missing argument was sent")
+	}
+}